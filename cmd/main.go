@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	"k8s.io/klog"
 
@@ -43,6 +44,14 @@ func init() {
 	flag.StringVar(&conf.NodeID, "nodeid", "", "node id")
 	flag.BoolVar(&conf.IsControllerServer, "controller", false, "Start controller server")
 	flag.BoolVar(&conf.IsNodeServer, "node", false, "Start node server")
+	flag.DurationVar(&conf.ShutdownTimeout, "shutdown-timeout", 25*time.Second, "Max time to drain in-flight requests on termination")
+	flag.Var(&conf.RPCTimeouts, "rpc-timeouts", "SPDK JSON-RPC timeout per method, e.g., bdev_lvol_create=5m,bdev_lvol_delete=5m")
+	flag.StringVar(&conf.StateDir, "state-dir", "/var/lib/kubelet/plugins/csi.spdk.io/volumes", "Node local directory to persist staged volumes")
+	flag.StringVar(&conf.NVMfConnector, "nvmf-connector", util.NVMfConnectorNative,
+		"How node connects to NVMe-oF target, native(/dev/nvme-fabrics) or nvme-cli")
+	flag.StringVar(&conf.LocalRPCURL, "local-rpc-url", "",
+		"SPDK JSON-RPC url of node local SPDK serving nbd volumes, e.g., unix:///var/tmp/spdk.sock, disabled if empty")
+	flag.StringVar(&conf.MetricsAddr, "metrics-addr", "", "Prometheus metrics listen address, e.g., :9090, disabled if empty")
 
 	klog.InitFlags(nil)
 	if err := flag.Set("logtostderr", "true"); err != nil {
@@ -3,13 +3,16 @@ module github.com/spdk/spdk-csi
 go 1.14
 
 require (
-	github.com/container-storage-interface/spec v1.2.0
+	github.com/container-storage-interface/spec v1.3.0
 	github.com/golang/protobuf v1.4.2
 	github.com/google/uuid v1.1.1
 	github.com/kubernetes-csi/csi-lib-utils v0.7.0
+	github.com/kubernetes-csi/csi-test/v4 v4.0.2
 	github.com/onsi/ginkgo v1.11.0
-	github.com/onsi/gomega v1.7.0
-	google.golang.org/grpc v1.27.1
+	github.com/onsi/gomega v1.7.1
+	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/sys v0.0.0-20200622214017-ed371f2e16b4
+	google.golang.org/grpc v1.29.1
 	k8s.io/apimachinery v0.19.3
 	k8s.io/client-go v0.19.3
 	k8s.io/klog v1.0.0
@@ -40,29 +40,33 @@ func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
 type nonBlockingGRPCServer struct {
 	wg     sync.WaitGroup
 	server *grpc.Server
+	socket string // unix socket file, removed on exit
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
-	s.wg.Add(1)
+	// setup server synchronously so Stop is safe once Start returns
+	listener := s.listen(endpoint)
+	s.server = newGRPCServer(ids, cs, ns)
 
-	go s.serve(endpoint, ids, cs, ns)
+	s.wg.Add(1)
+	go s.serve(listener)
 }
 
 func (s *nonBlockingGRPCServer) Wait() {
 	s.wg.Wait()
 }
 
+// Stop stops accepting new requests and blocks until in-flight ones finish
 func (s *nonBlockingGRPCServer) Stop() {
 	s.server.GracefulStop()
 }
 
+// ForceStop closes all connections and cancels in-flight requests
 func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
-	var err error
-
+func (s *nonBlockingGRPCServer) listen(endpoint string) net.Listener {
 	proto, addr, err := parseEndpoint(endpoint)
 	if err != nil {
 		klog.Fatal(err.Error())
@@ -73,18 +77,21 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
 			klog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
 		}
+		s.socket = addr
 	}
 
 	listener, err := net.Listen(proto, addr)
 	if err != nil {
 		klog.Fatalf("Failed to listen: %v", err)
 	}
+	return listener
+}
 
+func newGRPCServer(ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) *grpc.Server {
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.UnaryInterceptor(chainUnaryInterceptors(metricsGRPC, logGRPC)),
 	}
 	server := grpc.NewServer(opts...)
-	s.server = server
 
 	if ids != nil {
 		csi.RegisterIdentityServer(server, ids)
@@ -95,11 +102,24 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	if ns != nil {
 		csi.RegisterNodeServer(server, ns)
 	}
+	return server
+}
+
+func (s *nonBlockingGRPCServer) serve(listener net.Listener) {
+	defer s.wg.Done()
 
 	klog.Infof("Listening for connections on address: %#v", listener.Addr())
 
-	err = server.Serve(listener)
+	// returns nil after Stop or ForceStop
+	err := s.server.Serve(listener)
 	if err != nil {
 		klog.Fatalf("Failed to start GRPC server: %v", err)
 	}
+
+	if s.socket != "" {
+		if err = os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("Failed to remove %s, error: %s", s.socket, err.Error())
+		}
+	}
+	klog.Info("GRPC server stopped")
 }
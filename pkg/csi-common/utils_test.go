@@ -0,0 +1,68 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsGRPC(t *testing.T) {
+	const metricName = "spdkcsi_csi_request_duration_seconds"
+	count := func() int {
+		n, err := testutil.GatherAndCount(prometheus.DefaultGatherer, metricName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/TestMetricsGRPC"}
+	errNotFound := status.Error(codes.NotFound, "not found")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if req == nil {
+			return nil, errNotFound
+		}
+		return req, nil
+	}
+
+	// one histogram per method and status code
+	before := count()
+	resp, err := metricsGRPC(context.Background(), nil, info, handler)
+	if resp != nil || err != errNotFound {
+		t.Fatalf("unexpected result: %v, %v", resp, err)
+	}
+	if count() != before+1 {
+		t.Fatalf("request not observed: %d, %d", before, count())
+	}
+	_, _ = metricsGRPC(context.Background(), nil, info, handler)
+	if count() != before+1 {
+		t.Fatalf("same method and code should share histogram: %d, %d", before, count())
+	}
+	resp, err = metricsGRPC(context.Background(), "req", info, handler)
+	if resp != "req" || err != nil {
+		t.Fatalf("unexpected result: %v, %v", resp, err)
+	}
+	if count() != before+2 {
+		t.Fatalf("request of different code not observed: %d, %d", before, count())
+	}
+}
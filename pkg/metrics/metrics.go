@@ -0,0 +1,145 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+const namespace = "spdkcsi"
+
+var (
+	// CSI gRPC requests, counts are exported as histogram _count
+	grpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "csi_request_duration_seconds",
+			Help:      "CSI gRPC request latency by method and status code.",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"method", "code"},
+	)
+
+	// SPDK JSON-RPC calls to storage nodes
+	spdkRPCDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "spdk_rpc_duration_seconds",
+			Help:      "SPDK JSON-RPC call latency by storage node and method.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"node", "method"},
+	)
+	spdkRPCErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spdk_rpc_errors_total",
+			Help:      "SPDK JSON-RPC call failures by storage node and method.",
+		},
+		[]string{"node", "method"},
+	)
+	spdkRPCRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spdk_rpc_retries_total",
+			Help:      "SPDK JSON-RPC retry attempts by storage node and method.",
+		},
+		[]string{"node", "method"},
+	)
+	spdkRPCRetryResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spdk_rpc_retried_calls_total",
+			Help:      "SPDK JSON-RPC calls needed retry by storage node, method and final result.",
+		},
+		[]string{"node", "method", "result"},
+	)
+
+	// NVMf/iSCSI initiator operations
+	initiatorDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "initiator_duration_seconds",
+			Help:      "Initiator connect and disconnect latency by target type and result.",
+			Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 20, 40, 60},
+		},
+		[]string{"type", "operation", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcDuration, spdkRPCDuration, spdkRPCErrors, spdkRPCRetries, spdkRPCRetryResults, initiatorDuration)
+}
+
+// Register adds collector to default registry, e.g., lvstore capacity
+func Register(collector prometheus.Collector) error {
+	return prometheus.Register(collector)
+}
+
+// Serve starts http listener exposing /metrics, returns immediately
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		klog.Infof("serving metrics on %s", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			klog.Errorf("metrics listener failed: %s", err)
+		}
+	}()
+}
+
+// ObserveGRPC records a CSI gRPC request
+func ObserveGRPC(method, code string, start time.Time) {
+	grpcDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+// ObserveSpdkRPC records a SPDK JSON-RPC call
+func ObserveSpdkRPC(node, method string, start time.Time, err error) {
+	spdkRPCDuration.WithLabelValues(node, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		spdkRPCErrors.WithLabelValues(node, method).Inc()
+	}
+}
+
+// ObserveSpdkRPCRetry records a retry attempt of a SPDK JSON-RPC call
+func ObserveSpdkRPCRetry(node, method string) {
+	spdkRPCRetries.WithLabelValues(node, method).Inc()
+}
+
+// ObserveSpdkRPCRetryResult records final result of a retried SPDK JSON-RPC call
+func ObserveSpdkRPCRetryResult(node, method string, err error) {
+	spdkRPCRetryResults.WithLabelValues(node, method, result(err)).Inc()
+}
+
+// ObserveInitiator records an initiator connect or disconnect operation
+func ObserveInitiator(targetType, operation string, start time.Time, err error) {
+	initiatorDuration.WithLabelValues(targetType, operation, result(err)).Observe(time.Since(start).Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
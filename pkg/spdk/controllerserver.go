@@ -18,8 +18,13 @@ package spdk
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes"
@@ -28,31 +33,61 @@ import (
 	"k8s.io/klog"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
 	"github.com/spdk/spdk-csi/pkg/util"
 )
 
 var errVolumeInCreation = status.Error(codes.Internal, "volume in creation")
 
+const (
+	// max time to clean up resources of a failed request
+	rollbackTimeout = 2 * time.Minute
+	// interval and max time to repair degraded replicated volumes
+	repairInterval = time.Minute
+	repairTimeout  = 5 * time.Minute
+)
+
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
 
-	spdkNodes []util.SpdkNode // all spdk nodes in cluster
+	spdkNodes  []util.SpdkNode          // spdk nodes shared by cluster
+	localNodes map[string]util.SpdkNode // node local spdk by kubernetes node name
+	vhostNodes map[util.SpdkNode]bool   // local spdk serving vhost, block volumes only
+
+	volumes       map[string]*volume         // volume id to volume struct
+	volumesIdem   map[string]string          // volume name to id, for CreateVolume idempotency
+	mtx           sync.Mutex                 // protect volumes and volumesIdem map
+	snapshotsIdem map[string]csi.Snapshot    // snapshot id to csi.Snapshot struct
+	snapshotNames map[string]string          // snapshot name to id, for CreateSnapshot idempotency
+	snapshotKeys  map[string]*util.CryptoKey // snapshot id to key of encrypted source volume
+	snapshotsGone map[string]util.SpdkNode   // deleted snapshot id to node, lvol kept until clones are deleted
+	mtxSnapshot   sync.RWMutex               // protect snapshot maps
 
-	volumes       map[string]*volume      // volume id to volume struct
-	volumesIdem   map[string]string       // volume name to id, for CreateVolume idempotency
-	mtx           sync.Mutex              // protect volumes and volumesIdem map
-	snapshotsIdem map[string]csi.Snapshot // snapshot id to csi.Snapshot struct
-	mtxSnapshot   sync.RWMutex            // protect snapshotsIdem map
+	certs *certReloader // reloads certificates of https spdk nodes
 }
 
 type volume struct {
 	name      string // CO provided volume name
 	spdkNode  util.SpdkNode
 	csiVolume csi.Volume
-	mtx       sync.Mutex // per volume lock to serialize DeleteVolume requests
+	cryptoKey *util.CryptoKey // nil if volume is not encrypted
+	replicas  []*replica      // remote replicas of raid1 built on spdkNode
+	mtx       sync.Mutex      // per volume lock to serialize DeleteVolume requests
+}
+
+type replica struct {
+	spdkNode util.SpdkNode
+	lvolID   string
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume name missing")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing")
+	}
+
 	// be idempotent to duplicated requests
 	volume, err := func() (*volume, error) {
 		const creatingTag = "__CREATING__"
@@ -68,6 +103,9 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			}
 			// another task has successfully processed same request
 			volume := cs.volumes[volumeID]
+			if !capacityCompatible(volume.csiVolume.GetCapacityBytes(), req.GetCapacityRange()) {
+				return nil, status.Errorf(codes.AlreadyExists, "volume %s exists with different capacity", req.Name)
+			}
 			klog.Warningf("volume exists: %s, %p", req.Name, volume)
 			return volume, nil
 		}
@@ -91,15 +129,46 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 	}()
 
-	volume, err = cs.createVolume(req)
+	cryptoKey, err := getCryptoKey(req.GetParameters(), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	replicaCount, err := cs.getReplicaCount(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	local, err := getLocal(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	if local && replicaCount > 1 {
+		return nil, status.Error(codes.InvalidArgument, "node local volume cannot be replicated")
+	}
+	// nvmf host parameters are passed to node in volume context
+	err = util.ValidateNVMfHostParams(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// so are mkfs parameters, applied when node formats the volume
+	for _, fsType := range mountFsTypes(req) {
+		err = util.ValidateMkfsParams(fsType, req.GetParameters())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	volume, err = cs.createVolume(ctx, req, cryptoKey, replicaCount, local)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, rpcStatus(err)
 	}
 
-	volumeInfo, err := publishVolume(volume)
+	volumeInfo, err := publishVolume(ctx, volume)
 	if err != nil {
-		deleteVolume(volume) // nolint:errcheck // we can do little
-		return nil, status.Error(codes.Internal, err.Error())
+		rollbackCtx, cancel := rollbackContext()
+		defer cancel()
+		deleteVolume(rollbackCtx, volume) // nolint:errcheck // we can do little
+		deleteReplicas(rollbackCtx, volume)
+		return nil, rpcStatus(err)
 	}
 	// copy volume info. node needs these info to contact target(ip, port, nqn, ...)
 	if volume.csiVolume.VolumeContext == nil {
@@ -121,6 +190,9 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing")
+	}
 	cs.mtx.Lock()
 	volume, exists := cs.volumes[volumeID]
 	cs.mtx.Unlock()
@@ -137,7 +209,7 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	defer volume.mtx.Unlock()
 
 	// no harm if volume already unpublished
-	err := unpublishVolume(volume)
+	err := unpublishVolume(ctx, volume)
 	switch {
 	case err == util.ErrVolumeUnpublished:
 		// unpublished but not deleted in last request?
@@ -146,18 +218,23 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		// deleted in previous request?
 		klog.Warningf("volume already deleted: %s", volumeID)
 	case err != nil:
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, rpcStatus(err)
 	}
 
 	// no harm if volume already deleted
-	err = deleteVolume(volume)
-	if err == util.ErrJSONNoSuchDevice {
+	err = deleteVolume(ctx, volume)
+	if errors.Is(err, spdkrpc.ErrNoSuchDevice) {
 		// deleted in previous request?
 		klog.Warningf("volume not exists: %s", volumeID)
 	} else if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, rpcStatus(err)
 	}
 
+	// replicas are not accessed by anyone after raid1 is deleted
+	deleteReplicas(ctx, volume)
+	// one clone less, deleted snapshots may be deletable now
+	cs.purgeSnapshots(ctx, volume.spdkNode)
+
 	// no harm if volumeID already deleted
 	cs.mtx.Lock()
 	delete(cs.volumes, volumeID)
@@ -167,8 +244,111 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing")
+	}
+	cs.mtx.Lock()
+	volume, exists := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume not found: %s", volumeID)
+	}
+
+	volume.mtx.Lock()
+	defer volume.mtx.Unlock()
+
+	// degraded replicated volume is repaired in background, see runRepair
+	condition, err := volume.spdkNode.VolumeCondition(ctx, volumeID)
+	if err != nil {
+		return nil, rpcStatus(err)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &volume.csiVolume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: condition.Abnormal,
+				Message:  condition.Message,
+			},
+		},
+	}, nil
+}
+
+// repair degraded replicated volumes periodically until ctx is done
+func (cs *controllerServer) runRepair(ctx context.Context) {
+	ticker := time.NewTicker(repairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cs.repairVolumes(ctx)
+	}
+}
+
+// lost replica may come back, add it to raid and rebuild
+func (cs *controllerServer) repairVolumes(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, repairTimeout)
+	defer cancel()
+
+	var volumes []*volume
+	cs.mtx.Lock()
+	for _, volume := range cs.volumes {
+		volumes = append(volumes, volume)
+	}
+	cs.mtx.Unlock()
+
+	for _, volume := range volumes {
+		cs.repairVolume(ctx, volume)
+	}
+}
+
+func (cs *controllerServer) repairVolume(ctx context.Context, volume *volume) {
+	volume.mtx.Lock()
+	defer volume.mtx.Unlock()
+
+	volumeID := volume.csiVolume.GetVolumeId()
+	if len(volume.replicas) == 0 {
+		return
+	}
+	condition, err := volume.spdkNode.VolumeCondition(ctx, volumeID)
+	if err != nil {
+		klog.Errorf("failed to check volume %s: %s", volumeID, err)
+		return
+	}
+	if !condition.Abnormal {
+		return
+	}
+	err = volume.spdkNode.RepairVolume(ctx, volumeID)
+	if err != nil {
+		klog.Errorf("failed to repair volume %s: %s", volumeID, err)
+	}
+}
+
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing")
+	}
+	cs.mtx.Lock()
+	volume, exists := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume not found: %s", volumeID)
+	}
+
 	// make sure we support all requested caps
+	err := cs.checkAccessType(volume.spdkNode, req.GetVolumeCapabilities())
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+	}
 	for _, cap := range req.VolumeCapabilities {
 		supported := false
 		for _, accessMode := range cs.Driver.GetVolumeCapabilityAccessModes() {
@@ -191,6 +371,9 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	lvolID := req.GetSourceVolumeId()
 	snapshotName := req.GetName()
+	if snapshotName == "" || lvolID == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name or source volume id missing")
+	}
 
 	cs.mtx.Lock()
 	volume, exists := cs.volumes[lvolID]
@@ -201,7 +384,7 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}
 
 	cs.mtxSnapshot.RLock()
-	if exSnap, ok := cs.snapshotsIdem[snapshotName]; ok {
+	if exSnap, ok := cs.snapshotsIdem[cs.snapshotNames[snapshotName]]; ok {
 		cs.mtxSnapshot.RUnlock()
 		if exSnap.SourceVolumeId == lvolID {
 			return &csi.CreateSnapshotResponse{
@@ -212,9 +395,9 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}
 	cs.mtxSnapshot.RUnlock()
 
-	snapshotID, err := volume.spdkNode.CreateSnapshot(lvolID, snapshotName)
+	snapshotID, err := volume.spdkNode.CreateSnapshot(ctx, lvolID, snapshotName, volume.cryptoKey != nil)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, rpcStatus(err)
 	}
 
 	creationTime := ptypes.TimestampNow()
@@ -228,6 +411,11 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 
 	cs.mtxSnapshot.Lock()
 	cs.snapshotsIdem[snapshotID] = snapshotData
+	cs.snapshotNames[snapshotName] = snapshotID
+	if volume.cryptoKey != nil {
+		// snapshot data is encrypted, clones must use the same key
+		cs.snapshotKeys[snapshotID] = volume.cryptoKey
+	}
 	cs.mtxSnapshot.Unlock()
 
 	return &csi.CreateSnapshotResponse{
@@ -236,13 +424,17 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 }
 
 func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	snapshotID := req.SnapshotId
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot id missing")
+	}
 	cs.mtxSnapshot.RLock()
 	exSnap, exists := cs.snapshotsIdem[snapshotID]
 	cs.mtxSnapshot.RUnlock()
 	if !exists {
+		// already deleted?
 		klog.Warningf("snapshot does not exist: %s", snapshotID)
-		return &csi.DeleteSnapshotResponse{}, status.Error(codes.Internal, "snapshot does not exist")
+		return &csi.DeleteSnapshotResponse{}, nil
 	}
 
 	sourceVolumeID := exSnap.SourceVolumeId
@@ -254,19 +446,34 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		return &csi.DeleteSnapshotResponse{}, status.Error(codes.Internal, "snapshot source volume does not exist")
 	}
 
-	err := volume.spdkNode.DeleteVolume(snapshotID)
+	err := volume.spdkNode.DeleteVolume(ctx, snapshotID)
+	if errors.Is(err, spdkrpc.ErrNotPermitted) {
+		// spdk refuses deleting snapshot of more than one clone, source volume
+		// is already one, lvol is deleted after clones, see purgeSnapshots
+		klog.Warningf("snapshot %s has clones, deleting it later", snapshotID)
+		err = nil
+		cs.mtxSnapshot.Lock()
+		cs.snapshotsGone[snapshotID] = volume.spdkNode
+		cs.mtxSnapshot.Unlock()
+	}
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, rpcStatus(err)
 	}
 
 	cs.mtxSnapshot.Lock()
 	delete(cs.snapshotsIdem, snapshotID)
+	delete(cs.snapshotKeys, snapshotID)
+	for name, id := range cs.snapshotNames {
+		if id == snapshotID {
+			delete(cs.snapshotNames, name)
+		}
+	}
 	cs.mtxSnapshot.Unlock()
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*volume, error) {
+func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest, cryptoKey *util.CryptoKey, replicaCount int, local bool) (*volume, error) {
 	size := req.GetCapacityRange().GetRequiredBytes()
 	if size == 0 {
 		klog.Warningln("invalid volume size, resize to 1G")
@@ -274,72 +481,514 @@ func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*volume,
 	}
 	sizeMiB := util.ToMiB(size)
 
-	// schedule suitable node:lvstore
-	spdkNode, lvstore, err := cs.schedule(sizeMiB)
+	vol := &volume{
+		name: req.Name,
+	}
+	var volumeID string
+	var err error
+
+	if snapshotID := req.GetVolumeContentSource().GetSnapshot().GetSnapshotId(); snapshotID != "" {
+		if replicaCount > 1 {
+			return nil, status.Error(codes.InvalidArgument, "cannot create replicated volume from snapshot")
+		}
+		cryptoKey, err = cs.cloneCryptoKey(ctx, snapshotID, cryptoKey)
+		if err != nil {
+			return nil, err
+		}
+		vol.spdkNode, volumeID, sizeMiB, err = cs.cloneVolume(ctx, snapshotID, sizeMiB, cryptoKey != nil, req.GetVolumeCapabilities())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// schedule suitable node:lvstore, first one hosts raid1 if replicated
+		var spdkNodes []util.SpdkNode
+		var lvstores []string
+		if local {
+			spdkNodes, lvstores, err = cs.scheduleLocal(ctx, req.GetAccessibilityRequirements(), sizeMiB)
+		} else {
+			spdkNodes, lvstores, err = cs.schedule(ctx, sizeMiB, replicaCount)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vol.spdkNode = spdkNodes[0]
+		err = cs.checkAccessType(vol.spdkNode, req.GetVolumeCapabilities())
+		if err != nil {
+			return nil, err
+		}
+		err = requireFeatures(ctx, vol.spdkNode, cryptoKey != nil, replicaCount > 1)
+		if err != nil {
+			return nil, err
+		}
+
+		// TODO: re-schedule on spdkrpc.ErrNoSpaceLeft per optimistic concurrency control
+		volumeID, err = vol.spdkNode.CreateVolume(ctx, lvstores[0], sizeMiB)
+		if err != nil {
+			return nil, err
+		}
+
+		if replicaCount > 1 {
+			err = createReplicas(ctx, vol, volumeID, spdkNodes[1:], lvstores[1:], sizeMiB)
+			if err != nil {
+				rollbackCtx, cancel := rollbackContext()
+				defer cancel()
+				vol.spdkNode.DeleteVolume(rollbackCtx, volumeID) // nolint:errcheck // we can do little
+				return nil, err
+			}
+		}
+	}
+	vol.csiVolume = csi.Volume{
+		VolumeId:      volumeID,
+		CapacityBytes: sizeMiB * 1024 * 1024,
+		VolumeContext: req.GetParameters(),
+		ContentSource: req.GetVolumeContentSource(),
+		// node local and vhost volumes, and their clones, are pinned to the node
+		AccessibleTopology: cs.topology(vol.spdkNode),
+	}
+
+	if cryptoKey != nil {
+		err = vol.spdkNode.EncryptVolume(ctx, volumeID, cryptoKey)
+		if err != nil {
+			rollbackCtx, cancel := rollbackContext()
+			defer cancel()
+			deleteVolume(rollbackCtx, vol) // nolint:errcheck // we can do little
+			deleteReplicas(rollbackCtx, vol)
+			return nil, err
+		}
+		vol.cryptoKey = cryptoKey
+	}
+
+	return vol, nil
+}
+
+// create and export replica lvols, build raid1 over them on primary node
+func createReplicas(ctx context.Context, vol *volume, volumeID string, spdkNodes []util.SpdkNode, lvstores []string, sizeMiB int64) (err error) {
+	defer func() {
+		if err != nil {
+			rollbackCtx, cancel := rollbackContext()
+			defer cancel()
+			deleteReplicas(rollbackCtx, vol)
+		}
+	}()
+
+	var replicaInfos []map[string]string
+	for i, spdkNode := range spdkNodes {
+		lvolID, err := spdkNode.CreateVolume(ctx, lvstores[i], sizeMiB)
+		if err != nil {
+			return err
+		}
+		vol.replicas = append(vol.replicas, &replica{spdkNode: spdkNode, lvolID: lvolID})
+
+		err = spdkNode.PublishVolume(ctx, lvolID)
+		if err != nil {
+			return err
+		}
+		info, err := spdkNode.VolumeInfo(lvolID)
+		if err != nil {
+			return err
+		}
+		if targetType := strings.ToLower(info["targetType"]); targetType != "tcp" && targetType != "rdma" {
+			return fmt.Errorf("replica node %s is not an NVMe-oF target", spdkNode.Info())
+		}
+		replicaInfos = append(replicaInfos, info)
+	}
+
+	return vol.spdkNode.ReplicateVolume(ctx, volumeID, replicaInfos)
+}
+
+// unexport and delete replica lvols, errors are logged and ignored
+func deleteReplicas(ctx context.Context, vol *volume) {
+	for _, r := range vol.replicas {
+		err := r.spdkNode.UnpublishVolume(ctx, r.lvolID)
+		if err != nil && err != util.ErrVolumeUnpublished && err != util.ErrVolumeDeleted {
+			klog.Errorf("failed to unpublish replica %s on %s: %s", r.lvolID, r.spdkNode.Info(), err)
+		}
+		err = r.spdkNode.DeleteVolume(ctx, r.lvolID)
+		if err != nil && !errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+			klog.Errorf("failed to delete replica %s on %s: %s", r.lvolID, r.spdkNode.Info(), err)
+		}
+	}
+	vol.replicas = nil
+}
+
+// clone volume from snapshot on the node hosting the snapshot
+func (cs *controllerServer) cloneVolume(ctx context.Context, snapshotID string, sizeMiB int64, encrypted bool, caps []*csi.VolumeCapability) (util.SpdkNode, string, int64, error) {
+	snapshot, source, err := cs.snapshotSource(snapshotID)
 	if err != nil {
-		return nil, err
+		return nil, "", 0, err
+	}
+	err = cs.checkAccessType(source.spdkNode, caps)
+	if err != nil {
+		return nil, "", 0, err
 	}
 
-	// TODO: re-schedule on ErrJSONNoSpaceLeft per optimistic concurrency control
-	volumeID, err := spdkNode.CreateVolume(lvstore, sizeMiB)
+	// resize clone only if requested size is larger than snapshot
+	snapshotSizeMiB := util.ToMiB(snapshot.GetSizeBytes())
+	resizeMiB := int64(0)
+	if sizeMiB > snapshotSizeMiB {
+		resizeMiB = sizeMiB
+	} else {
+		sizeMiB = snapshotSizeMiB
+	}
+
+	err = requireFeatures(ctx, source.spdkNode, encrypted, false)
 	if err != nil {
-		return nil, err
+		return nil, "", 0, err
 	}
+	volumeID, err := source.spdkNode.CloneVolume(ctx, snapshotID, resizeMiB)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return source.spdkNode, volumeID, sizeMiB, nil
+}
 
-	return &volume{
-		name:     req.Name,
-		spdkNode: spdkNode,
-		csiVolume: csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: sizeMiB * 1024 * 1024,
-			VolumeContext: req.GetParameters(),
-			ContentSource: req.GetVolumeContentSource(),
-		},
-	}, nil
+// snapshot and its source volume
+func (cs *controllerServer) snapshotSource(snapshotID string) (*csi.Snapshot, *volume, error) {
+	cs.mtxSnapshot.RLock()
+	snapshot, exists := cs.snapshotsIdem[snapshotID]
+	cs.mtxSnapshot.RUnlock()
+	if !exists {
+		return nil, nil, status.Errorf(codes.NotFound, "snapshot not found: %s", snapshotID)
+	}
+
+	cs.mtx.Lock()
+	source, exists := cs.volumes[snapshot.SourceVolumeId]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, nil, status.Errorf(codes.NotFound, "snapshot source volume not found: %s", snapshot.SourceVolumeId)
+	}
+	return &snapshot, source, nil
 }
 
-func publishVolume(volume *volume) (map[string]string, error) {
-	err := volume.spdkNode.PublishVolume(volume.csiVolume.GetVolumeId())
+// check optional features before creating anything on spdk node
+func requireFeatures(ctx context.Context, spdkNode util.SpdkNode, encrypted, replicated bool) error {
+	var methods []string
+	if encrypted {
+		methods = append(methods, util.FeatureEncrypt...)
+	}
+	if replicated {
+		methods = append(methods, util.FeatureReplicate...)
+	}
+	caps, err := spdkNode.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	return caps.Require(methods...)
+}
+
+// encrypted snapshot passes its key to the clone, plain snapshot cannot be
+// cloned to an encrypted volume as existing data is not ciphertext
+func (cs *controllerServer) cloneCryptoKey(ctx context.Context, snapshotID string, cryptoKey *util.CryptoKey) (*util.CryptoKey, error) {
+	cs.mtxSnapshot.RLock()
+	snapshotKey := cs.snapshotKeys[snapshotID]
+	cs.mtxSnapshot.RUnlock()
+
+	if snapshotKey == nil {
+		// key is not known, fail closed unless spdk node confirms the snapshot
+		// is not encrypted, cloning it raw would expose ciphertext as data
+		_, source, err := cs.snapshotSource(snapshotID)
+		if err != nil {
+			return nil, err
+		}
+		encrypted, err := source.spdkNode.SnapshotEncrypted(ctx, snapshotID)
+		if err != nil {
+			return nil, rpcStatus(err)
+		}
+		if encrypted {
+			return nil, status.Errorf(codes.FailedPrecondition, "key of encrypted snapshot %s is unknown", snapshotID)
+		}
+	}
+
+	switch {
+	case snapshotKey == nil && cryptoKey != nil:
+		return nil, status.Error(codes.InvalidArgument, "cannot create encrypted volume from unencrypted snapshot")
+	case snapshotKey != nil && cryptoKey != nil && *snapshotKey != *cryptoKey:
+		return nil, status.Error(codes.InvalidArgument, "encryption key mismatch with source snapshot")
+	}
+	return snapshotKey, nil
+}
+
+// parse encryption parameters from storage class and key from secrets
+// returns nil if volume is not encrypted
+func getCryptoKey(params, secrets map[string]string) (*util.CryptoKey, error) {
+	encrypted, exists := params["encrypted"]
+	if !exists {
+		return nil, nil
+	}
+	isEncrypted, err := strconv.ParseBool(encrypted)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid encrypted parameter: %s", encrypted)
+	}
+	if !isEncrypted {
+		return nil, nil
+	}
+
+	cryptoKey := &util.CryptoKey{
+		Cipher: params["encryptionCipher"],
+		Key:    secrets["encryptionKey"],
+		Key2:   secrets["encryptionKey2"],
+	}
+	if cryptoKey.Cipher == "" {
+		cryptoKey.Cipher = "AES_CBC"
+	}
+
+	// AES-128 keys per SPDK crypto bdev
+	const keyLen = 16
+	if len(cryptoKey.Key) != keyLen {
+		return nil, status.Errorf(codes.InvalidArgument, "encryptionKey must be %d bytes", keyLen)
+	}
+	switch cryptoKey.Cipher {
+	case "AES_CBC":
+		if cryptoKey.Key2 != "" {
+			return nil, status.Error(codes.InvalidArgument, "encryptionKey2 is only valid for AES_XTS")
+		}
+	case "AES_XTS":
+		if len(cryptoKey.Key2) != keyLen {
+			return nil, status.Errorf(codes.InvalidArgument, "encryptionKey2 must be %d bytes", keyLen)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported encryptionCipher: %s", cryptoKey.Cipher)
+	}
+
+	return cryptoKey, nil
+}
+
+// filesystem types the volume may be formatted as, from mount capabilities or
+// fsType parameter, empty if requested as block device only
+func mountFsTypes(req *csi.CreateVolumeRequest) []string {
+	var fsTypes []string
+	for _, capability := range req.GetVolumeCapabilities() {
+		if mountVolume := capability.GetMount(); mountVolume != nil {
+			fsType := mountVolume.GetFsType()
+			if fsType == "" {
+				fsType = req.GetParameters()["fsType"]
+			}
+			fsTypes = append(fsTypes, fsType)
+		}
+	}
+	return fsTypes
+}
+
+// parse node local flag, default to false(shared spdk nodes)
+func getLocal(params map[string]string) (bool, error) {
+	local, exists := params["local"]
+	if !exists {
+		return false, nil
+	}
+	isLocal, err := strconv.ParseBool(local)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid local parameter: %s", local)
+	}
+	return isLocal, nil
+}
+
+// parse replication factor, default to 1(not replicated)
+func (cs *controllerServer) getReplicaCount(params map[string]string) (int, error) {
+	replicas, exists := params["replicas"]
+	if !exists {
+		return 1, nil
+	}
+	replicaCount, err := strconv.Atoi(replicas)
+	if err != nil || replicaCount < 1 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid replicas parameter: %s", replicas)
+	}
+	if replicaCount > len(cs.spdkNodes) {
+		return 0, status.Errorf(codes.InvalidArgument, "replicas %d exceeds spdk node count %d", replicaCount, len(cs.spdkNodes))
+	}
+	return replicaCount, nil
+}
+
+func publishVolume(ctx context.Context, volume *volume) (map[string]string, error) {
+	err := volume.spdkNode.PublishVolume(ctx, volume.csiVolume.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
 
 	volumeInfo, err := volume.spdkNode.VolumeInfo(volume.csiVolume.GetVolumeId())
 	if err != nil {
-		unpublishVolume(volume) // nolint:errcheck // we can do little
+		unpublishVolume(ctx, volume) // nolint:errcheck // we can do little
 		return nil, err
 	}
 	return volumeInfo, nil
 }
 
-func deleteVolume(volume *volume) error {
-	return volume.spdkNode.DeleteVolume(volume.csiVolume.GetVolumeId())
+func deleteVolume(ctx context.Context, volume *volume) error {
+	return volume.spdkNode.DeleteVolume(ctx, volume.csiVolume.GetVolumeId())
 }
 
-func unpublishVolume(volume *volume) error {
-	return volume.spdkNode.UnpublishVolume(volume.csiVolume.GetVolumeId())
+func unpublishVolume(ctx context.Context, volume *volume) error {
+	return volume.spdkNode.UnpublishVolume(ctx, volume.csiVolume.GetVolumeId())
 }
 
-// simplest volume scheduler: find first node:lvstore with enough free space
-func (cs *controllerServer) schedule(sizeMiB int64) (spdkNode util.SpdkNode, lvstore string, err error) {
-	for _, spdkNode := range cs.spdkNodes {
-		// retrieve lastest lvstore info from spdk node
-		lvstores, err := spdkNode.LvStores()
-		if err != nil {
-			klog.Errorf("failed to get lvstores from node %s: %s", spdkNode.Info(), err.Error())
+// map spdk and volume errors to grpc status, status errors are passed through
+func rpcStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code := codes.Internal
+	switch {
+	case errors.Is(err, spdkrpc.ErrNoSuchDevice), errors.Is(err, util.ErrVolumeDeleted):
+		code = codes.NotFound
+	case errors.Is(err, spdkrpc.ErrNoSpaceLeft):
+		code = codes.ResourceExhausted
+	case errors.Is(err, spdkrpc.ErrAlreadyExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, spdkrpc.ErrUnavailable):
+		code = codes.Unavailable
+	case errors.Is(err, spdkrpc.ErrBusy):
+		code = codes.FailedPrecondition
+	case errors.Is(err, spdkrpc.ErrMethodUnsupported), errors.Is(err, spdkrpc.ErrMethodNotFound):
+		// missing feature of older spdk, retrying does not help
+		code = codes.Unimplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
+
+// delete lvols of deleted snapshots on the node, refused by spdk until at most
+// one clone is left
+func (cs *controllerServer) purgeSnapshots(ctx context.Context, spdkNode util.SpdkNode) {
+	var snapshotIDs []string
+	cs.mtxSnapshot.RLock()
+	for snapshotID, node := range cs.snapshotsGone {
+		if node == spdkNode {
+			snapshotIDs = append(snapshotIDs, snapshotID)
+		}
+	}
+	cs.mtxSnapshot.RUnlock()
+
+	for _, snapshotID := range snapshotIDs {
+		err := spdkNode.DeleteVolume(ctx, snapshotID)
+		if errors.Is(err, spdkrpc.ErrNotPermitted) {
+			continue // clones left
+		}
+		if err != nil && !errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+			klog.Errorf("failed to delete snapshot %s: %s", snapshotID, err)
 			continue
 		}
-		// check if lvstore has enough free space
-		for i := range lvstores {
-			lvstore := &lvstores[i]
-			if lvstore.FreeSizeMiB > sizeMiB {
-				return spdkNode, lvstore.Name, nil
+		klog.Infof("deleted snapshot lvol: %s", snapshotID)
+		cs.mtxSnapshot.Lock()
+		delete(cs.snapshotsGone, snapshotID)
+		cs.mtxSnapshot.Unlock()
+	}
+}
+
+// rollback of a failed request should not be cancelled together with it
+func rollbackContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), rollbackTimeout)
+}
+
+// check if capacity of an existing volume satisfies the requested range
+func capacityCompatible(capacity int64, capacityRange *csi.CapacityRange) bool {
+	if capacity < capacityRange.GetRequiredBytes() {
+		return false
+	}
+	limit := capacityRange.GetLimitBytes()
+	return limit == 0 || capacity <= limit
+}
+
+// simplest volume scheduler: find first count distinct node:lvstore with
+// enough free space
+func (cs *controllerServer) schedule(ctx context.Context, sizeMiB int64, count int) (spdkNodes []util.SpdkNode, lvstores []string, err error) {
+	for _, spdkNode := range cs.spdkNodes {
+		lvstore := findLvStore(ctx, spdkNode, sizeMiB)
+		if lvstore != "" {
+			spdkNodes = append(spdkNodes, spdkNode)
+			lvstores = append(lvstores, lvstore)
+			if len(spdkNodes) == count {
+				return spdkNodes, lvstores, nil
 			}
 		}
-		klog.Infof("not enough free space from node %s", spdkNode.Info())
 	}
 
-	return nil, "", fmt.Errorf("failed to find node with enough free space")
+	return nil, nil, status.Errorf(codes.ResourceExhausted, "failed to find %d node(s) with enough free space", count)
+}
+
+// schedule node local volume on the node local spdk of requested topology,
+// preferred ones first, e.g., the node picked by WaitForFirstConsumer binding
+func (cs *controllerServer) scheduleLocal(ctx context.Context, requirement *csi.TopologyRequirement, sizeMiB int64) ([]util.SpdkNode, []string, error) {
+	var topologies []*csi.Topology
+	topologies = append(topologies, requirement.GetPreferred()...)
+	topologies = append(topologies, requirement.GetRequisite()...)
+	if len(topologies) == 0 {
+		return nil, nil, status.Error(codes.InvalidArgument, "node local volume requires accessibility requirements")
+	}
+
+	tried := make(map[string]bool)
+	for _, topology := range topologies {
+		nodeName := topology.GetSegments()[topologyKeyNode]
+		spdkNode, exists := cs.localNodes[nodeName]
+		if !exists || tried[nodeName] {
+			continue
+		}
+		tried[nodeName] = true
+		lvstore := findLvStore(ctx, spdkNode, sizeMiB)
+		if lvstore != "" {
+			return []util.SpdkNode{spdkNode}, []string{lvstore}, nil
+		}
+	}
+
+	return nil, nil, status.Error(codes.ResourceExhausted, "failed to find node local spdk with enough free space in requested topology")
+}
+
+// first lvstore on spdk node with enough free space, empty if not found
+func findLvStore(ctx context.Context, spdkNode util.SpdkNode, sizeMiB int64) string {
+	// retrieve lastest lvstore info from spdk node
+	lvss, err := spdkNode.LvStores(ctx)
+	if err != nil {
+		klog.Errorf("failed to get lvstores from node %s: %s", spdkNode.Info(), err.Error())
+		return ""
+	}
+	for i := range lvss {
+		if lvss[i].FreeSizeMiB > sizeMiB {
+			return lvss[i].Name
+		}
+	}
+	klog.Infof("not enough free space from node %s", spdkNode.Info())
+	return ""
+}
+
+// volume on node local spdk is only accessible from that node, nil for
+// volumes accessible from all nodes
+func (cs *controllerServer) topology(spdkNode util.SpdkNode) []*csi.Topology {
+	for nodeName, localNode := range cs.localNodes {
+		if localNode == spdkNode {
+			return []*csi.Topology{{Segments: map[string]string{topologyKeyNode: nodeName}}}
+		}
+	}
+	return nil
+}
+
+// vhost socket is passed to vm runtime as is, cannot be formatted or mounted
+func (cs *controllerServer) checkAccessType(spdkNode util.SpdkNode, caps []*csi.VolumeCapability) error {
+	if !cs.vhostNodes[spdkNode] {
+		return nil
+	}
+	for _, cap := range caps {
+		if cap.GetBlock() == nil {
+			return status.Error(codes.InvalidArgument, "vhost volume supports block access type only")
+		}
+	}
+	return nil
+}
+
+// all shared and node local spdk nodes, local ones in name order
+func (cs *controllerServer) allSpdkNodes() []util.SpdkNode {
+	names := make([]string, 0, len(cs.localNodes))
+	for name := range cs.localNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	spdkNodes := append([]util.SpdkNode{}, cs.spdkNodes...)
+	for _, name := range names {
+		spdkNodes = append(spdkNodes, cs.localNodes[name])
+	}
+	return spdkNodes
 }
 
 func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
@@ -348,63 +997,51 @@ func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
 		volumes:                 make(map[string]*volume),
 		volumesIdem:             make(map[string]string),
 		snapshotsIdem:           make(map[string]csi.Snapshot),
+		snapshotNames:           make(map[string]string),
+		snapshotKeys:            make(map[string]*util.CryptoKey),
+		snapshotsGone:           make(map[string]util.SpdkNode),
+		localNodes:              make(map[string]util.SpdkNode),
+		vhostNodes:              make(map[util.SpdkNode]bool),
 	}
 
-	// get spdk node configs, see deploy/kubernetes/config-map.yaml
-	var config struct {
-		Nodes []struct {
-			Name       string `json:"name"`
-			URL        string `json:"rpcURL"`
-			TargetType string `json:"targetType"`
-			TargetAddr string `json:"targetAddr"`
-		} `json:"Nodes"`
-	}
-	configFile := util.FromEnv("SPDKCSI_CONFIG", "/etc/spdkcsi-config/config.json")
-	err := util.ParseJSONFile(configFile, &config)
-	if err != nil {
-		return nil, err
-	}
-
-	// get spdk node secrets, see deploy/kubernetes/secret.yaml
-	var secret struct {
-		Tokens []struct {
-			Name     string `json:"name"`
-			UserName string `json:"username"`
-			Password string `json:"password"`
-		} `json:"rpcTokens"`
-	}
-	secretFile := util.FromEnv("SPDKCSI_SECRET", "/etc/spdkcsi-secret/secret.json")
-	err = util.ParseJSONFile(secretFile, &secret)
+	configs, secrets, err := readSpdkNodeConfigs()
 	if err != nil {
 		return nil, err
 	}
 
 	// create spdk nodes
-	for i := range config.Nodes {
-		node := &config.Nodes[i]
-		tokenFound := false
+	reloader := newCertReloader(secretFile())
+	for i := range configs {
+		node := &configs[i]
 		// find secret per node
-		for j := range secret.Tokens {
-			token := &secret.Tokens[j]
-			if token.Name == node.Name {
-				tokenFound = true
-				spdkNode, err := util.NewSpdkNode(node.URL, token.UserName, token.Password, node.TargetType, node.TargetAddr)
-				if err != nil {
-					klog.Errorf("failed to create spdk node %s: %s", node.Name, err.Error())
-				} else {
-					klog.Infof("spdk node created: name=%s, url=%s", node.Name, node.URL)
-					server.spdkNodes = append(server.spdkNodes, spdkNode)
-				}
-				break
-			}
-		}
-		if !tokenFound {
+		secret := secrets.find(node.Name)
+		if secret == nil {
 			klog.Errorf("failed to find secret for spdk node %s", node.Name)
+			continue
+		}
+		// misconfigured node is skipped, unreachable node is probed on use
+		spdkNode, err := newSpdkNode(node, secret)
+		if err != nil {
+			klog.Errorf("failed to create spdk node %s: %s", node.Name, err.Error())
+			continue
+		}
+		klog.Infof("spdk node created: name=%s, url=%s", node.Name, node.URL)
+		if strings.EqualFold(node.TargetType, "nbd") || strings.EqualFold(node.TargetType, "vhost") {
+			// node local spdk is named after kubernetes node, vhost socket
+			// is only reachable on the same host
+			server.localNodes[node.Name] = spdkNode
+			if strings.EqualFold(node.TargetType, "vhost") {
+				server.vhostNodes[spdkNode] = true
+			}
+		} else {
+			server.spdkNodes = append(server.spdkNodes, spdkNode)
 		}
+		reloader.add(node, spdkNode)
 	}
-	if len(server.spdkNodes) == 0 {
+	if len(server.spdkNodes) == 0 && len(server.localNodes) == 0 {
 		return nil, fmt.Errorf("no valid spdk node found")
 	}
+	server.certs = reloader
 
 	return &server, nil
 }
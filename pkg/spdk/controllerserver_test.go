@@ -2,16 +2,23 @@ package spdk
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
 	"github.com/spdk/spdk-csi/pkg/util"
 )
 
@@ -39,8 +46,493 @@ func TestIscsiConcurrency(t *testing.T) {
 	testConcurrency("iscsi", t)
 }
 
+func TestCreateVolumeArguments(t *testing.T) {
+	cs, _, err := createTestController(t, "nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = createTestVolume(cs, "", 1024*1024)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{Name: "test-volume"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+
+	// same name and compatible size is idempotent, different size fails
+	volumeID, err := createTestVolume(cs, "test-volume", 4*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID2, err := createTestVolume(cs, "test-volume", 4*1024*1024)
+	if err != nil || volumeID2 != volumeID {
+		t.Fatalf("duplicated request: %s, %v", volumeID2, err)
+	}
+	_, err = createTestVolume(cs, "test-volume", 8*1024*1024)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expect AlreadyExists: %v", err)
+	}
+
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteTestVolume(cs, "")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+
+	// nvmf host parameters are validated and passed to node in volume context
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume-params",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"queueSize": "8"},
+	}
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+	req.Parameters = map[string]string{"queueSize": "128", "ctrlLossTmo": "-1", "dataDigest": "true"}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeContext := resp.GetVolume().GetVolumeContext()
+	if volumeContext["queueSize"] != "128" || volumeContext["ctrlLossTmo"] != "-1" || volumeContext["nqn"] == "" {
+		t.Fatalf("unexpected volume context: %v", volumeContext)
+	}
+	err = deleteTestVolume(cs, resp.GetVolume().GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mkfs parameters are validated against fsType of mount capability
+	req.Name = "test-volume-mkfs"
+	req.Parameters = map[string]string{"mkfsReflink": "true"}
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("reflink on ext4, expect InvalidArgument: %v", err)
+	}
+	req.Parameters = map[string]string{"fsUuid": "c5e3a2b4-1f3d-4b0e-9a7c-2d8f6e1b0a93"}
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("fsUuid shared by volumes, expect InvalidArgument: %v", err)
+	}
+	req.Parameters = map[string]string{"fsType": "xfs", "mkfsReflink": "true", "fsLabel": "data"}
+	req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability(), {
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: mountCapability().GetAccessMode(),
+	}}
+	resp, err = cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteTestVolume(cs, resp.GetVolume().GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalVolume(t *testing.T) {
+	cs, lvss, err := createTestController(t, "nbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume-local",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	}
+	// no shared spdk node
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expect ResourceExhausted: %v", err)
+	}
+	// node local volume must be scheduled by topology
+	req.Parameters = map[string]string{"local": "true"}
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+	req.Parameters = map[string]string{"local": "true", "replicas": "2"}
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+
+	// preferred node has no local spdk, falls back to requisite
+	req.Parameters = map[string]string{"local": "true"}
+	req.AccessibilityRequirements = &csi.TopologyRequirement{
+		Preferred: []*csi.Topology{{Segments: map[string]string{topologyKeyNode: "other"}}},
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{topologyKeyNode: "other"}},
+			{Segments: map[string]string{topologyKeyNode: "localhost"}},
+		},
+	}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol := resp.GetVolume()
+	topology := vol.GetAccessibleTopology()
+	if len(topology) != 1 || topology[0].GetSegments()[topologyKeyNode] != "localhost" {
+		t.Fatalf("volume not pinned to node: %v", topology)
+	}
+	if vol.GetVolumeContext()["targetType"] != "nbd" || vol.GetVolumeContext()["bdev"] != vol.GetVolumeId() {
+		t.Fatalf("unexpected volume context: %v", vol.GetVolumeContext())
+	}
+
+	err = deleteTestVolume(cs, vol.GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+// vhost volume is block only and pinned to the host of spdk target
+func TestVhostVolume(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{VhostSocketDir: "/var/tmp"})
+	defer server.Close()
+	cs := createFakeController(t, "vhost", server)
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume-vhost",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"local": "true"},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{topologyKeyNode: "node0"}}},
+		},
+	}
+	_, err := cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("filesystem on vhost, expect InvalidArgument: %v", err)
+	}
+	if calls := server.Calls("bdev_lvol_create"); calls != 0 {
+		t.Fatalf("volume should not be created: %d", calls)
+	}
+
+	req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability()}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol := resp.GetVolume()
+	topology := vol.GetAccessibleTopology()
+	if len(topology) != 1 || topology[0].GetSegments()[topologyKeyNode] != "node0" {
+		t.Fatalf("volume not pinned to node: %v", topology)
+	}
+
+	validateResp, err := cs.ValidateVolumeCapabilities(context.TODO(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           vol.GetVolumeId(),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	if err != nil || validateResp.GetConfirmed() != nil {
+		t.Fatalf("filesystem on vhost should not be confirmed: %v, %v", validateResp, err)
+	}
+
+	err = deleteTestVolume(cs, vol.GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spdk node down when controller starts is not dropped, it's probed on use
+func TestUnreachableNode(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	defer server.Close()
+	server.Inject(spdkrpctest.Fault{Method: "rpc_get_methods", Count: 1, Code: -32603, Message: "not ready"})
+
+	cs := createFakeController(t, "nvme-tcp", server)
+	_, err := createTestVolume(cs, "test-volume-unreachable", 4*1024*1024)
+	if err == nil {
+		t.Fatal("should fail before spdk node is probed")
+	}
+	volumeID, err := createTestVolume(cs, "test-volume-unreachable", 4*1024*1024)
+	if err != nil {
+		t.Fatalf("spdk node should be probed again: %s", err)
+	}
+	if calls := server.Calls("rpc_get_methods"); calls != 2 {
+		t.Fatalf("expect 2 rpc_get_methods, got %d", calls)
+	}
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spdk refuses deleting snapshot of more than one clone, lvol is deleted
+// after clones are
+func TestDeleteSnapshotWithClones(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	defer server.Close()
+	cs := createFakeController(t, "nvme-tcp", server)
+	lvss, err := getLVSS(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	volumeID, err := createTestVolume(cs, "test-volume-source", 4*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "test-snapshot-clones",
+		SourceVolumeId: volumeID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotID := snapshot.GetSnapshot().GetSnapshotId()
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume-clone",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+			},
+		},
+	}
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneID := resp.GetVolume().GetVolumeId()
+
+	// source volume and clone, snapshot is gone for CO but lvol is kept
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Name = "test-volume-clone2"
+	_, err = cs.CreateVolume(ctx, req)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expect NotFound: %v", err)
+	}
+	if len(cs.snapshotsGone) != 1 {
+		t.Fatalf("snapshot lvol should be kept: %v", cs.snapshotsGone)
+	}
+
+	// one clone left, snapshot lvol is deleted
+	err = deleteTestVolume(cs, cloneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.snapshotsGone) != 0 {
+		t.Fatalf("snapshot lvol not deleted: %v", cs.snapshotsGone)
+	}
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+func TestEncryptedVolume(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	defer server.Close()
+	cs := createFakeController(t, "nvme-tcp", server)
+	lvss, err := getLVSS(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	const key16 = "0123456789abcdef"
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "test-volume-encrypted",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"encrypted": "true"},
+		Secrets:            map[string]string{"encryptionKey": key16},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	key := server.CryptoKey("crypto-" + volumeID)
+	if key.Cipher != "AES_CBC" || key.Key != hex.EncodeToString([]byte(key16)) {
+		t.Fatalf("volume not encrypted: %+v", key)
+	}
+
+	snapshot, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "test-snapshot-encrypted",
+		SourceVolumeId: volumeID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotID := snapshot.GetSnapshot().GetSnapshotId()
+
+	// clone inherits key of encrypted snapshot, storage class of clone may
+	// not specify encryption
+	cloneReq := &csi.CreateVolumeRequest{
+		Name:               "test-volume-clone",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+			},
+		},
+	}
+	resp, err = cs.CreateVolume(ctx, cloneReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneID := resp.GetVolume().GetVolumeId()
+	if cloneKey := server.CryptoKey("crypto-" + cloneID); cloneKey != key {
+		t.Fatalf("clone key mismatch: %+v, %+v", cloneKey, key)
+	}
+
+	// snapshot key lost, e.g., controller restarted, encryption mark of the
+	// snapshot on spdk target fails cloning closed
+	cs.mtxSnapshot.Lock()
+	delete(cs.snapshotKeys, snapshotID)
+	cs.mtxSnapshot.Unlock()
+	cloneReq.Name = "test-volume-clone-nokey"
+	_, err = cs.CreateVolume(ctx, cloneReq)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition: %v", err)
+	}
+
+	// crypto bdev is deleted before lvol, which fails with EBUSY otherwise
+	err = deleteTestVolume(cs, cloneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Calls("bdev_crypto_delete") != 2 || server.Calls("accel_crypto_key_destroy") != 2 {
+		t.Fatalf("crypto bdevs or keys not deleted: %d, %d",
+			server.Calls("bdev_crypto_delete"), server.Calls("accel_crypto_key_destroy"))
+	}
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+func TestReplicatedVolume(t *testing.T) {
+	var servers []*spdkrpctest.Server
+	for i := 0; i < 3; i++ {
+		server := spdkrpctest.NewServer(spdkrpctest.Options{})
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	cs := createFakeController(t, "nvme-tcp", servers...)
+	lvss, err := getLVSS(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+	calls := func(method string) int {
+		n := 0
+		for _, server := range servers {
+			n += server.Calls(method)
+		}
+		return n
+	}
+
+	// attaching second replica fails, replica lvols are unexported and
+	// deleted, so is the primary lvol
+	for _, server := range servers {
+		server.Inject(spdkrpctest.Fault{Method: "bdev_nvme_attach_controller", Count: 1})
+		server.Inject(spdkrpctest.Fault{Method: "bdev_nvme_attach_controller", Count: 1, Code: -6, Message: "No such device or address"})
+	}
+	req := &csi.CreateVolumeRequest{
+		Name:               "test-volume-replicated",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"replicas": "3"},
+	}
+	_, err = cs.CreateVolume(ctx, req)
+	if err == nil {
+		t.Fatal("CreateVolume should fail")
+	}
+	if calls("bdev_nvme_attach_controller") != 2 || calls("bdev_nvme_detach_controller") != 1 {
+		t.Fatalf("unexpected attach %d, detach %d",
+			calls("bdev_nvme_attach_controller"), calls("bdev_nvme_detach_controller"))
+	}
+	if calls("nvmf_delete_subsystem") != 2 || !verifyLVSS(cs, lvss) {
+		t.Fatal("replicas not rolled back")
+	}
+	for _, server := range servers {
+		server.ClearFaults()
+	}
+
+	// two replicas, primary lvol and one remote
+	req.Parameters["replicas"] = "2"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	cs.mtx.Lock()
+	volume := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if len(volume.replicas) != 1 || calls("bdev_raid_create") != 1 {
+		t.Fatalf("volume not replicated: %d replicas", len(volume.replicas))
+	}
+	checkCondition := func(abnormal bool) {
+		t.Helper()
+		resp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		condition := resp.GetStatus().GetVolumeCondition()
+		if condition.GetAbnormal() != abnormal {
+			t.Fatalf("unexpected condition: %v", condition)
+		}
+	}
+	checkCondition(false)
+
+	// replica lost, ControllerGetVolume only reports it
+	var replicaServer *spdkrpctest.Server
+	for i, spdkNode := range cs.spdkNodes {
+		if spdkNode == volume.replicas[0].spdkNode {
+			replicaServer = servers[i]
+		}
+	}
+	replicaServer.SetFabricDown(true)
+	checkCondition(true)
+	if calls("bdev_raid_add_base_bdev") != 0 {
+		t.Fatal("ControllerGetVolume should not repair volume")
+	}
+	cs.repairVolumes(ctx)
+	checkCondition(true)
+
+	// replica back, background repair adds it to raid
+	replicaServer.SetFabricDown(false)
+	checkCondition(true)
+	cs.repairVolumes(ctx)
+	checkCondition(false)
+
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls("bdev_raid_delete") != 1 || !verifyLVSS(cs, lvss) {
+		t.Fatal("replicated volume not deleted")
+	}
+}
+
 func testVolume(targetType string, t *testing.T) {
-	cs, lvss, err := createTestController(targetType)
+	cs, lvss, err := createTestController(t, targetType)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,7 +574,7 @@ func testVolume(targetType string, t *testing.T) {
 }
 
 func testIdempotency(targetType string, t *testing.T) {
-	cs, lvss, err := createTestController(targetType)
+	cs, lvss, err := createTestController(t, targetType)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -106,7 +598,7 @@ func testIdempotency(targetType string, t *testing.T) {
 }
 
 func testConcurrency(targetType string, t *testing.T) {
-	cs, lvss, err := createTestController(targetType)
+	cs, lvss, err := createTestController(t, targetType)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -148,8 +640,16 @@ func testConcurrency(targetType string, t *testing.T) {
 	}
 }
 
-func createTestController(targetType string) (cs *controllerServer, lvss [][]util.LvStore, err error) {
-	err = createConfigFiles(targetType)
+// controller of a fake spdk target, or real one if spdkrpctest.EnvRPCURL is set
+func createTestController(t *testing.T, targetType string) (cs *controllerServer, lvss [][]util.LvStore, err error) {
+	rpcURL := os.Getenv(spdkrpctest.EnvRPCURL)
+	if rpcURL == "" {
+		server := spdkrpctest.NewServer(spdkrpctest.Options{User: "spdkcsiuser", Password: "spdkcsipass"})
+		t.Cleanup(server.Close)
+		rpcURL = server.URL
+	}
+
+	err = createConfigFiles(targetType, rpcURL)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -172,7 +672,7 @@ func createTestController(targetType string) (cs *controllerServer, lvss [][]uti
 	return cs, lvss, nil
 }
 
-func createConfigFiles(targetType string) error {
+func createConfigFiles(targetType, rpcURL string) error {
 	configFile, err := ioutil.TempFile("", "spdkcsi-config*.json")
 	if err != nil {
 		return err
@@ -186,7 +686,7 @@ func createConfigFiles(targetType string) error {
       "nodes": [
         {
           "name": "localhost",
-          "rpcURL": "http://127.0.0.1:9009",
+          "rpcURL": "%s",
           "targetType": "nvme-tcp",
           "targetAddr": "127.0.0.1"
         }
@@ -198,14 +698,25 @@ func createConfigFiles(targetType string) error {
       "nodes": [
         {
           "name": "localhost",
-          "rpcURL": "http://127.0.0.1:9009",
+          "rpcURL": "%s",
           "targetType": "iscsi",
           "targetAddr": "127.0.0.1"
         }
       ]
+    }`
+	case "nbd":
+		config = `
+    {
+      "nodes": [
+        {
+          "name": "localhost",
+          "rpcURL": "%s",
+          "targetType": "nbd"
+        }
+      ]
     }`
 	}
-	_, err = configFile.Write([]byte(config))
+	_, err = configFile.Write([]byte(fmt.Sprintf(config, rpcURL)))
 	if err != nil {
 		os.Remove(configFile.Name())
 		return err
@@ -240,10 +751,49 @@ func createConfigFiles(targetType string) error {
 	return nil
 }
 
+// controller of fake spdk targets, node of server i is named "node<i>"
+func createFakeController(t *testing.T, targetType string, servers ...*spdkrpctest.Server) *controllerServer {
+	var config struct {
+		Nodes []spdkNodeConfig `json:"nodes"`
+	}
+	var secrets spdkNodeSecrets
+	for i, server := range servers {
+		name := fmt.Sprintf("node%d", i)
+		config.Nodes = append(config.Nodes, spdkNodeConfig{
+			Name:       name,
+			URL:        server.URL,
+			TargetType: targetType,
+			TargetAddr: "127.0.0.1",
+		})
+		secrets.Tokens = append(secrets.Tokens, spdkNodeSecret{Name: name})
+	}
+
+	for env, v := range map[string]interface{}{"SPDKCSI_CONFIG": &config, "SPDKCSI_SECRET": &secrets} {
+		f, err := ioutil.TempFile("", "spdkcsi-*.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		err = json.NewEncoder(f).Encode(v)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv(env, f.Name())
+	}
+
+	cs, err := newControllerServer(csicommon.NewCSIDriver("test-driver", "test-version", "test-node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
 func createTestVolume(cs *controllerServer, name string, size int64) (string, error) {
 	reqCreate := csi.CreateVolumeRequest{
-		Name:          name,
-		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
 	}
 
 	resp, err := cs.CreateVolume(context.TODO(), &reqCreate)
@@ -272,8 +822,9 @@ func createSameVolumeInParallel(cs *controllerServer, name string, count int, si
 	// issue multiple create requests to create *same* volume in parallel
 	volumeID := make([]string, count)
 	reqCreate := csi.CreateVolumeRequest{
-		Name:          name,
-		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
 	}
 	for i := 0; i < count; i++ {
 		wg.Add(1)
@@ -337,8 +888,8 @@ func deleteSameVolumeInParallel(cs *controllerServer, volumeID string, count int
 
 func getLVSS(cs *controllerServer) ([][]util.LvStore, error) {
 	var lvss [][]util.LvStore
-	for _, spdkNode := range cs.spdkNodes {
-		lvs, err := spdkNode.LvStores()
+	for _, spdkNode := range cs.allSpdkNodes() {
+		lvs, err := spdkNode.LvStores(context.TODO())
 		if err != nil {
 			return nil, err
 		}
@@ -371,3 +922,140 @@ func verifyLVSS(cs *controllerServer, lvss [][]util.LvStore) bool {
 	}
 	return true
 }
+
+func TestRPCStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{&spdkrpc.Error{Method: "test", Code: -32601, Message: "Method not found"}, codes.Unimplemented},
+		{fmt.Errorf("wrapped: %w", spdkrpc.ErrMethodUnsupported), codes.Unimplemented},
+		{&spdkrpc.Error{Method: "test", Code: -19, Message: "No such device"}, codes.NotFound},
+		{&spdkrpc.Error{Method: "test", Code: -16, Message: "Device or resource busy"}, codes.FailedPrecondition},
+		{&spdkrpc.Error{Method: "test", Code: -32603, Message: "Internal error"}, codes.Internal},
+		{status.Error(codes.Aborted, "as is"), codes.Aborted},
+	}
+	for _, tt := range tests {
+		if code := status.Code(rpcStatus(tt.err)); code != tt.code {
+			t.Errorf("%v: expect %s, got %s", tt.err, tt.code, code)
+		}
+	}
+}
+
+func TestGetCryptoKey(t *testing.T) {
+	const key16 = "0123456789abcdef"
+	tests := []struct {
+		params  map[string]string
+		secrets map[string]string
+		valid   bool
+		key     *util.CryptoKey
+	}{
+		{params: nil, valid: true, key: nil},
+		{params: map[string]string{"encrypted": "false"}, valid: true, key: nil},
+		{params: map[string]string{"encrypted": "yes"}, valid: false},
+		{params: map[string]string{"encrypted": "true"}, valid: false},
+		{
+			params:  map[string]string{"encrypted": "true"},
+			secrets: map[string]string{"encryptionKey": key16},
+			valid:   true,
+			key:     &util.CryptoKey{Cipher: "AES_CBC", Key: key16},
+		},
+		{
+			params:  map[string]string{"encrypted": "true"},
+			secrets: map[string]string{"encryptionKey": "short"},
+			valid:   false,
+		},
+		{
+			params:  map[string]string{"encrypted": "true", "encryptionCipher": "AES_XTS"},
+			secrets: map[string]string{"encryptionKey": key16},
+			valid:   false,
+		},
+		{
+			params:  map[string]string{"encrypted": "true", "encryptionCipher": "AES_XTS"},
+			secrets: map[string]string{"encryptionKey": key16, "encryptionKey2": key16},
+			valid:   true,
+			key:     &util.CryptoKey{Cipher: "AES_XTS", Key: key16, Key2: key16},
+		},
+		{
+			params:  map[string]string{"encrypted": "true", "encryptionCipher": "DES"},
+			secrets: map[string]string{"encryptionKey": key16},
+			valid:   false,
+		},
+	}
+
+	for i, test := range tests {
+		key, err := getCryptoKey(test.params, test.secrets)
+		if (err == nil) != test.valid {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if !test.valid {
+			continue
+		}
+		if (key == nil) != (test.key == nil) || (key != nil && *key != *test.key) {
+			t.Fatalf("case %d: key mismatch: %+v", i, key)
+		}
+	}
+}
+
+// spdk node stub counting certificate reloads
+type tlsNode struct {
+	util.SpdkNode
+	err    error
+	reload int
+}
+
+func (node *tlsNode) SetTLSConfig(*spdkrpc.TLSConfig) error {
+	node.reload++
+	return node.err
+}
+
+func TestCertReloader(t *testing.T) {
+	f, err := ioutil.TempFile("", "spdkcsi-secret-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	writeSecret := func(caCert string) {
+		secrets := spdkNodeSecrets{Tokens: []spdkNodeSecret{{Name: "node0", CACert: caCert}, {Name: "node1", CACert: caCert}}}
+		data, _ := json.Marshal(&secrets)
+		err := ioutil.WriteFile(f.Name(), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeSecret("ca1")
+	r := newCertReloader(f.Name())
+	nodes := []*tlsNode{{}, {err: fmt.Errorf("bad certificate")}}
+	for i, node := range nodes {
+		r.add(&spdkNodeConfig{Name: fmt.Sprintf("node%d", i), URL: "https://127.0.0.1:9009"}, node)
+	}
+
+	// node failed to reload is retried on next poll
+	writeSecret("ca2")
+	r.reload()
+	r.reload()
+	if nodes[0].reload != 2 || nodes[1].reload != 2 {
+		t.Fatalf("expect 2 reloads: %d, %d", nodes[0].reload, nodes[1].reload)
+	}
+	nodes[1].err = nil
+	r.reload()
+	r.reload()
+	if nodes[0].reload != 3 || nodes[1].reload != 3 {
+		t.Fatalf("expect no reload after success: %d, %d", nodes[0].reload, nodes[1].reload)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reloader not stopped")
+	}
+}
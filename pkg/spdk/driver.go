@@ -17,14 +17,62 @@ limitations under the License.
 package spdk
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/metrics"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
 	"github.com/spdk/spdk-csi/pkg/util"
 )
 
+// topology segment of a kubernetes node, volumes of node local spdk are only
+// accessible from the node
+const topologyKeyNode = "topology.csi.spdk.io/node"
+
 func Run(conf *util.Config) {
+	ids, cs, ns := newServers(conf)
+
+	if cs != nil && conf.MetricsAddr != "" {
+		err := metrics.Register(newLvstoreCollector(cs.allSpdkNodes()))
+		if err != nil {
+			klog.Fatalf("failed to register lvstore metrics: %s", err)
+		}
+	}
+	if conf.MetricsAddr != "" {
+		metrics.Serve(conf.MetricsAddr)
+	}
+
+	s := csicommon.NewNonBlockingGRPCServer()
+	s.Start(conf.Endpoint, ids, cs, ns)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cs != nil {
+		go cs.runRepair(ctx)
+		go cs.certs.run(ctx)
+	}
+	if ns != nil && conf.StateDir != "" {
+		// lvols of unknown ephemeral volumes are deleted, requires state
+		go ns.runEphemeralGC(ctx)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	klog.Infof("received signal %s, shutting down", sig)
+	shutdown(s, conf.ShutdownTimeout)
+}
+
+// create identity, controller and node servers per conf, controller or node
+// server is nil if not enabled
+func newServers(conf *util.Config) (*identityServer, *controllerServer, *nodeServer) {
 	var (
 		cd  *csicommon.CSIDriver
 		ids *identityServer
@@ -34,6 +82,8 @@ func Run(conf *util.Config) {
 		controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 		}
 		volumeModes = []csi.VolumeCapability_AccessMode_Mode{
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -52,10 +102,27 @@ func Run(conf *util.Config) {
 	ids = newIdentityServer(cd)
 
 	if conf.IsNodeServer {
-		ns = newNodeServer(cd)
+		if conf.NVMfConnector != "" {
+			err := util.SetNVMfConnector(conf.NVMfConnector)
+			if err != nil {
+				klog.Fatalf("failed to set nvmf connector: %s", err)
+			}
+		}
+		if conf.LocalRPCURL != "" {
+			err := util.SetLocalRPC(conf.LocalRPCURL)
+			if err != nil {
+				klog.Fatalf("failed to set local spdk rpc: %s", err)
+			}
+		}
+		ns = newNodeServer(cd, conf.StateDir)
+		err := ns.recoverVolumes()
+		if err != nil {
+			klog.Fatalf("failed to recover node volumes: %s", err)
+		}
 	}
 
 	if conf.IsControllerServer {
+		spdkrpc.SetTimeouts(conf.RPCTimeouts)
 		var err error
 		cs, err = newControllerServer(cd)
 		if err != nil {
@@ -63,7 +130,25 @@ func Run(conf *util.Config) {
 		}
 	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(conf.Endpoint, ids, cs, ns)
+	return ids, cs, ns
+}
+
+// stop accepting new requests and drain in-flight ones, force stop cancels
+// contexts of in-flight requests, and pending spdk and initiator operations
+// with them, if draining doesn't finish before timeout
+func shutdown(s csicommon.NonBlockingGRPCServer, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		klog.Warningf("in-flight requests not finished in %v, cancelling", timeout)
+		s.ForceStop()
+		<-stopped
+	}
 	s.Wait()
 }
@@ -0,0 +1,131 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+)
+
+// identity server whose Probe blocks in handler
+type blockingIdentityServer struct {
+	*identityServer
+	probe func(ctx context.Context)
+}
+
+func (ids *blockingIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	ids.probe(ctx)
+	return ids.identityServer.Probe(ctx, req)
+}
+
+// start grpc server with the blocking Probe, and call Probe in background
+func startBlockedServer(t *testing.T, probe func(ctx context.Context)) (csicommon.NonBlockingGRPCServer, <-chan error) {
+	dir, err := ioutil.TempDir("", "spdkcsi-shutdown*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "csi.sock")
+
+	entered := make(chan struct{})
+	ids := &blockingIdentityServer{
+		identityServer: newIdentityServer(csicommon.NewCSIDriver("test-driver", "test-version", "test-node")),
+		probe: func(ctx context.Context) {
+			close(entered)
+			probe(ctx)
+		},
+	}
+	s := csicommon.NewNonBlockingGRPCServer()
+	s.Start("unix://"+socket, ids, nil, nil)
+
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{})
+		result <- err
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Probe not called")
+	}
+	return s, result
+}
+
+func TestShutdownGraceful(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := false
+	s, result := startBlockedServer(t, func(ctx context.Context) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			cancelled = true
+		}
+	})
+
+	// in-flight request finishes while draining
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	start := time.Now()
+	shutdown(s, 10*time.Second)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	if err := <-result; err != nil || cancelled {
+		t.Fatalf("in-flight request should finish: %v, cancelled=%v", err, cancelled)
+	}
+}
+
+func TestShutdownForce(t *testing.T) {
+	cancelled := make(chan struct{})
+	s, result := startBlockedServer(t, func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	// in-flight request never finishes by itself, it's cancelled after timeout
+	timeout := 200 * time.Millisecond
+	start := time.Now()
+	shutdown(s, timeout)
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 5*time.Second {
+		t.Fatalf("shutdown took %v, timeout %v", elapsed, timeout)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request not cancelled")
+	}
+	if err := <-result; err == nil {
+		t.Fatal("in-flight request should fail")
+	}
+}
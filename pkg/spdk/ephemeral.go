@@ -0,0 +1,293 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// CSI ephemeral inline volumes
+//
+// Node server creates lvol on node local spdk(targetType nbd, named after the
+// node in config map), connects and mounts it at target path in
+// NodePublishVolume, and tears it down in NodeUnpublishVolume. Volume state is
+// saved before lvol is created, volumes of deleted pods and lvols without
+// state are garbage collected periodically.
+
+const (
+	// set by kubelet in volume context, requires podInfoOnMount of CSIDriver
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+
+	defaultEphemeralSize = 1024 * 1024 * 1024
+	ephemeralGCInterval  = 10 * time.Minute
+	ephemeralGCTimeout   = 5 * time.Minute
+)
+
+type ephemeralVolume struct {
+	targetPath string // device is mounted here if stagingPath is not empty
+}
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralContextKey] == "true"
+}
+
+// volume size from volume attribute "size", e.g., 4Gi
+func ephemeralSizeMiB(volumeContext map[string]string) (int64, error) {
+	size, exists := volumeContext["size"]
+	if !exists {
+		return util.ToMiB(defaultEphemeralSize), nil
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil || quantity.Value() <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid size attribute: %s", size)
+	}
+	return util.ToMiB(quantity.Value()), nil
+}
+
+// node local spdk is probed on first use, it may start after node server
+func (ns *nodeServer) getLocalNode() (util.SpdkNode, error) {
+	ns.localNodeMtx.Lock()
+	defer ns.localNodeMtx.Unlock()
+
+	if ns.localNode == nil {
+		spdkNode, err := ns.newLocalNode()
+		if err != nil {
+			return nil, err
+		}
+		ns.localNode = spdkNode
+	}
+	return ns.localNode, nil
+}
+
+func (ns *nodeServer) publishEphemeral(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if req.GetVolumeCapability().GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral volume supports mount access type only")
+	}
+	// lvol without state cannot be told from orphans, nor found after restart
+	if ns.stateDir == "" {
+		return nil, status.Error(codes.FailedPrecondition, "ephemeral volume requires --state-dir")
+	}
+	sizeMiB, err := ephemeralSizeMiB(req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	ns.mtx.Lock()
+	volume, exists := ns.volumes[volumeID]
+	if !exists {
+		volume = &nodeVolume{ephemeral: &ephemeralVolume{targetPath: req.GetTargetPath()}}
+		ns.volumes[volumeID] = volume
+	}
+	ns.mtx.Unlock()
+	if volume.ephemeral == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is not ephemeral", volumeID)
+	}
+
+	if volume.tryLock.Lock() {
+		defer volume.tryLock.Unlock()
+
+		if volume.stagingPath != "" {
+			klog.Warning("ephemeral volume already published")
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		err = ns.createEphemeral(ctx, volumeID, volume, sizeMiB, req)
+		if err != nil {
+			// kubelet retries publish, or volume is collected after pod is gone
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	return nil, status.Error(codes.Aborted, "concurrent request ongoing")
+}
+
+// create, connect and mount, must be idempotent
+func (ns *nodeServer) createEphemeral(ctx context.Context, volumeID string, volume *nodeVolume, sizeMiB int64, req *csi.NodePublishVolumeRequest) error {
+	// lvol without state is deleted as orphan
+	state := &volumeState{
+		Ephemeral:  true,
+		TargetPath: volume.ephemeral.targetPath,
+	}
+	err := ns.saveVolumeState(volumeID, state)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	spdkNode, err := ns.getLocalNode()
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	volumeContext, err := util.CreateEphemeralVolume(ctx, spdkNode, volumeID, sizeMiB)
+	if err != nil {
+		return rpcStatus(err)
+	}
+	if volume.initiator == nil {
+		volume.initiator, err = ns.newInitiator(volumeContext)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	devicePath, err := volume.initiator.Connect(ctx) // idempotent
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	err = ns.mountEphemeral(devicePath, volume.ephemeral.targetPath, req)
+	if err != nil {
+		return rpcStatus(err)
+	}
+	state.VolumeContext = volumeContext
+	state.StagingPath = volume.ephemeral.targetPath
+	state.DevicePath = devicePath
+	err = ns.saveVolumeState(volumeID, state)
+	if err != nil {
+		klog.Errorf("failed to save state of volume %s: %s", volumeID, err)
+	}
+	volume.stagingPath = volume.ephemeral.targetPath
+	return nil
+}
+
+// format and mount device at target path, must be idempotent
+func (ns *nodeServer) mountEphemeral(devicePath, targetPath string, req *csi.NodePublishVolumeRequest) error {
+	mounted, err := ns.createMountPoint(targetPath)
+	if err != nil || mounted {
+		return err
+	}
+
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if fsType == "" {
+		fsType = req.GetVolumeContext()["fsType"]
+	}
+	mntFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	if req.GetReadonly() {
+		mntFlags = append(mntFlags, "ro")
+	}
+	klog.Infof("mount %s to %s, fstype: %s, flags: %v", devicePath, targetPath, fsType, mntFlags)
+	return ns.formatAndMount(devicePath, targetPath, fsType, mntFlags, req.GetVolumeContext())
+}
+
+// unmount, disconnect and delete, must be idempotent, caller holds volume lock
+func (ns *nodeServer) deleteEphemeral(ctx context.Context, volumeID string, volume *nodeVolume) error {
+	err := ns.deleteMountPoint(volume.ephemeral.targetPath)
+	if err != nil {
+		return err
+	}
+	volume.stagingPath = ""
+	if volume.initiator != nil {
+		err = volume.initiator.Disconnect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	spdkNode, err := ns.getLocalNode()
+	if err != nil {
+		return err
+	}
+	err = util.DeleteEphemeralVolume(ctx, spdkNode, volumeID)
+	if err != nil {
+		return err
+	}
+
+	err = ns.removeVolumeState(volumeID)
+	if err != nil {
+		return err
+	}
+	ns.mtx.Lock()
+	delete(ns.volumes, volumeID)
+	ns.mtx.Unlock()
+	return nil
+}
+
+// collect ephemeral volumes periodically until ctx is done
+func (ns *nodeServer) runEphemeralGC(ctx context.Context) {
+	ticker := time.NewTicker(ephemeralGCInterval)
+	defer ticker.Stop()
+	for {
+		ns.gcEphemeralVolumes(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// delete ephemeral volumes of deleted pods, e.g., unpublish failed or node
+// server was down when pod was deleted, and lvols left without state
+func (ns *nodeServer) gcEphemeralVolumes(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, ephemeralGCTimeout)
+	defer cancel()
+
+	spdkNode, err := ns.getLocalNode()
+	if err != nil {
+		klog.V(4).Infof("skip ephemeral volume gc: %s", err)
+		return
+	}
+
+	// kubelet removes volume directory of target path after unpublish succeeds
+	orphans := make(map[string]*nodeVolume)
+	ns.mtx.Lock()
+	for volumeID, volume := range ns.volumes {
+		if volume.ephemeral == nil {
+			continue
+		}
+		_, err := os.Stat(filepath.Dir(volume.ephemeral.targetPath))
+		if os.IsNotExist(err) {
+			orphans[volumeID] = volume
+		}
+	}
+	ns.mtx.Unlock()
+
+	for volumeID, volume := range orphans {
+		if !volume.tryLock.Lock() {
+			continue // being published or unpublished
+		}
+		klog.Warningf("deleting ephemeral volume %s of deleted pod", volumeID)
+		err = ns.deleteEphemeral(ctx, volumeID, volume)
+		volume.tryLock.Unlock()
+		if err != nil {
+			klog.Errorf("failed to delete ephemeral volume %s: %s", volumeID, err)
+		}
+	}
+
+	err = util.DeleteOrphanEphemeralVolumes(ctx, spdkNode, func() []string {
+		ns.mtx.Lock()
+		defer ns.mtx.Unlock()
+		var volumeIDs []string
+		for volumeID, volume := range ns.volumes {
+			if volume.ephemeral != nil {
+				volumeIDs = append(volumeIDs, volumeID)
+			}
+		}
+		return volumeIDs
+	})
+	if err != nil {
+		klog.Errorf("failed to delete orphan ephemeral lvols: %s", err)
+	}
+}
@@ -35,6 +35,8 @@ func newIdentityServer(d *csicommon.CSIDriver) *identityServer {
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	// no VolumeExpansion, ControllerExpandVolume and NodeExpandVolume are
+	// not implemented, and UNKNOWN is not a valid expansion type
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
@@ -45,9 +47,9 @@ func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.G
 				},
 			},
 			{
-				Type: &csi.PluginCapability_VolumeExpansion_{
-					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_UNKNOWN,
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
 					},
 				},
 			},
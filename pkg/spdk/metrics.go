@@ -0,0 +1,84 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// below prometheus default scrape timeout, var for tests
+var collectTimeout = 5 * time.Second
+
+// lvstoreCollector queries lvstore capacity from all spdk nodes per scrape
+type lvstoreCollector struct {
+	spdkNodes []util.SpdkNode
+	totalDesc *prometheus.Desc
+	freeDesc  *prometheus.Desc
+}
+
+func newLvstoreCollector(spdkNodes []util.SpdkNode) *lvstoreCollector {
+	labels := []string{"node", "lvstore"}
+	return &lvstoreCollector{
+		spdkNodes: spdkNodes,
+		totalDesc: prometheus.NewDesc("spdkcsi_lvstore_total_bytes", "Total size of lvstore.", labels, nil),
+		freeDesc:  prometheus.NewDesc("spdkcsi_lvstore_free_bytes", "Free size of lvstore.", labels, nil),
+	}
+}
+
+func (c *lvstoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.totalDesc
+	ch <- c.freeDesc
+}
+
+func (c *lvstoreCollector) Collect(ch chan<- prometheus.Metric) {
+	// query nodes concurrently and don't block scraper on unresponsive ones,
+	// lvstores of nodes not responding in time are not reported
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, spdkNode := range c.spdkNodes {
+		wg.Add(1)
+		go func(spdkNode util.SpdkNode) {
+			defer wg.Done()
+			c.collectNode(ctx, spdkNode, ch)
+		}(spdkNode)
+	}
+	wg.Wait()
+}
+
+func (c *lvstoreCollector) collectNode(ctx context.Context, spdkNode util.SpdkNode, ch chan<- prometheus.Metric) {
+	lvstores, err := spdkNode.LvStores(ctx)
+	if err != nil {
+		klog.Errorf("failed to get lvstores from node %s: %s", spdkNode.Info(), err)
+		return
+	}
+	for i := range lvstores {
+		lvs := &lvstores[i]
+		ch <- prometheus.MustNewConstMetric(c.totalDesc, prometheus.GaugeValue,
+			float64(lvs.TotalSizeMiB*1024*1024), spdkNode.Info(), lvs.Name)
+		ch <- prometheus.MustNewConstMetric(c.freeDesc, prometheus.GaugeValue,
+			float64(lvs.FreeSizeMiB*1024*1024), spdkNode.Info(), lvs.Name)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func TestLvstoreCollector(t *testing.T) {
+	saved := collectTimeout
+	collectTimeout = 200 * time.Millisecond
+	defer func() { collectTimeout = saved }()
+
+	// second node doesn't respond in time
+	var spdkNodes []util.SpdkNode
+	for i := 0; i < 2; i++ {
+		server := spdkrpctest.NewServer(spdkrpctest.Options{
+			LvStores: []spdkrpctest.LvStoreOptions{{Name: "lvs0", SizeMiB: 64}},
+		})
+		defer server.Close()
+		spdkNode, err := util.NewSpdkNode(server.URL, "", "", "nvme-tcp", "127.0.0.1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spdkNodes = append(spdkNodes, spdkNode)
+		if i == 1 {
+			server.Inject(spdkrpctest.Fault{Method: "bdev_lvol_get_lvstores", Delay: time.Minute})
+		}
+	}
+	spdkNode := spdkNodes[0]
+
+	registry := prometheus.NewPedanticRegistry()
+	err := registry.Register(newLvstoreCollector(spdkNodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`
+# HELP spdkcsi_lvstore_free_bytes Free size of lvstore.
+# TYPE spdkcsi_lvstore_free_bytes gauge
+spdkcsi_lvstore_free_bytes{lvstore="lvs0",node="%[1]s"} 6.7108864e+07
+# HELP spdkcsi_lvstore_total_bytes Total size of lvstore.
+# TYPE spdkcsi_lvstore_total_bytes gauge
+spdkcsi_lvstore_total_bytes{lvstore="lvs0",node="%[1]s"} 6.7108864e+07
+`, spdkNode.Info())
+
+	start := time.Now()
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*collectTimeout {
+		t.Fatalf("collect blocked by unresponsive node: %v", elapsed)
+	}
+}
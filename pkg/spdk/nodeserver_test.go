@@ -0,0 +1,844 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fake initiator backed by a temporary file as block device
+type fakeInitiator struct {
+	devicePath string
+	connectErr error
+
+	mtx         sync.Mutex
+	connected   bool
+	connects    int
+	disconnects int
+}
+
+func (fake *fakeInitiator) Connect(ctx context.Context) (string, error) {
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+
+	fake.connects++
+	if fake.connectErr != nil {
+		return "", fake.connectErr
+	}
+	err := ioutil.WriteFile(fake.devicePath, nil, 0600)
+	if err != nil {
+		return "", err
+	}
+	fake.connected = true
+	return fake.devicePath, nil
+}
+
+func (fake *fakeInitiator) Disconnect(ctx context.Context) error {
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+
+	fake.disconnects++
+	err := os.Remove(fake.devicePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fake.connected = false
+	return nil
+}
+
+func (fake *fakeInitiator) Condition() *util.VolumeCondition {
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+
+	if !fake.connected {
+		return &util.VolumeCondition{Abnormal: true, Message: "not connected"}
+	}
+	return &util.VolumeCondition{Message: "connected"}
+}
+
+// node server with fake mounter, exec and initiators
+func newTestNodeServer(t *testing.T) (*nodeServer, map[string]*fakeInitiator) {
+	stateDir, err := ioutil.TempDir("", "spdkcsi-state*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(stateDir) })
+
+	driver := csicommon.NewCSIDriver("csi.spdk.io", "test", "node0")
+	ns := newNodeServer(driver, stateDir)
+	return ns, fakeNodeServer(t, ns)
+}
+
+// replace mounter, exec and initiators of node server with fakes, initiators
+// are created per volume model and kept in the returned map
+func fakeNodeServer(t *testing.T, ns *nodeServer) map[string]*fakeInitiator {
+	devDir, err := ioutil.TempDir("", "spdkcsi-dev*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(devDir) })
+
+	var mtx sync.Mutex
+	initiators := make(map[string]*fakeInitiator)
+
+	ns.mounter = mount.NewFakeMounter(nil)
+	ns.exec = &testingexec.FakeExec{DisableScripts: true}
+	ns.newInitiator = func(volumeContext map[string]string) (util.SpdkCsiInitiator, error) {
+		model := volumeContext["model"]
+		if model == "" {
+			model = volumeContext["bdev"] // ephemeral volume
+		}
+		if model == "" {
+			return nil, errors.New("model missing")
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		initiator, exists := initiators[model]
+		if !exists {
+			initiator = &fakeInitiator{devicePath: filepath.Join(devDir, model)}
+			initiators[model] = initiator
+		}
+		return initiator, nil
+	}
+	return initiators
+}
+
+func stageRequest(volumeID, stagingPath string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     map[string]string{"model": volumeID},
+	}
+}
+
+func publishRequest(volumeID, stagingPath, targetPath string) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability(),
+	}
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestNodeStagePublish(t *testing.T) {
+	ns, initiators := newTestNodeServer(t)
+	mounter := ns.mounter.(*mount.FakeMounter)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const volumeID = "volume0"
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+
+	// stage twice, second one is no-op
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeStageVolume(ctx, stageRequest(volumeID, stagingPath))
+		if err != nil {
+			t.Fatalf("NodeStageVolume: %s", err)
+		}
+	}
+	initiator := initiators[volumeID]
+	if initiator.connects != 1 || !initiator.connected {
+		t.Fatalf("expect one connect, got %d", initiator.connects)
+	}
+	if log := mounter.GetLog(); len(log) != 1 || log[0].Source != initiator.devicePath || log[0].FSType != "ext4" {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+
+	// publish twice, second one is no-op
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+		if err != nil {
+			t.Fatalf("NodePublishVolume: %s", err)
+		}
+	}
+	if log := mounter.GetLog(); len(log) != 2 || log[1].Target != targetPath {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+
+	// unpublish twice, second one is no-op
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+		if err != nil {
+			t.Fatalf("NodeUnpublishVolume: %s", err)
+		}
+	}
+	if _, err = os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Fatalf("target path not removed: %v", err)
+	}
+
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume: %s", err)
+	}
+	if initiator.disconnects != 1 || initiator.connected {
+		t.Fatalf("expect one disconnect, got %d", initiator.disconnects)
+	}
+	if log := mounter.GetLog(); len(log) != 4 || log[3].Action != mount.FakeActionUnmount {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+	if len(mounter.MountPoints) != 0 {
+		t.Fatalf("mount points left: %v", mounter.MountPoints)
+	}
+
+	// volume is forgotten after unstage
+	_, err = ns.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expect NotFound: %v", err)
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+// block device or vhost socket is bind mounted to files, not formatted
+func TestNodeStagePublishBlock(t *testing.T) {
+	ns, initiators := newTestNodeServer(t)
+	mounter := ns.mounter.(*mount.FakeMounter)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const volumeID = "volume0"
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "pod", "target")
+
+	// vhost socket cannot be mounted as filesystem
+	stageReq := stageRequest(volumeID, stagingPath)
+	stageReq.VolumeContext["targetType"] = "vhost"
+	_, err = ns.NodeStageVolume(ctx, stageReq)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+
+	stageReq.VolumeCapability = blockCapability()
+	_, err = ns.NodeStageVolume(ctx, stageReq)
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %s", err)
+	}
+	publishReq := publishRequest(volumeID, stagingPath, targetPath)
+	publishReq.VolumeCapability = blockCapability()
+	_, err = ns.NodePublishVolume(ctx, publishReq)
+	if err != nil {
+		t.Fatalf("NodePublishVolume: %s", err)
+	}
+
+	// fake mounter logs source of bind mount as the device
+	devicePath := initiators[volumeID].devicePath
+	log := mounter.GetLog()
+	if len(log) != 2 || log[0].Source != devicePath || log[0].Target != filepath.Join(stagingPath, volumeID) ||
+		log[1].Source != devicePath || log[1].Target != targetPath || log[1].FSType != "" {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+	if info, err := os.Stat(targetPath); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("target path should be a file: %v", err)
+	}
+
+	_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+	if err != nil {
+		t.Fatalf("NodeUnpublishVolume: %s", err)
+	}
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume: %s", err)
+	}
+	if len(mounter.MountPoints) != 0 {
+		t.Fatalf("mount points left: %v", mounter.MountPoints)
+	}
+}
+
+// exec runs commands scripted per command name, blkid reports fsType, and
+// command lines are logged
+func scriptedExec(fsType string, log *[][]string) *testingexec.FakeExec {
+	fake := &testingexec.FakeExec{}
+	for i := 0; i < 10; i++ {
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			*log = append(*log, append([]string{cmd}, args...))
+			output := ""
+			if cmd == "blkid" && fsType != "" {
+				output = "TYPE=" + fsType + "\n"
+			}
+			fakeCmd := &testingexec.FakeCmd{
+				CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) { return []byte(output), nil, nil },
+				},
+			}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+	return fake
+}
+
+func TestNodeStageMkfs(t *testing.T) {
+	ns, initiators := newTestNodeServer(t)
+	mounter := ns.mounter.(*mount.FakeMounter)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// unformatted volume is formatted with mkfs parameters
+	var commands [][]string
+	ns.exec = scriptedExec("", &commands)
+	req := stageRequest("volume0", dir)
+	req.VolumeCapability.GetMount().FsType = "xfs"
+	req.VolumeContext["mkfsBlockSize"] = "4096"
+	req.VolumeContext["mkfsReflink"] = "true"
+	req.VolumeContext["fsLabel"] = "data"
+	_, err = ns.NodeStageVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %s", err)
+	}
+	devicePath := initiators["volume0"].devicePath
+	expect := []string{"mkfs.xfs", "-b", "size=4096", "-L", "data", "-m", "reflink=1", devicePath}
+	if len(commands) != 2 || strings.Join(commands[1], " ") != strings.Join(expect, " ") {
+		t.Fatalf("unexpected commands: %v", commands)
+	}
+	if log := mounter.GetLog(); len(log) != 1 || log[0].Source != devicePath || log[0].FSType != "xfs" {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+
+	// existing filesystem of another type is not reformatted
+	commands = nil
+	ns.exec = scriptedExec("xfs", &commands)
+	_, err = ns.NodeStageVolume(ctx, stageRequest("volume1", dir))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition: %v", err)
+	}
+	if len(commands) != 1 || commands[0][0] != "blkid" || initiators["volume1"].connected {
+		t.Fatalf("unexpected commands: %v", commands)
+	}
+
+	// existing filesystem of same type is checked and mounted
+	commands = nil
+	ns.exec = scriptedExec("ext4", &commands)
+	_, err = ns.NodeStageVolume(ctx, stageRequest("volume2", dir))
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %s", err)
+	}
+	for _, command := range commands {
+		if strings.HasPrefix(command[0], "mkfs") {
+			t.Fatalf("formatted existing filesystem: %v", commands)
+		}
+	}
+	if log := mounter.GetLog(); len(log) != 2 || log[1].FSType != "ext4" {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+}
+
+func TestNodeStageFailure(t *testing.T) {
+	ns, initiators := newTestNodeServer(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// missing arguments
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "volume0", StagingTargetPath: dir})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+
+	// invalid volume context
+	req := stageRequest("volume0", dir)
+	req.VolumeContext = nil
+	_, err = ns.NodeStageVolume(ctx, req)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expect Internal: %v", err)
+	}
+
+	// connect failure is reported and can be retried
+	_, err = ns.newInitiator(map[string]string{"model": "volume1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiators["volume1"].connectErr = errors.New("connect failed")
+	_, err = ns.NodeStageVolume(ctx, stageRequest("volume1", dir))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expect Internal: %v", err)
+	}
+	initiators["volume1"].connectErr = nil
+	_, err = ns.NodeStageVolume(ctx, stageRequest("volume1", dir))
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %s", err)
+	}
+}
+
+func TestNodeConcurrentRequest(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const volumeID = "volume0"
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+
+	// publish before stage
+	_, err = ns.NodeStageVolume(ctx, stageRequest(volumeID, stagingPath))
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %s", err)
+	}
+	ns.volumes[volumeID].stagingPath = ""
+	_, err = ns.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("expect Aborted: %v", err)
+	}
+	ns.volumes[volumeID].stagingPath = filepath.Join(stagingPath, volumeID)
+
+	// requests to a volume with ongoing request are aborted
+	volume := ns.volumes[volumeID]
+	if !volume.tryLock.Lock() {
+		t.Fatal("failed to lock volume")
+	}
+	_, err = ns.NodeStageVolume(ctx, stageRequest(volumeID, stagingPath))
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("NodeStageVolume: expect Aborted: %v", err)
+	}
+	_, err = ns.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("NodePublishVolume: expect Aborted: %v", err)
+	}
+	_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("NodeUnpublishVolume: expect Aborted: %v", err)
+	}
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("NodeUnstageVolume: expect Aborted: %v", err)
+	}
+	if ns.volumes[volumeID] == nil {
+		t.Fatal("aborted unstage should not forget volume")
+	}
+	volume.tryLock.Unlock()
+
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume: %s", err)
+	}
+}
+
+func TestNodeRecovery(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const volumeID = "volume0"
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	_, err = ns.NodeStageVolume(ctx, stageRequest(volumeID, stagingPath))
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %s", err)
+	}
+	_, err = ns.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+	if err != nil {
+		t.Fatalf("NodePublishVolume: %s", err)
+	}
+
+	// node server restarts, mount table is kept
+	restart := func(mounter mount.Interface) (*nodeServer, map[string]*fakeInitiator) {
+		driver := csicommon.NewCSIDriver("csi.spdk.io", "test", "node0")
+		nsNew := newNodeServer(driver, ns.stateDir)
+		initiators := fakeNodeServer(t, nsNew)
+		nsNew.mounter = mounter
+		err := nsNew.recoverVolumes()
+		if err != nil {
+			t.Fatalf("recoverVolumes: %s", err)
+		}
+		return nsNew, initiators
+	}
+	ns2, initiators := restart(ns.mounter)
+	if volume := ns2.volumes[volumeID]; volume == nil || volume.stagingPath != filepath.Join(stagingPath, volumeID) {
+		t.Fatalf("volume not recovered: %+v", volume)
+	}
+
+	// node restarts, staging mount is gone
+	ns3, _ := restart(mount.NewFakeMounter(nil))
+	if volume := ns3.volumes[volumeID]; volume == nil || volume.stagingPath != "" {
+		t.Fatalf("volume should be unstaged: %+v", volume)
+	}
+
+	// all requests work after restart
+	_, err = ns2.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+	if err != nil {
+		t.Fatalf("NodeUnpublishVolume: %s", err)
+	}
+	_, err = ns2.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+	if err != nil {
+		t.Fatalf("NodePublishVolume: %s", err)
+	}
+	_, err = ns2.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+	if err != nil {
+		t.Fatalf("NodeUnpublishVolume: %s", err)
+	}
+	_, err = ns2.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume: %s", err)
+	}
+	if initiators[volumeID].disconnects != 1 {
+		t.Fatal("recovered volume not disconnected")
+	}
+
+	// nothing to recover after unstage
+	ns4, _ := restart(ns.mounter)
+	if len(ns4.volumes) != 0 {
+		t.Fatalf("unexpected volumes: %v", ns4.volumes)
+	}
+}
+
+// node local spdk is faked, lvol bdev is the fake initiator model
+func fakeLocalNode(t *testing.T, ns *nodeServer) *spdkrpctest.Server {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	t.Cleanup(server.Close)
+	ns.newLocalNode = func() (util.SpdkNode, error) {
+		return util.NewSpdkNode(server.URL, "", "", "nbd", "", nil)
+	}
+	return server
+}
+
+func ephemeralRequest(volumeID, targetPath string) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:         volumeID,
+		TargetPath:       targetPath,
+		VolumeCapability: mountCapability(),
+		VolumeContext:    map[string]string{ephemeralContextKey: "true", "size": "8Mi"},
+	}
+}
+
+func TestNodeEphemeral(t *testing.T) {
+	ns, initiators := newTestNodeServer(t)
+	server := fakeLocalNode(t, ns)
+	mounter := ns.mounter.(*mount.FakeMounter)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const volumeID = "csi-ephemeral0"
+	targetPath := filepath.Join(dir, "pod0", "target")
+
+	// block access and invalid size are rejected
+	req := ephemeralRequest(volumeID, targetPath)
+	req.VolumeCapability = blockCapability()
+	_, err = ns.NodePublishVolume(ctx, req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+	req = ephemeralRequest(volumeID, targetPath)
+	req.VolumeContext["size"] = "-1"
+	_, err = ns.NodePublishVolume(ctx, req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+
+	// publish twice, second one is no-op
+	for i := 0; i < 2; i++ {
+		_, err = ns.NodePublishVolume(ctx, ephemeralRequest(volumeID, targetPath))
+		if err != nil {
+			t.Fatalf("NodePublishVolume: %s", err)
+		}
+	}
+	if calls := server.Calls("bdev_lvol_create"); calls != 1 {
+		t.Fatalf("expect 1 bdev_lvol_create, got %d", calls)
+	}
+	if len(initiators) != 1 {
+		t.Fatalf("expect 1 initiator, got %d", len(initiators))
+	}
+	initiator := ns.volumes[volumeID].initiator.(*fakeInitiator)
+	if log := mounter.GetLog(); len(log) != 1 || log[0].Source != initiator.devicePath ||
+		log[0].Target != targetPath || log[0].FSType != "ext4" {
+		t.Fatalf("unexpected mounts: %v", log)
+	}
+
+	// node server restarts, ephemeral volume is unpublished and deleted
+	driver := csicommon.NewCSIDriver("csi.spdk.io", "test", "node0")
+	ns2 := newNodeServer(driver, ns.stateDir)
+	initiators = fakeNodeServer(t, ns2)
+	ns2.mounter = ns.mounter
+	ns2.newLocalNode = ns.newLocalNode
+	err = ns2.recoverVolumes()
+	if err != nil {
+		t.Fatalf("recoverVolumes: %s", err)
+	}
+	if volume := ns2.volumes[volumeID]; volume == nil || volume.ephemeral == nil || volume.stagingPath != targetPath {
+		t.Fatalf("ephemeral volume not recovered: %+v", volume)
+	}
+	_, err = ns2.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+	if err != nil {
+		t.Fatalf("NodeUnpublishVolume: %s", err)
+	}
+	if initiators[filepath.Base(initiator.devicePath)].disconnects != 1 {
+		t.Fatal("ephemeral volume not disconnected")
+	}
+	if calls := server.Calls("bdev_lvol_delete"); calls != 1 {
+		t.Fatalf("expect 1 bdev_lvol_delete, got %d", calls)
+	}
+	if len(mounter.MountPoints) != 0 || len(ns2.volumes) != 0 {
+		t.Fatalf("volume left: %v, %v", mounter.MountPoints, ns2.volumes)
+	}
+	if _, err = os.Stat(ns2.stateFile(volumeID)); !os.IsNotExist(err) {
+		t.Fatalf("state file not removed: %v", err)
+	}
+}
+
+func TestNodeEphemeralGC(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	server := fakeLocalNode(t, ns)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// volume0 of deleted pod, volume1 of running pod
+	for _, volumeID := range []string{"volume0", "volume1"} {
+		_, err = ns.NodePublishVolume(ctx, ephemeralRequest(volumeID, filepath.Join(dir, volumeID, "target")))
+		if err != nil {
+			t.Fatalf("NodePublishVolume: %s", err)
+		}
+	}
+
+	// kubelet removed pod directory, unpublish never came
+	os.RemoveAll(filepath.Join(dir, "volume0"))
+	ns.gcEphemeralVolumes(ctx)
+	if _, exists := ns.volumes["volume0"]; exists || len(ns.volumes) != 1 {
+		t.Fatalf("unexpected volumes: %v", ns.volumes)
+	}
+	if _, err = os.Stat(ns.stateFile("volume0")); !os.IsNotExist(err) {
+		t.Fatalf("state file not removed: %v", err)
+	}
+	if calls := server.Calls("bdev_lvol_delete"); calls != 1 {
+		t.Fatalf("expect 1 bdev_lvol_delete, got %d", calls)
+	}
+	if lvols := ephemeralLvols(t, server); lvols != 1 {
+		t.Fatalf("expect 1 ephemeral lvol, got %d", lvols)
+	}
+
+	// csi-eph- lvol left without state, e.g., state directory lost
+	spdkNode, err := ns.getLocalNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = util.CreateEphemeralVolume(ctx, spdkNode, "volume2", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lvols := ephemeralLvols(t, server); lvols != 2 {
+		t.Fatalf("expect 2 ephemeral lvols, got %d", lvols)
+	}
+	ns.gcEphemeralVolumes(ctx)
+	if _, exists := ns.volumes["volume1"]; !exists || len(ns.volumes) != 1 {
+		t.Fatalf("unexpected volumes: %v", ns.volumes)
+	}
+	if calls := server.Calls("bdev_lvol_delete"); calls != 2 {
+		t.Fatalf("expect 2 bdev_lvol_delete, got %d", calls)
+	}
+	if lvols := ephemeralLvols(t, server); lvols != 1 {
+		t.Fatalf("expect 1 ephemeral lvol, got %d", lvols)
+	}
+
+	// ephemeral volume is not supported without node local spdk
+	ns2, _ := newTestNodeServer(t)
+	ns2.newLocalNode = func() (util.SpdkNode, error) {
+		return nil, util.ErrEphemeralUnsupported
+	}
+	_, err = ns2.NodePublishVolume(ctx, ephemeralRequest("volume3", filepath.Join(dir, "volume3", "target")))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition: %v", err)
+	}
+	ns2.gcEphemeralVolumes(ctx)
+
+	// nor without state directory, lvols could not be told from orphans
+	ns3 := newNodeServer(csicommon.NewCSIDriver("csi.spdk.io", "test", "node0"), "")
+	fakeNodeServer(t, ns3)
+	ns3.newLocalNode = ns.newLocalNode
+	_, err = ns3.NodePublishVolume(ctx, ephemeralRequest("volume3", filepath.Join(dir, "volume3", "target")))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition: %v", err)
+	}
+	if calls := server.Calls("bdev_lvol_create"); calls != 3 {
+		t.Fatalf("expect 3 bdev_lvol_create, got %d", calls)
+	}
+}
+
+// number of ephemeral lvols on the fake local spdk
+func ephemeralLvols(t *testing.T, server *spdkrpctest.Server) int {
+	client, err := spdkrpc.NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdevs, err := client.BdevGetBdevs(context.Background(), &spdkrpc.BdevGetBdevsParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for i := range bdevs {
+		for _, alias := range bdevs[i].Aliases {
+			if strings.Contains(alias, "/csi-eph-") {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spdkcsi-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const volumeID = "volume0"
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	_, err = ns.NodeStageVolume(ctx, stageRequest(volumeID, stagingPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ns.NodePublishVolume(ctx, publishRequest(volumeID, stagingPath, targetPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fake mounter leaves target path on the filesystem of temp dir
+	resp, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: volumeID, VolumePath: targetPath})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %s", err)
+	}
+	var statfs unix.Statfs_t
+	err = unix.Statfs(targetPath, &statfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := resp.GetUsage()
+	if len(usage) != 2 || usage[0].GetUnit() != csi.VolumeUsage_BYTES || usage[1].GetUnit() != csi.VolumeUsage_INODES {
+		t.Fatalf("unexpected usage: %v", usage)
+	}
+	// nolint:unconvert // field types differ among architectures
+	if usage[0].GetTotal() != int64(statfs.Blocks)*int64(statfs.Bsize) || usage[0].GetUsed() > usage[0].GetTotal() {
+		t.Fatalf("unexpected bytes usage: %v, statfs %+v", usage[0], statfs)
+	}
+	if usage[1].GetTotal() != int64(statfs.Files) || usage[1].GetUsed()+usage[1].GetAvailable() != usage[1].GetTotal() {
+		t.Fatalf("unexpected inodes usage: %v, statfs %+v", usage[1], statfs)
+	}
+	if condition := resp.GetVolumeCondition(); condition == nil || condition.GetAbnormal() {
+		t.Fatalf("unexpected condition: %v", condition)
+	}
+
+	// block volume reports size of device only
+	resp, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "unknown", VolumePath: "/dev/null"})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %s", err)
+	}
+	if usage := resp.GetUsage(); len(usage) != 1 || usage[0].GetUnit() != csi.VolumeUsage_BYTES || usage[0].GetTotal() != 0 {
+		t.Fatalf("unexpected usage: %v", usage)
+	}
+	if resp.GetVolumeCondition() != nil {
+		t.Fatalf("unknown volume should have no condition: %v", resp.GetVolumeCondition())
+	}
+	devicePath := filepath.Join(dir, "device")
+	err = ioutil.WriteFile(devicePath, make([]byte, 8192), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockUsage, err := blockVolumeUsage(devicePath)
+	if err != nil || len(blockUsage) != 1 || blockUsage[0].GetTotal() != 8192 {
+		t.Fatalf("blockVolumeUsage: %v, %v", blockUsage, err)
+	}
+
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: volumeID, VolumePath: filepath.Join(dir, "none")})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expect NotFound: %v", err)
+	}
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: volumeID})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument: %v", err)
+	}
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetNodeId() != "node0" || resp.GetAccessibleTopology().GetSegments()[topologyKeyNode] != "node0" {
+		t.Fatalf("unexpected node info: %v", resp)
+	}
+}
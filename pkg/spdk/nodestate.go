@@ -0,0 +1,152 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// staging metadata of a volume persisted in node state directory, so staged
+// volumes can be unstaged and published after node server restarts
+type volumeState struct {
+	VolumeContext map[string]string `json:"volumeContext"`
+	StagingPath   string            `json:"stagingPath"`
+	DevicePath    string            `json:"devicePath"`
+
+	// ephemeral volume is mounted at target path, volume context is empty
+	// if state is saved before lvol is created
+	Ephemeral  bool   `json:"ephemeral,omitempty"`
+	TargetPath string `json:"targetPath,omitempty"`
+}
+
+const stateFileSuffix = ".json"
+
+func (ns *nodeServer) stateFile(volumeID string) string {
+	// volume id may contain path separator
+	return filepath.Join(ns.stateDir, url.PathEscape(volumeID)+stateFileSuffix)
+}
+
+// write state file atomically, no-op if state directory is not configured
+func (ns *nodeServer) saveVolumeState(volumeID string, state *volumeState) error {
+	if ns.stateDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(ns.stateDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // nolint:errcheck // renamed on success
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), ns.stateFile(volumeID))
+}
+
+func (ns *nodeServer) removeVolumeState(volumeID string) error {
+	if ns.stateDir == "" {
+		return nil
+	}
+	err := os.Remove(ns.stateFile(volumeID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// rebuild volumes map from state directory, called once before serving
+func (ns *nodeServer) recoverVolumes() error {
+	if ns.stateDir == "" {
+		return nil
+	}
+	err := os.MkdirAll(ns.stateDir, 0700)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(ns.stateDir)
+	if err != nil {
+		return err
+	}
+
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, stateFileSuffix) {
+			continue
+		}
+		volumeID, err := url.PathUnescape(strings.TrimSuffix(name, stateFileSuffix))
+		if err != nil {
+			klog.Errorf("invalid state file %s: %s", name, err)
+			continue
+		}
+		var state volumeState
+		err = util.ParseJSONFile(filepath.Join(ns.stateDir, name), &state)
+		if err != nil {
+			klog.Errorf("failed to read state of volume %s: %s", volumeID, err)
+			continue
+		}
+		var initiator util.SpdkCsiInitiator
+		if !state.Ephemeral || state.VolumeContext != nil {
+			initiator, err = ns.newInitiator(state.VolumeContext)
+			if err != nil {
+				klog.Errorf("failed to create initiator of volume %s: %s", volumeID, err)
+				continue
+			}
+		}
+
+		// staging mount is gone after node reboot, volume must be staged again
+		stagingPath := state.StagingPath
+		unmounted, err := mount.IsNotMountPoint(ns.mounter, stagingPath)
+		if err != nil || unmounted {
+			klog.Warningf("volume %s not mounted at %s, treat as unstaged", volumeID, stagingPath)
+			stagingPath = ""
+		}
+
+		volume := &nodeVolume{
+			initiator:   initiator,
+			stagingPath: stagingPath,
+		}
+		if state.Ephemeral {
+			volume.ephemeral = &ephemeralVolume{targetPath: state.TargetPath}
+		}
+		ns.volumes[volumeID] = volume
+		klog.Infof("volume recovered: %s, staging path: %s, device: %s", volumeID, stagingPath, state.DevicePath)
+	}
+	return nil
+}
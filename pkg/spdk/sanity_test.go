@@ -0,0 +1,83 @@
+//go:build sanity
+// +build sanity
+
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// csi-test sanity suite against in-process controller and node servers backed
+// by fake spdk target and initiators, run by `make test` or `make sanity-test`
+func TestSanity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spdkcsi-sanity*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := spdkrpctest.NewServer(spdkrpctest.Options{
+		User:     "spdkcsiuser",
+		Password: "spdkcsipass",
+		LvStores: []spdkrpctest.LvStoreOptions{{Name: "lvs0", SizeMiB: 16 * 1024}},
+	})
+	defer server.Close()
+	err = createConfigFiles("nvme-tcp", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(os.Getenv("SPDKCSI_CONFIG"))
+		os.Remove(os.Getenv("SPDKCSI_SECRET"))
+	}()
+
+	conf := &util.Config{
+		DriverName:         "csi.spdk.io",
+		DriverVersion:      "sanity",
+		Endpoint:           "unix://" + filepath.Join(dir, "csi.sock"),
+		NodeID:             "sanity-node",
+		StateDir:           filepath.Join(dir, "state"),
+		ShutdownTimeout:    10 * time.Second,
+		IsControllerServer: true,
+		IsNodeServer:       true,
+	}
+	ids, cs, ns := newServers(conf)
+	fakeNodeServer(t, ns)
+
+	s := csicommon.NewNonBlockingGRPCServer()
+	s.Start(conf.Endpoint, ids, cs, ns)
+	defer shutdown(s, conf.ShutdownTimeout)
+
+	config := sanity.NewTestConfig()
+	config.Address = conf.Endpoint
+	config.TargetPath = filepath.Join(dir, "target")
+	config.StagingPath = filepath.Join(dir, "staging")
+	config.TestVolumeSize = 64 * 1024 * 1024
+	sanity.Test(t, config)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// kubelet syncs mounted secret about every minute
+const secretPollInterval = 30 * time.Second
+
+// spdk node config, see deploy/kubernetes/config-map.yaml
+type spdkNodeConfig struct {
+	Name       string `json:"name"`
+	URL        string `json:"rpcURL"`
+	TargetType string `json:"targetType"`
+	TargetAddr string `json:"targetAddr"`
+	TLS        struct {
+		ServerName string `json:"serverName"` // name in server certificate
+	} `json:"tls"`
+}
+
+// spdk node secret, see deploy/kubernetes/secret.yaml
+type spdkNodeSecret struct {
+	Name       string `json:"name"`
+	UserName   string `json:"username"`
+	Password   string `json:"password"`
+	CACert     string `json:"caCert"`     // PEM CA bundle
+	ClientCert string `json:"clientCert"` // PEM client certificate and key, for mutual tls
+	ClientKey  string `json:"clientKey"`
+}
+
+type spdkNodeSecrets struct {
+	Tokens []spdkNodeSecret `json:"rpcTokens"`
+}
+
+func (secrets *spdkNodeSecrets) find(name string) *spdkNodeSecret {
+	for i := range secrets.Tokens {
+		if secrets.Tokens[i].Name == name {
+			return &secrets.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// nil if rpcURL is not https
+func (config *spdkNodeConfig) tlsConfig(secret *spdkNodeSecret) *spdkrpc.TLSConfig {
+	u, err := url.Parse(config.URL)
+	if err != nil || !strings.EqualFold(u.Scheme, "https") {
+		return nil
+	}
+	return &spdkrpc.TLSConfig{
+		CACert:     []byte(secret.CACert),
+		ClientCert: []byte(secret.ClientCert),
+		ClientKey:  []byte(secret.ClientKey),
+		ServerName: config.TLS.ServerName,
+	}
+}
+
+func secretFile() string {
+	return util.FromEnv("SPDKCSI_SECRET", "/etc/spdkcsi-secret/secret.json")
+}
+
+// read spdk node configs and secrets mounted from config map and secret
+func readSpdkNodeConfigs() ([]spdkNodeConfig, *spdkNodeSecrets, error) {
+	// get spdk node configs, see deploy/kubernetes/config-map.yaml
+	var config struct {
+		Nodes []spdkNodeConfig `json:"Nodes"`
+	}
+	configFile := util.FromEnv("SPDKCSI_CONFIG", "/etc/spdkcsi-config/config.json")
+	err := util.ParseJSONFile(configFile, &config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// get spdk node secrets, see deploy/kubernetes/secret.yaml
+	var secrets spdkNodeSecrets
+	err = util.ParseJSONFile(secretFile(), &secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config.Nodes, &secrets, nil
+}
+
+// create spdk node, it's probed on first use
+func newSpdkNode(config *spdkNodeConfig, secret *spdkNodeSecret) (util.SpdkNode, error) {
+	return util.NewSpdkNode(config.URL, secret.UserName, secret.Password,
+		config.TargetType, config.TargetAddr, config.tlsConfig(secret))
+}
+
+// reloads certificates of https spdk nodes when mounted secret changes
+type certReloader struct {
+	secretFile string
+	content    []byte // last loaded secret file
+	configs    map[string]*spdkNodeConfig
+	nodes      map[string]util.SpdkNode
+}
+
+func newCertReloader(secretFile string) *certReloader {
+	content, _ := ioutil.ReadFile(secretFile)
+	return &certReloader{
+		secretFile: secretFile,
+		content:    content,
+		configs:    make(map[string]*spdkNodeConfig),
+		nodes:      make(map[string]util.SpdkNode),
+	}
+}
+
+// register spdk node for reloading, nodes not over https are ignored
+func (r *certReloader) add(config *spdkNodeConfig, node util.SpdkNode) {
+	if config.tlsConfig(&spdkNodeSecret{}) != nil {
+		r.configs[config.Name] = config
+		r.nodes[config.Name] = node
+	}
+}
+
+// poll secret file until ctx is done
+func (r *certReloader) run(ctx context.Context) {
+	if len(r.nodes) == 0 {
+		return
+	}
+	ticker := time.NewTicker(secretPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.reload()
+	}
+}
+
+func (r *certReloader) reload() {
+	content, err := ioutil.ReadFile(r.secretFile)
+	if err != nil {
+		klog.Errorf("failed to read secret: %s", err)
+		return
+	}
+	if bytes.Equal(content, r.content) {
+		return
+	}
+
+	var secrets spdkNodeSecrets
+	err = json.Unmarshal(content, &secrets)
+	if err != nil {
+		klog.Errorf("failed to parse secret: %s", err)
+		return
+	}
+
+	failed := false
+	for name, node := range r.nodes {
+		secret := secrets.find(name)
+		if secret == nil {
+			klog.Errorf("failed to find secret for spdk node %s", name)
+			failed = true
+			continue
+		}
+		// invalid certificates are rejected, node keeps using previous ones
+		err = node.SetTLSConfig(r.configs[name].tlsConfig(secret))
+		if err != nil {
+			klog.Errorf("failed to reload certificates of spdk node %s: %s", name, err)
+			failed = true
+			continue
+		}
+		klog.Infof("certificates reloaded: spdk node %s", name)
+	}
+	// retry on next poll if any node failed, e.g., secret partially updated
+	if !failed {
+		r.content = content
+	}
+}
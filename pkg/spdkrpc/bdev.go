@@ -0,0 +1,196 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import "context"
+
+// Bdev is an item of bdev_get_bdevs result, only common fields are decoded
+type Bdev struct {
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	ProductName string   `json:"product_name"`
+	BlockSize   int64    `json:"block_size"`
+	NumBlocks   int64    `json:"num_blocks"`
+	UUID        string   `json:"uuid"`
+}
+
+// BdevGetBdevsParams of bdev_get_bdevs, all bdevs are returned if Name is empty
+type BdevGetBdevsParams struct {
+	Name string `json:"name,omitempty"`
+}
+
+// BdevGetBdevs returns ErrNoSuchDevice if named bdev not found
+func (client *Client) BdevGetBdevs(ctx context.Context, params *BdevGetBdevsParams) ([]Bdev, error) {
+	var result []Bdev
+	err := client.Call(ctx, "bdev_get_bdevs", params, &result)
+	return result, err
+}
+
+// BdevCryptoCreateParams of bdev_crypto_create
+//
+// Before SPDK v23.01, key material is passed in Key, Cipher and Key2. Since
+// then, key is registered by accel_crypto_key_create and referred by KeyName.
+type BdevCryptoCreateParams struct {
+	BaseBdevName string `json:"base_bdev_name"`
+	Name         string `json:"name"`
+	CryptoPmd    string `json:"crypto_pmd,omitempty"`
+	Key          string `json:"key,omitempty"`
+	Cipher       string `json:"cipher,omitempty"`
+	Key2         string `json:"key2,omitempty"`
+	KeyName      string `json:"key_name,omitempty"`
+}
+
+// BdevCryptoCreate returns name of the crypto bdev
+func (client *Client) BdevCryptoCreate(ctx context.Context, params *BdevCryptoCreateParams) (string, error) {
+	var name string
+	err := client.Call(ctx, "bdev_crypto_create", params, &name)
+	return name, err
+}
+
+// BdevCryptoDelete deletes crypto bdev, base bdev is not touched
+func (client *Client) BdevCryptoDelete(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	return client.Call(ctx, "bdev_crypto_delete", &params, nil)
+}
+
+// AccelCryptoKeyCreateParams of accel_crypto_key_create, keys are in hex
+type AccelCryptoKeyCreateParams struct {
+	Name   string `json:"name"`
+	Cipher string `json:"cipher"`
+	Key    string `json:"key"`
+	Key2   string `json:"key2,omitempty"`
+}
+
+// AccelCryptoKeyCreate registers a crypto key to accel framework
+func (client *Client) AccelCryptoKeyCreate(ctx context.Context, params *AccelCryptoKeyCreateParams) error {
+	return client.Call(ctx, "accel_crypto_key_create", params, nil)
+}
+
+// AccelCryptoKeyDestroy removes a crypto key from accel framework
+func (client *Client) AccelCryptoKeyDestroy(ctx context.Context, keyName string) error {
+	params := struct {
+		KeyName string `json:"key_name"`
+	}{
+		KeyName: keyName,
+	}
+	return client.Call(ctx, "accel_crypto_key_destroy", &params, nil)
+}
+
+// BdevNvmeAttachControllerParams of bdev_nvme_attach_controller
+type BdevNvmeAttachControllerParams struct {
+	Name    string `json:"name"`
+	TrType  string `json:"trtype"`
+	TrAddr  string `json:"traddr"`
+	AdrFam  string `json:"adrfam,omitempty"`
+	TrSvcID string `json:"trsvcid,omitempty"`
+	SubNqn  string `json:"subnqn,omitempty"`
+}
+
+// BdevNvmeAttachController returns bdevs created from namespaces of the
+// controller, ErrAlreadyExists if the controller is already attached
+func (client *Client) BdevNvmeAttachController(ctx context.Context, params *BdevNvmeAttachControllerParams) ([]string, error) {
+	var bdevs []string
+	err := client.Call(ctx, "bdev_nvme_attach_controller", params, &bdevs)
+	return bdevs, err
+}
+
+// BdevNvmeDetachController detaches controller and deletes its bdevs
+func (client *Client) BdevNvmeDetachController(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	return client.Call(ctx, "bdev_nvme_detach_controller", &params, nil)
+}
+
+// BdevRaidCreateParams of bdev_raid_create, StripSizeKB is ignored by raid1
+type BdevRaidCreateParams struct {
+	Name        string   `json:"name"`
+	RaidLevel   string   `json:"raid_level"`
+	BaseBdevs   []string `json:"base_bdevs"`
+	StripSizeKB int      `json:"strip_size_kb"`
+}
+
+// BdevRaidCreate creates raid bdev over base bdevs
+func (client *Client) BdevRaidCreate(ctx context.Context, params *BdevRaidCreateParams) error {
+	return client.Call(ctx, "bdev_raid_create", params, nil)
+}
+
+// BdevRaidDelete deletes raid bdev, base bdevs are not touched
+func (client *Client) BdevRaidDelete(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	return client.Call(ctx, "bdev_raid_delete", &params, nil)
+}
+
+// BdevRaidAddBaseBdev adds base bdev to raid, raid1 starts rebuild onto it
+func (client *Client) BdevRaidAddBaseBdev(ctx context.Context, raidBdev, baseBdev string) error {
+	params := struct {
+		RaidBdev string `json:"raid_bdev"`
+		BaseBdev string `json:"base_bdev"`
+	}{
+		RaidBdev: raidBdev,
+		BaseBdev: baseBdev,
+	}
+	return client.Call(ctx, "bdev_raid_add_base_bdev", &params, nil)
+}
+
+// RaidBdev is an item of bdev_raid_get_bdevs result
+type RaidBdev struct {
+	Name                   string           `json:"name"`
+	State                  string           `json:"state"`
+	RaidLevel              string           `json:"raid_level"`
+	NumBaseBdevs           int              `json:"num_base_bdevs"`
+	NumBaseBdevsDiscovered int              `json:"num_base_bdevs_discovered"`
+	BaseBdevs              []RaidBaseBdev   `json:"base_bdevs_list"`
+	Process                *RaidBdevProcess `json:"process"`
+}
+
+// RaidBaseBdev is a base bdev of raid bdev
+type RaidBaseBdev struct {
+	Name         string `json:"name"`
+	IsConfigured bool   `json:"is_configured"`
+}
+
+// RaidBdevProcess is background process of raid bdev, e.g., rebuild
+type RaidBdevProcess struct {
+	Type     string `json:"type"`
+	Target   string `json:"target"`
+	Progress struct {
+		Percent float64 `json:"percent"`
+	} `json:"progress"`
+}
+
+// BdevRaidGetBdevs returns raid bdevs of category: all, online, configuring, offline
+func (client *Client) BdevRaidGetBdevs(ctx context.Context, category string) ([]RaidBdev, error) {
+	params := struct {
+		Category string `json:"category"`
+	}{
+		Category: category,
+	}
+	var result []RaidBdev
+	err := client.Call(ctx, "bdev_raid_get_bdevs", &params, &result)
+	return result, err
+}
@@ -0,0 +1,151 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// names before SPDK v19.10 renamed rpc methods, request parameters are same
+var legacyMethods = map[string]string{
+	"rpc_get_methods":              "get_rpc_methods",
+	"spdk_get_version":             "get_spdk_version",
+	"bdev_get_bdevs":               "get_bdevs",
+	"bdev_lvol_get_lvstores":       "get_lvol_stores",
+	"bdev_lvol_create":             "construct_lvol_bdev",
+	"bdev_lvol_delete":             "destroy_lvol_bdev",
+	"bdev_lvol_snapshot":           "snapshot_lvol_bdev",
+	"bdev_lvol_clone":              "clone_lvol_bdev",
+	"bdev_lvol_resize":             "resize_lvol_bdev",
+	"bdev_crypto_create":           "construct_crypto_bdev",
+	"bdev_crypto_delete":           "delete_crypto_bdev",
+	"bdev_nvme_attach_controller":  "construct_nvme_bdev",
+	"bdev_nvme_detach_controller":  "delete_nvme_controller",
+	"nvmf_create_subsystem":        "nvmf_subsystem_create",
+	"nvmf_delete_subsystem":        "delete_nvmf_subsystem",
+	"nvmf_get_transports":          "get_nvmf_transports",
+	"iscsi_create_portal_group":    "add_portal_group",
+	"iscsi_get_portal_groups":      "get_portal_groups",
+	"iscsi_create_initiator_group": "add_initiator_group",
+	"iscsi_get_initiator_groups":   "get_initiator_groups",
+	"iscsi_create_target_node":     "construct_target_node",
+	"iscsi_delete_target_node":     "delete_target_node",
+	"iscsi_get_target_nodes":       "get_target_nodes",
+	"nvmf_get_subsystems":          "get_nvmf_subsystems",
+	"bdev_lvol_inflate":            "inflate_lvol_bdev",
+	"bdev_lvol_rename":             "rename_lvol_bdev",
+	"vhost_create_blk_controller":  "construct_vhost_blk_controller",
+	"vhost_delete_controller":      "remove_vhost_controller",
+	"vhost_get_controllers":        "get_vhost_controllers",
+	"nbd_start_disk":               "start_nbd_disk",
+	"nbd_stop_disk":                "stop_nbd_disk",
+	"nbd_get_disks":                "get_nbd_disks",
+}
+
+// Capabilities of a spdk target, see Client.Probe
+type Capabilities struct {
+	Version string // e.g., "SPDK v20.01.1"
+	url     string
+	methods map[string]bool
+}
+
+// HasMethod checks if method, or its legacy name, is supported
+func (caps *Capabilities) HasMethod(method string) bool {
+	return caps.resolve(method) != ""
+}
+
+// Require returns ErrMethodUnsupported if any method is not supported
+func (caps *Capabilities) Require(methods ...string) error {
+	var missing []string
+	for _, method := range methods {
+		if !caps.HasMethod(method) {
+			missing = append(missing, method)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s(%s) lacks %s", ErrMethodUnsupported, caps.url, caps.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// method name understood by spdk target, empty if not supported
+// nil capabilities(not probed) supports everything
+func (caps *Capabilities) resolve(method string) string {
+	if caps == nil || caps.methods[method] {
+		return method
+	}
+	if legacy, exists := legacyMethods[method]; exists && caps.methods[legacy] {
+		return legacy
+	}
+	return ""
+}
+
+// Capabilities returns result of last Probe, nil if not probed
+func (client *Client) Capabilities() *Capabilities {
+	client.capsMtx.RLock()
+	defer client.capsMtx.RUnlock()
+	return client.caps
+}
+
+func (client *Client) setCapabilities(caps *Capabilities) {
+	client.capsMtx.Lock()
+	defer client.capsMtx.Unlock()
+	client.caps = caps
+}
+
+// Probe queries spdk version and supported methods, Call translates method
+// names for old spdk afterwards
+func (client *Client) Probe(ctx context.Context) error {
+	var methods []string
+	err := client.Call(ctx, "rpc_get_methods", nil, &methods)
+	if errors.Is(err, ErrMethodNotFound) {
+		err = client.Call(ctx, legacyMethods["rpc_get_methods"], nil, &methods)
+	}
+	if err != nil {
+		return err
+	}
+
+	caps := &Capabilities{
+		url:     client.url,
+		methods: make(map[string]bool, len(methods)),
+	}
+	for _, method := range methods {
+		caps.methods[method] = true
+	}
+	client.setCapabilities(caps) // call resolves method names from now on
+
+	var version struct {
+		Version string `json:"version"`
+	}
+	err = client.Call(ctx, "spdk_get_version", nil, &version)
+	if err != nil {
+		client.setCapabilities(nil) // probe again
+		return err
+	}
+	// concurrent calls may be reading caps, publish a copy with version
+	probed := *caps
+	probed.Version = version.Version
+	client.setCapabilities(&probed)
+
+	klog.Infof("spdk node %s: %s, %d rpc methods", client.url, probed.Version, len(methods))
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCapabilitiesLegacySpdk(t *testing.T) {
+	// spdk before v19.10 knows only legacy method names
+	methods := []string{"get_rpc_methods", "get_spdk_version", "get_lvol_stores", "construct_lvol_bdev", "snapshot_lvol_bdev"}
+	var mtx sync.Mutex
+	var called []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID     int32  `json:"id"`
+			Method string `json:"method"`
+		}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mtx.Lock()
+		called = append(called, request.Method)
+		mtx.Unlock()
+
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+		switch request.Method {
+		case "get_rpc_methods":
+			response["result"] = methods
+		case "get_spdk_version":
+			response["result"] = map[string]string{"version": "SPDK v19.07"}
+		case "get_lvol_stores":
+			response["result"] = []interface{}{}
+		default:
+			response["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+		}
+		json.NewEncoder(w).Encode(response) // nolint:errcheck // test only
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Probe(context.Background())
+	if err != nil {
+		t.Fatalf("probe: %s", err)
+	}
+	if client.caps.Version != "SPDK v19.07" {
+		t.Fatalf("unexpected version: %s", client.caps.Version)
+	}
+
+	_, err = client.BdevLvolGetLvstores(context.Background())
+	if err != nil {
+		t.Fatalf("BdevLvolGetLvstores: %s", err)
+	}
+	expected := []string{"rpc_get_methods", "get_rpc_methods", "get_spdk_version", "get_lvol_stores"}
+	if len(called) != len(expected) {
+		t.Fatalf("called %v, expected %v", called, expected)
+	}
+	for i := range expected {
+		if called[i] != expected[i] {
+			t.Fatalf("called %v, expected %v", called, expected)
+		}
+	}
+
+	err = client.caps.Require("bdev_lvol_snapshot")
+	if err != nil {
+		t.Fatalf("snapshot should be supported: %s", err)
+	}
+	err = client.caps.Require("bdev_lvol_clone", "bdev_lvol_resize")
+	if !errors.Is(err, ErrMethodUnsupported) {
+		t.Fatalf("clone should be unsupported: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package spdkrpc is a typed client of SPDK JSON-RPC API
+//
+// Client talks to spdk target through http proxy(spdk/scripts/rpc_http_proxy.py)
+// or directly to its unix or tcp socket. Typed methods are named after the rpc
+// methods, e.g., BdevLvolCreate for bdev_lvol_create, and Call can be used for
+// methods not covered.
+package spdkrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client is a jsonrpc client to spdk target, safe for concurrent use
+type Client struct {
+	// Observer, if not nil, is notified of calls and retries, e.g., to
+	// export metrics, must be set before first call
+	Observer Observer
+
+	url       string
+	transport transport
+	id        int32         // json request message ID, auto incremented
+	caps      *Capabilities // nil before probed
+	capsMtx   sync.RWMutex  // probing may run concurrently with calls
+}
+
+// Observer receives events of rpc calls
+type Observer interface {
+	ObserveCall(url, method string, start time.Time, err error)
+	ObserveRetry(url, method string)
+	ObserveRetryResult(url, method string, err error)
+}
+
+// transport sends a json request and returns the raw json response with
+// matching id, implementation must be safe for concurrent calls
+type transport interface {
+	roundTrip(ctx context.Context, id int32, request []byte) ([]byte, error)
+}
+
+// NewClient creates client per url scheme
+// - http://host:port: jsonrpc http proxy, with basic auth user and password
+// - https://host:port: same as above over tls, see SetTLSConfig
+// - unix:///var/tmp/spdk.sock: spdk target unix socket
+// - tcp://host:port: spdk target tcp socket
+func NewClient(rpcURL, user, password string) (*Client, error) {
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpcURL %s: %s", rpcURL, err)
+	}
+
+	client := Client{
+		url: rpcURL,
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		client.transport = newHTTPTransport(rpcURL, user, password, strings.EqualFold(u.Scheme, "https"))
+	case "unix":
+		client.transport = newSocketTransport("unix", u.Path)
+	case "tcp":
+		client.transport = newSocketTransport("tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported rpcURL scheme: %s", rpcURL)
+	}
+	return &client, nil
+}
+
+// URL returns rpc url of spdk target
+func (client *Client) URL() string {
+	return client.url
+}
+
+// Call sends request with params, and decodes result if not nil
+//
+// The call is abandoned when ctx is done or method timeout expires, see
+// SetTimeouts. Idempotent reads are retried on transient failures within the
+// timeout. Method is translated to legacy name if spdk target is probed and
+// doesn't know the current name.
+func (client *Client) Call(ctx context.Context, method string, params, result interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout(method))
+	defer cancel()
+
+	if resolved := client.Capabilities().resolve(method); resolved != "" {
+		method = resolved // legacy name on old spdk
+	}
+
+	start := time.Now()
+	defer func() {
+		if client.Observer != nil {
+			client.Observer.ObserveCall(client.url, method, start, err)
+		}
+	}()
+
+	return client.callWithRetry(ctx, method, params, result)
+}
+
+// single rpc request/response round trip
+func (client *Client) callOnce(ctx context.Context, method string, params, result interface{}) error {
+	type rpcRequest struct {
+		Ver    string `json:"jsonrpc"`
+		ID     int32  `json:"id"`
+		Method string `json:"method"`
+	}
+
+	id := atomic.AddInt32(&client.id, 1)
+	request := rpcRequest{
+		Ver:    "2.0",
+		ID:     id,
+		Method: method,
+	}
+
+	var data []byte
+	var err error
+
+	if params == nil {
+		data, err = json.Marshal(request)
+	} else {
+		requestWithParams := struct {
+			rpcRequest
+			Params interface{} `json:"params"`
+		}{
+			request,
+			params,
+		}
+		data, err = json.Marshal(requestWithParams)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", method, err)
+	}
+
+	data, err = client.transport.roundTrip(ctx, id, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+
+	response := struct {
+		ID    int32 `json:"id"`
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Result interface{} `json:"result"`
+	}{
+		Result: result,
+	}
+
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return fmt.Errorf("%s: %s", method, err)
+	}
+	if response.ID != id {
+		return fmt.Errorf("%s: json response ID mismatch", method)
+	}
+	if response.Error.Code != 0 {
+		return &Error{
+			Method:  method,
+			Code:    response.Error.Code,
+			Message: response.Error.Message,
+		}
+	}
+
+	return nil
+}
+
+// jsonrpc http proxy
+type httpTransport struct {
+	url        string
+	user       string
+	password   string
+	https      bool
+	tlsConfig  atomic.Value // *tls.Config
+	httpClient *http.Client
+}
+
+func newHTTPTransport(rpcURL, user, password string, https bool) *httpTransport {
+	t := &httpTransport{
+		url:      rpcURL,
+		user:     user,
+		password: password,
+		https:    https,
+	}
+	// verify server with system roots until SetTLSConfig is called
+	t.tlsConfig.Store(&tls.Config{MinVersion: tls.VersionTLS12})
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialTLSContext = t.dialTLS
+	t.httpClient = &http.Client{Transport: transport} // timeout per request context
+	return t
+}
+
+func (t *httpTransport) roundTrip(ctx context.Context, id int32, request []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(t.user, t.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isCertError(err) {
+			return nil, err // not transient, retry won't help
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		// proxy up but spdk target behind it may be down
+		return nil, fmt.Errorf("%w: HTTP error code: %d", ErrUnavailable, resp.StatusCode)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("HTTP error code: %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
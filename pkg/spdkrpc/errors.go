@@ -0,0 +1,99 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// sentinel errors, see Error for how spdk errors are mapped
+var (
+	ErrNoSpaceLeft   = errors.New("json: No space left")
+	ErrNoSuchDevice  = errors.New("json: No such device")
+	ErrAlreadyExists = errors.New("json: Already exists")
+
+	// spdk target unreachable or temporarily out of resource, request may be retried
+	ErrUnavailable = errors.New("spdk rpc unavailable")
+
+	// resource in use, e.g., exported lvol, request fails again until it's released
+	ErrBusy = errors.New("json: Device or resource busy")
+
+	// operation refused in current state, e.g., deleting snapshot of more than one clone
+	ErrNotPermitted = errors.New("json: Operation not permitted")
+
+	// spdk target doesn't support the method, see Capabilities
+	ErrMethodNotFound    = errors.New("json: Method not found")
+	ErrMethodUnsupported = errors.New("spdk rpc method unsupported")
+)
+
+// Error is an error response returned by spdk target
+//
+// Use errors.Is to check against sentinel errors, e.g., ErrNoSuchDevice,
+// or errors.As to get the details.
+type Error struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: json response error(%d): %s", e.Method, e.Code, e.Message)
+}
+
+// Is reports whether the error maps to target sentinel error
+func (e *Error) Is(target error) bool {
+	sentinel := e.sentinel()
+	return sentinel != nil && sentinel == target
+}
+
+// spdk reports failures in two ways:
+//   - negative errno as error code, e.g., -19 for ENODEV
+//   - generic json-rpc error code(invalid params, internal error) with
+//     strerror(errno) as message, e.g., "No such device"
+var errnoSentinels = map[syscall.Errno]error{
+	syscall.ENODEV: ErrNoSuchDevice,
+	syscall.ENOENT: ErrNoSuchDevice,
+	syscall.ENOSPC: ErrNoSpaceLeft,
+	syscall.EEXIST: ErrAlreadyExists,
+	syscall.EBUSY:  ErrBusy,
+	syscall.EPERM:  ErrNotPermitted,
+	syscall.EAGAIN: ErrUnavailable,
+}
+
+// json-rpc 2.0 reserves -32768 to -32000 for pre-defined errors
+const (
+	minErrno          = -32000
+	errMethodNotFound = -32601
+)
+
+func (e *Error) sentinel() error {
+	if e.Code == errMethodNotFound {
+		return ErrMethodNotFound
+	}
+	if e.Code < 0 && e.Code > minErrno {
+		return errnoSentinels[syscall.Errno(-e.Code)]
+	}
+	for errno, sentinel := range errnoSentinels {
+		if strings.EqualFold(e.Message, errno.Error()) {
+			return sentinel
+		}
+	}
+	return nil
+}
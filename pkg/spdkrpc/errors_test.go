@@ -0,0 +1,59 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		code     int
+		message  string
+		sentinel error
+	}{
+		{-19, "No such device", ErrNoSuchDevice},
+		{-2, "No such file or directory", ErrNoSuchDevice},
+		{-28, "anything", ErrNoSpaceLeft},
+		{-17, "File exists", ErrAlreadyExists},
+		{-16, "Device or resource busy", ErrBusy},
+		{-11, "Resource temporarily unavailable", ErrUnavailable},
+		{-32602, "Operation not permitted", ErrNotPermitted},
+		{-32602, "No such device", ErrNoSuchDevice},
+		{-32603, "No space left on device", ErrNoSpaceLeft},
+		{-32602, "Invalid parameters", nil},
+		// only whole message is matched
+		{-32602, "bdev_lvol_create: No such device or address", nil},
+	}
+
+	sentinels := []error{ErrNoSuchDevice, ErrNoSpaceLeft, ErrAlreadyExists, ErrUnavailable, ErrBusy, ErrNotPermitted}
+	for _, tt := range tests {
+		err := fmt.Errorf("wrapped: %w", &Error{Method: "test", Code: tt.code, Message: tt.message})
+		for _, sentinel := range sentinels {
+			if errors.Is(err, sentinel) != (sentinel == tt.sentinel) {
+				t.Errorf("code %d, message %q: errors.Is(%v) = %v", tt.code, tt.message, sentinel, !(sentinel == tt.sentinel))
+			}
+		}
+
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) || rpcErr.Code != tt.code || rpcErr.Method != "test" {
+			t.Errorf("code %d: errors.As failed: %v", tt.code, err)
+		}
+	}
+}
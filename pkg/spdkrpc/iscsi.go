@@ -0,0 +1,133 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// IscsiPortal is a listening address of portal group
+type IscsiPortal struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+// IscsiPortalGroup of iscsi_create_portal_group and iscsi_get_portal_groups
+type IscsiPortalGroup struct {
+	Portals []IscsiPortal `json:"portals"`
+	Tag     int           `json:"tag"`
+}
+
+// IscsiCreatePortalGroup adds a portal group
+func (client *Client) IscsiCreatePortalGroup(ctx context.Context, group *IscsiPortalGroup) error {
+	return client.callBool(ctx, "iscsi_create_portal_group", group)
+}
+
+// IscsiGetPortalGroups returns all portal groups
+func (client *Client) IscsiGetPortalGroups(ctx context.Context) ([]IscsiPortalGroup, error) {
+	var result []IscsiPortalGroup
+	err := client.Call(ctx, "iscsi_get_portal_groups", nil, &result)
+	return result, err
+}
+
+// IscsiInitiatorGroup of iscsi_create_initiator_group and iscsi_get_initiator_groups
+type IscsiInitiatorGroup struct {
+	Initiators []string `json:"initiators"`
+	Tag        int      `json:"tag"`
+	Netmasks   []string `json:"netmasks"`
+}
+
+// IscsiCreateInitiatorGroup adds an initiator group
+func (client *Client) IscsiCreateInitiatorGroup(ctx context.Context, group *IscsiInitiatorGroup) error {
+	return client.callBool(ctx, "iscsi_create_initiator_group", group)
+}
+
+// IscsiGetInitiatorGroups returns all initiator groups
+func (client *Client) IscsiGetInitiatorGroups(ctx context.Context) ([]IscsiInitiatorGroup, error) {
+	var result []IscsiInitiatorGroup
+	err := client.Call(ctx, "iscsi_get_initiator_groups", nil, &result)
+	return result, err
+}
+
+// IscsiLun maps a bdev to lun of target node
+type IscsiLun struct {
+	LunID    int    `json:"lun_id"`
+	BdevName string `json:"bdev_name"`
+}
+
+// IscsiPgIgMap maps a portal group to an initiator group
+type IscsiPgIgMap struct {
+	IgTag int `json:"ig_tag"`
+	PgTag int `json:"pg_tag"`
+}
+
+// IscsiCreateTargetNodeParams of iscsi_create_target_node, Name is without
+// iqn prefix, e.g., "disk1" for "iqn.2016-06.io.spdk:disk1"
+type IscsiCreateTargetNodeParams struct {
+	Name        string         `json:"name"`
+	AliasName   string         `json:"alias_name"`
+	Luns        []IscsiLun     `json:"luns"`
+	PgIgMaps    []IscsiPgIgMap `json:"pg_ig_maps"`
+	QueueDepth  int            `json:"queue_depth"`
+	DisableChap bool           `json:"disable_chap"`
+}
+
+// IscsiCreateTargetNode adds an iSCSI target node
+func (client *Client) IscsiCreateTargetNode(ctx context.Context, params *IscsiCreateTargetNodeParams) error {
+	return client.callBool(ctx, "iscsi_create_target_node", params)
+}
+
+// IscsiDeleteTargetNode deletes target node by full name with iqn prefix
+func (client *Client) IscsiDeleteTargetNode(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	return client.callBool(ctx, "iscsi_delete_target_node", &params)
+}
+
+// IscsiTargetNode is an item of iscsi_get_target_nodes result, Name is with
+// iqn prefix
+type IscsiTargetNode struct {
+	Name       string         `json:"name"`
+	AliasName  string         `json:"alias_name"`
+	Luns       []IscsiLun     `json:"luns"`
+	PgIgMaps   []IscsiPgIgMap `json:"pg_ig_maps"`
+	QueueDepth int            `json:"queue_depth"`
+}
+
+// IscsiGetTargetNodes returns all target nodes
+func (client *Client) IscsiGetTargetNodes(ctx context.Context) ([]IscsiTargetNode, error) {
+	var result []IscsiTargetNode
+	err := client.Call(ctx, "iscsi_get_target_nodes", nil, &result)
+	return result, err
+}
+
+// iscsi methods returning true on success
+func (client *Client) callBool(ctx context.Context, method string, params interface{}) error {
+	var result bool
+	err := client.Call(ctx, method, params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("%s: failure", method)
+	}
+	return nil
+}
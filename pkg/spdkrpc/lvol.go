@@ -0,0 +1,128 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import "context"
+
+// LvStore is an item of bdev_lvol_get_lvstores result
+type LvStore struct {
+	UUID          string `json:"uuid"`
+	Name          string `json:"name"`
+	BaseBdev      string `json:"base_bdev"`
+	FreeClusters  int64  `json:"free_clusters"`
+	ClusterSize   int64  `json:"cluster_size"`
+	TotalClusters int64  `json:"total_data_clusters"`
+	BlockSize     int64  `json:"block_size"`
+}
+
+// BdevLvolGetLvstores returns all lvstores
+func (client *Client) BdevLvolGetLvstores(ctx context.Context) ([]LvStore, error) {
+	var result []LvStore
+	err := client.Call(ctx, "bdev_lvol_get_lvstores", nil, &result)
+	return result, err
+}
+
+// BdevLvolCreateParams of bdev_lvol_create, size in bytes
+type BdevLvolCreateParams struct {
+	LvolName      string `json:"lvol_name"`
+	Size          int64  `json:"size"`
+	LvsName       string `json:"lvs_name,omitempty"`
+	UUID          string `json:"uuid,omitempty"`
+	ClearMethod   string `json:"clear_method,omitempty"` // none, unmap, write_zeroes
+	ThinProvision bool   `json:"thin_provision"`
+}
+
+// BdevLvolCreate returns uuid of the lvol, ErrNoSpaceLeft if lvstore is full
+func (client *Client) BdevLvolCreate(ctx context.Context, params *BdevLvolCreateParams) (string, error) {
+	var lvolID string
+	err := client.Call(ctx, "bdev_lvol_create", params, &lvolID)
+	return lvolID, err
+}
+
+// BdevLvolDelete deletes lvol by uuid or alias
+func (client *Client) BdevLvolDelete(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	return client.Call(ctx, "bdev_lvol_delete", &params, nil)
+}
+
+// BdevLvolResize resizes lvol to size in bytes
+func (client *Client) BdevLvolResize(ctx context.Context, name string, size int64) error {
+	params := struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}{
+		Name: name,
+		Size: size,
+	}
+	return client.Call(ctx, "bdev_lvol_resize", &params, nil)
+}
+
+// BdevLvolSnapshot returns uuid of the read only snapshot
+func (client *Client) BdevLvolSnapshot(ctx context.Context, lvolName, snapshotName string) (string, error) {
+	params := struct {
+		LvolName     string `json:"lvol_name"`
+		SnapshotName string `json:"snapshot_name"`
+	}{
+		LvolName:     lvolName,
+		SnapshotName: snapshotName,
+	}
+	var snapshotID string
+	err := client.Call(ctx, "bdev_lvol_snapshot", &params, &snapshotID)
+	return snapshotID, err
+}
+
+// BdevLvolClone returns uuid of the writable clone of a snapshot
+func (client *Client) BdevLvolClone(ctx context.Context, snapshotName, cloneName string) (string, error) {
+	params := struct {
+		SnapshotName string `json:"snapshot_name"`
+		CloneName    string `json:"clone_name"`
+	}{
+		SnapshotName: snapshotName,
+		CloneName:    cloneName,
+	}
+	var lvolID string
+	err := client.Call(ctx, "bdev_lvol_clone", &params, &lvolID)
+	return lvolID, err
+}
+
+// BdevLvolInflate allocates all clusters of a thin provisioned or cloned
+// lvol, which is then independent of its parent snapshot
+func (client *Client) BdevLvolInflate(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	return client.Call(ctx, "bdev_lvol_inflate", &params, nil)
+}
+
+// BdevLvolRename renames lvol, oldName is uuid or alias, newName is the new
+// lvol name without lvstore prefix
+func (client *Client) BdevLvolRename(ctx context.Context, oldName, newName string) error {
+	params := struct {
+		OldName string `json:"old_name"`
+		NewName string `json:"new_name"`
+	}{
+		OldName: oldName,
+		NewName: newName,
+	}
+	return client.Call(ctx, "bdev_lvol_rename", &params, nil)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+)
+
+// NbdDisk is an item of nbd_get_disks result
+type NbdDisk struct {
+	BdevName  string `json:"bdev_name"`
+	NbdDevice string `json:"nbd_device"`
+}
+
+// NbdStartDisk exports a bdev as nbd device on spdk host, the first free
+// device is picked if nbdDevice is empty, returns the device path
+func (client *Client) NbdStartDisk(ctx context.Context, bdevName, nbdDevice string) (string, error) {
+	params := struct {
+		BdevName  string `json:"bdev_name"`
+		NbdDevice string `json:"nbd_device,omitempty"`
+	}{
+		BdevName:  bdevName,
+		NbdDevice: nbdDevice,
+	}
+	var result string
+	err := client.Call(ctx, "nbd_start_disk", &params, &result)
+	return result, err
+}
+
+// NbdStopDisk stops exporting the nbd device
+func (client *Client) NbdStopDisk(ctx context.Context, nbdDevice string) error {
+	params := struct {
+		NbdDevice string `json:"nbd_device"`
+	}{
+		NbdDevice: nbdDevice,
+	}
+	return client.callBool(ctx, "nbd_stop_disk", &params)
+}
+
+// NbdGetDisks returns the named nbd device, or all if nbdDevice is empty
+func (client *Client) NbdGetDisks(ctx context.Context, nbdDevice string) ([]NbdDisk, error) {
+	var params interface{}
+	if nbdDevice != "" {
+		params = struct {
+			NbdDevice string `json:"nbd_device"`
+		}{
+			NbdDevice: nbdDevice,
+		}
+	}
+	var result []NbdDisk
+	err := client.Call(ctx, "nbd_get_disks", params, &result)
+	return result, err
+}
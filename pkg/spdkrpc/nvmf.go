@@ -0,0 +1,151 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import "context"
+
+// NvmfCreateTransportParams of nvmf_create_transport, zero values are not
+// sent and spdk defaults apply
+type NvmfCreateTransportParams struct {
+	TrType             string `json:"trtype"`
+	MaxQueueDepth      int    `json:"max_queue_depth,omitempty"`
+	MaxIOQpairsPerCtrl int    `json:"max_io_qpairs_per_ctrlr,omitempty"`
+	InCapsuleDataSize  int    `json:"in_capsule_data_size,omitempty"`
+	MaxIOSize          int    `json:"max_io_size,omitempty"`
+	IOUnitSize         int    `json:"io_unit_size,omitempty"`
+}
+
+// NvmfCreateTransport creates transport of type RDMA, TCP, etc.
+func (client *Client) NvmfCreateTransport(ctx context.Context, params *NvmfCreateTransportParams) error {
+	return client.Call(ctx, "nvmf_create_transport", params, nil)
+}
+
+// NvmfTransport is an item of nvmf_get_transports result
+type NvmfTransport struct {
+	TrType        string `json:"trtype"`
+	MaxQueueDepth int    `json:"max_queue_depth"`
+	MaxIOSize     int    `json:"max_io_size"`
+	IOUnitSize    int    `json:"io_unit_size"`
+}
+
+// NvmfGetTransports returns created transports
+func (client *Client) NvmfGetTransports(ctx context.Context) ([]NvmfTransport, error) {
+	var result []NvmfTransport
+	err := client.Call(ctx, "nvmf_get_transports", nil, &result)
+	return result, err
+}
+
+// NvmfCreateSubsystemParams of nvmf_create_subsystem
+type NvmfCreateSubsystemParams struct {
+	Nqn           string `json:"nqn"`
+	AllowAnyHost  bool   `json:"allow_any_host"`
+	SerialNumber  string `json:"serial_number,omitempty"`
+	ModelNumber   string `json:"model_number,omitempty"`
+	MaxNamespaces int    `json:"max_namespaces,omitempty"`
+}
+
+// NvmfCreateSubsystem creates NVMe-oF subsystem
+func (client *Client) NvmfCreateSubsystem(ctx context.Context, params *NvmfCreateSubsystemParams) error {
+	return client.Call(ctx, "nvmf_create_subsystem", params, nil)
+}
+
+// NvmfDeleteSubsystem deletes subsystem with its namespaces and listeners,
+// bdevs are not touched
+func (client *Client) NvmfDeleteSubsystem(ctx context.Context, nqn string) error {
+	params := struct {
+		Nqn string `json:"nqn"`
+	}{
+		Nqn: nqn,
+	}
+	return client.Call(ctx, "nvmf_delete_subsystem", &params, nil)
+}
+
+// NvmfNamespace of nvmf_subsystem_add_ns, NsID is assigned by spdk if zero
+type NvmfNamespace struct {
+	BdevName string `json:"bdev_name"`
+	NsID     int    `json:"nsid,omitempty"`
+	NGUID    string `json:"nguid,omitempty"`
+	EUI64    string `json:"eui64,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
+}
+
+// NvmfSubsystemAddNs adds bdev as namespace of subsystem, returns nsid
+func (client *Client) NvmfSubsystemAddNs(ctx context.Context, nqn string, namespace *NvmfNamespace) (int, error) {
+	params := struct {
+		Nqn       string         `json:"nqn"`
+		Namespace *NvmfNamespace `json:"namespace"`
+	}{
+		Nqn:       nqn,
+		Namespace: namespace,
+	}
+	var nsID int
+	err := client.Call(ctx, "nvmf_subsystem_add_ns", &params, &nsID)
+	return nsID, err
+}
+
+// NvmfSubsystemRemoveNs removes namespace from subsystem
+func (client *Client) NvmfSubsystemRemoveNs(ctx context.Context, nqn string, nsID int) error {
+	params := struct {
+		Nqn  string `json:"nqn"`
+		NsID int    `json:"nsid"`
+	}{
+		Nqn:  nqn,
+		NsID: nsID,
+	}
+	return client.Call(ctx, "nvmf_subsystem_remove_ns", &params, nil)
+}
+
+// NvmfListenAddress is address of subsystem listener
+type NvmfListenAddress struct {
+	TrType  string `json:"trtype"`
+	AdrFam  string `json:"adrfam"`
+	TrAddr  string `json:"traddr"`
+	TrSvcID string `json:"trsvcid"`
+}
+
+// NvmfSubsystemAddListener starts listening on address for subsystem
+func (client *Client) NvmfSubsystemAddListener(ctx context.Context, nqn string, address *NvmfListenAddress) error {
+	params := struct {
+		Nqn           string             `json:"nqn"`
+		ListenAddress *NvmfListenAddress `json:"listen_address"`
+	}{
+		Nqn:           nqn,
+		ListenAddress: address,
+	}
+	return client.Call(ctx, "nvmf_subsystem_add_listener", &params, nil)
+}
+
+// NvmfSubsystem is an item of nvmf_get_subsystems result
+type NvmfSubsystem struct {
+	Nqn             string              `json:"nqn"`
+	Subtype         string              `json:"subtype"`
+	ListenAddresses []NvmfListenAddress `json:"listen_addresses"`
+	AllowAnyHost    bool                `json:"allow_any_host"`
+	Hosts           []struct {
+		Nqn string `json:"nqn"`
+	} `json:"hosts"`
+	SerialNumber string          `json:"serial_number"`
+	ModelNumber  string          `json:"model_number"`
+	Namespaces   []NvmfNamespace `json:"namespaces"`
+}
+
+// NvmfGetSubsystems returns all subsystems, including discovery subsystem
+func (client *Client) NvmfGetSubsystems(ctx context.Context) ([]NvmfSubsystem, error) {
+	var result []NvmfSubsystem
+	err := client.Call(ctx, "nvmf_get_subsystems", nil, &result)
+	return result, err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// retry policy of idempotent calls
+const (
+	maxRetries     = 4
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 3 * time.Second
+)
+
+// retry idempotent reads on transient failures, e.g., dropped connection to
+// http proxy, 5xx from proxy, EAGAIN from spdk target
+//
+// Mutating methods are never retried, as a failed request may have reached
+// spdk target and retrying it is not safe, e.g., creating lvol twice.
+func (client *Client) callWithRetry(ctx context.Context, method string, args, result interface{}) error {
+	err := client.callOnce(ctx, method, args, result)
+	if err == nil || !isIdempotent(method) {
+		return err
+	}
+
+	retries := 0
+	for retries < maxRetries && isTransient(ctx, err) {
+		delay := retryDelay(retries)
+		klog.Warningf("%s to %s failed: %s, retry %d/%d in %v", method, client.url, err, retries+1, maxRetries, delay)
+		if sleep(ctx, delay) != nil {
+			break
+		}
+		retries++
+		if client.Observer != nil {
+			client.Observer.ObserveRetry(client.url, method)
+		}
+		err = client.callOnce(ctx, method, args, result)
+	}
+
+	if retries > 0 {
+		if client.Observer != nil {
+			client.Observer.ObserveRetryResult(client.url, method, err)
+		}
+		if err == nil {
+			klog.Infof("%s to %s succeeded after %d retries", method, client.url, retries)
+		} else {
+			klog.Errorf("%s to %s failed after %d retries: %s", method, client.url, retries, err)
+		}
+	}
+	return err
+}
+
+// read methods, e.g., bdev_lvol_get_lvstores, nvmf_get_subsystems, and legacy
+// names like get_bdevs
+func isIdempotent(method string) bool {
+	return strings.Contains(method, "_get_") || strings.HasPrefix(method, "get_")
+}
+
+func isTransient(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && errors.Is(err, ErrUnavailable)
+}
+
+// exponential backoff with jitter, in [delay/2, delay]
+func retryDelay(retries int) time.Duration {
+	delay := retryMaxDelay
+	if retries < 16 && retryBaseDelay<<retries < delay {
+		delay = retryBaseDelay << retries
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) // nolint:gosec // no need of crypto rand
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRPCRetry(t *testing.T) {
+	// fail first two requests with 503, then echo request id
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var request struct {
+			ID int32 `json:"id"`
+		}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck // test only
+			"jsonrpc": "2.0",
+			"id":      request.ID,
+			"result":  true,
+		})
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mutating method is not retried
+	err = client.Call(context.Background(), "bdev_lvol_create", nil, nil)
+	if !errors.Is(err, ErrUnavailable) || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("mutating method: requests=%d, err=%v", requests, err)
+	}
+
+	// read method is retried until success
+	var result bool
+	err = client.Call(context.Background(), "bdev_get_bdevs", nil, &result)
+	if err != nil || !result || atomic.LoadInt32(&requests) != 3 {
+		t.Fatalf("read method: requests=%d, result=%v, err=%v", requests, result, err)
+	}
+}
+
+func TestRPCNoRetryBusy(t *testing.T) {
+	// resource in use doesn't go away by retrying
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var request struct {
+			ID int32 `json:"id"`
+		}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck // test only
+			"jsonrpc": "2.0",
+			"id":      request.ID,
+			"error":   map[string]interface{}{"code": -16, "message": "Device or resource busy"},
+		})
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call(context.Background(), "bdev_get_bdevs", nil, nil)
+	if !errors.Is(err, ErrBusy) || errors.Is(err, ErrUnavailable) || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("busy: requests=%d, err=%v", requests, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for retries := 0; retries < 100; retries++ {
+		delay := retryDelay(retries)
+		if delay < retryBaseDelay/2 || delay > retryMaxDelay {
+			t.Fatalf("retry %d: delay out of range: %v", retries, delay)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// jsonrpc 2.0 directly to spdk target unix or tcp socket
+//
+// Requests are written to one persistent connection, responses are read from
+// the json stream by a reader goroutine and dispatched to callers by id, so
+// concurrent requests don't wait for each other. Connection is re-established
+// on next request after any read/write error.
+type socketTransport struct {
+	network string // unix, tcp
+	addr    string
+
+	mtx     sync.Mutex // protect conn and pending, serialize writes
+	conn    net.Conn
+	pending map[int32]chan socketResponse // request id to waiting caller
+}
+
+type socketResponse struct {
+	data []byte
+	err  error
+}
+
+func newSocketTransport(network, addr string) *socketTransport {
+	return &socketTransport{
+		network: network,
+		addr:    addr,
+	}
+}
+
+func (t *socketTransport) roundTrip(ctx context.Context, id int32, request []byte) ([]byte, error) {
+	ch := make(chan socketResponse, 1)
+
+	err := func() error {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+
+		if t.conn == nil {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, t.network, t.addr)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("%w: %s", ErrUnavailable, err)
+			}
+			t.conn = conn
+			t.pending = make(map[int32]chan socketResponse)
+			go t.readLoop(conn)
+		}
+
+		if _, exists := t.pending[id]; exists {
+			return fmt.Errorf("duplicated request id: %d", id)
+		}
+		t.pending[id] = ch
+
+		deadline, _ := ctx.Deadline() // zero time means no deadline
+		err := t.conn.SetWriteDeadline(deadline)
+		if err == nil {
+			_, err = t.conn.Write(request)
+		}
+		if err != nil {
+			t.closeLocked(t.conn, err)
+			return fmt.Errorf("%w: %s", ErrUnavailable, err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-ch:
+		return response.data, response.err
+	case <-ctx.Done():
+		t.mtx.Lock()
+		delete(t.pending, id)
+		t.mtx.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// decode json stream and dispatch responses until connection fails
+func (t *socketTransport) readLoop(conn net.Conn) {
+	decoder := json.NewDecoder(conn)
+	for {
+		var data json.RawMessage
+		err := decoder.Decode(&data)
+		if err != nil {
+			t.mtx.Lock()
+			t.closeLocked(conn, err)
+			t.mtx.Unlock()
+			return
+		}
+
+		var header struct {
+			ID int32 `json:"id"`
+		}
+		err = json.Unmarshal(data, &header)
+		if err != nil {
+			klog.Errorf("invalid json response from %s: %s", t.addr, err)
+			continue
+		}
+
+		t.mtx.Lock()
+		ch, exists := t.pending[header.ID]
+		delete(t.pending, header.ID)
+		t.mtx.Unlock()
+
+		if exists {
+			ch <- socketResponse{data: data} // buffered, never blocks
+		} else {
+			// caller may have given up waiting
+			klog.Warningf("dropped json response from %s, id: %d", t.addr, header.ID)
+		}
+	}
+}
+
+// close connection and fail all pending requests, must hold t.mtx
+func (t *socketTransport) closeLocked(conn net.Conn, err error) {
+	if t.conn != conn {
+		return // already closed and maybe replaced by new connection
+	}
+	conn.Close()
+	t.conn = nil
+
+	for id, ch := range t.pending {
+		ch <- socketResponse{err: fmt.Errorf("%w: connection to %s closed: %s", ErrUnavailable, t.addr, err)}
+		delete(t.pending, id)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echo server replies "params" of a batch of requests in reverse order
+// batch applies to first connection, later connections reply immediately
+func serveReversed(listener net.Listener, batch int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn, batch int) {
+			defer conn.Close()
+			decoder := json.NewDecoder(conn)
+			encoder := json.NewEncoder(conn)
+			for {
+				var requests []map[string]interface{}
+				for i := 0; i < batch; i++ {
+					var request map[string]interface{}
+					if decoder.Decode(&request) != nil {
+						return
+					}
+					requests = append(requests, request)
+				}
+				for i := len(requests) - 1; i >= 0; i-- {
+					response := map[string]interface{}{
+						"jsonrpc": "2.0",
+						"id":      requests[i]["id"],
+						"result":  requests[i]["params"],
+					}
+					if encoder.Encode(response) != nil {
+						return
+					}
+				}
+			}
+		}(conn, batch)
+		batch = 1
+	}
+}
+
+func listenTempSocket(t *testing.T) (listener net.Listener, socket string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "spdkcsi-rpc*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket = filepath.Join(dir, "spdk.sock")
+	listener, err = net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return listener, socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSocketTransportConcurrency(t *testing.T) {
+	listener, socket, cleanup := listenTempSocket(t)
+	defer cleanup()
+
+	const batch = 8
+	go serveReversed(listener, batch)
+
+	client, err := NewClient("unix://"+socket, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// responses come back in reverse order, each caller must get its own
+	var wg sync.WaitGroup
+	errs := make(chan error, batch)
+	for i := 0; i < batch; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			params := struct {
+				Value int `json:"value"`
+			}{i}
+			var result struct {
+				Value int `json:"value"`
+			}
+			err := client.Call(context.Background(), "echo", &params, &result)
+			if err == nil && result.Value != i {
+				err = fmt.Errorf("response mismatch: %d != %d", result.Value, i)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// broken connection fails pending request, next request reconnects
+	transport, ok := client.transport.(*socketTransport)
+	if !ok {
+		t.Fatal("not socket transport")
+	}
+	transport.mtx.Lock()
+	transport.conn.Close()
+	transport.mtx.Unlock()
+	const retries = 3
+	for i := 0; i < retries; i++ {
+		err = client.Call(context.Background(), "echo", nil, nil)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to reconnect: %s", err)
+	}
+}
+
+func TestSocketTransportCancel(t *testing.T) {
+	listener, socket, cleanup := listenTempSocket(t)
+	defer cleanup()
+
+	// server waits for two requests, the only one sent never gets response
+	go serveReversed(listener, 2)
+
+	client, err := NewClient("unix://"+socket, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = client.Call(ctx, "echo", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got: %v", err)
+	}
+
+	transport, ok := client.transport.(*socketTransport)
+	if !ok {
+		t.Fatal("not socket transport")
+	}
+	transport.mtx.Lock()
+	defer transport.mtx.Unlock()
+	if len(transport.pending) != 0 {
+		t.Fatalf("cancelled request still pending: %v", transport.pending)
+	}
+}
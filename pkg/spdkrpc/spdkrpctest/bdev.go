@@ -0,0 +1,254 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"sort"
+	"syscall"
+
+	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// crypto bdev stacked on a base bdev, with inline key or accel key
+type cryptoBdev struct {
+	uuid    string
+	params  spdkrpc.BdevCryptoCreateParams
+	keyName string
+}
+
+// find bdev by name, lvols are also found by uuid or alias, nil if not found
+func (s *Server) findBdev(name string) *spdkrpc.Bdev {
+	if l := s.findLvol(name); l != nil {
+		return lvolBdev(l)
+	}
+	if c, exists := s.cryptoBdevs[name]; exists {
+		base := s.findBdev(c.params.BaseBdevName)
+		if base == nil {
+			return nil
+		}
+		return &spdkrpc.Bdev{
+			Name:        name,
+			ProductName: "crypto",
+			BlockSize:   base.BlockSize,
+			NumBlocks:   base.NumBlocks,
+			UUID:        c.uuid,
+		}
+	}
+	if b := s.findRaidBdev(name); b != nil {
+		return b
+	}
+	return s.findNvmeBdev(name)
+}
+
+// bdev referred by name or alias
+func refers(b *spdkrpc.Bdev, name string) bool {
+	if b.Name == name {
+		return true
+	}
+	for _, alias := range b.Aliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bdev exported by nvmf namespace, iscsi lun, vhost controller or nbd disk,
+// or stacked by another bdev, cannot be deleted
+func (s *Server) claimed(b *spdkrpc.Bdev) bool {
+	for _, ss := range s.subsystems {
+		for _, ns := range ss.namespaces {
+			if refers(b, ns.BdevName) {
+				return true
+			}
+		}
+	}
+	for _, node := range s.targetNodes {
+		for _, lun := range node.Luns {
+			if refers(b, lun.BdevName) {
+				return true
+			}
+		}
+	}
+	for _, ctrlr := range s.vhostCtrlrs {
+		if refers(b, ctrlr.BackendSpecific.Block.Bdev) {
+			return true
+		}
+	}
+	for _, bdev := range s.nbdDisks {
+		if refers(b, bdev) {
+			return true
+		}
+	}
+	for _, c := range s.cryptoBdevs {
+		if refers(b, c.params.BaseBdevName) {
+			return true
+		}
+	}
+	for _, r := range s.raidBdevs {
+		for _, base := range r.bases {
+			if refers(b, base) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) bdevGetBdevs(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.BdevGetBdevsParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Name != "" {
+		b := s.findBdev(p.Name)
+		if b == nil {
+			return nil, errnoError(syscall.ENODEV)
+		}
+		return []spdkrpc.Bdev{*b}, nil
+	}
+	var names []string
+	for name := range s.lvols {
+		names = append(names, name)
+	}
+	for name := range s.cryptoBdevs {
+		names = append(names, name)
+	}
+	for name := range s.raidBdevs {
+		names = append(names, name)
+	}
+	for _, c := range s.nvmeCtrlrs {
+		names = append(names, c.bdevName())
+	}
+	sort.Strings(names)
+	bdevs := []spdkrpc.Bdev{}
+	for _, name := range names {
+		if b := s.findBdev(name); b != nil {
+			bdevs = append(bdevs, *b)
+		}
+	}
+	return bdevs, nil
+}
+
+// CryptoKey returns key of crypto bdev, inline or registered to accel
+// framework, key name is not set, empty if crypto bdev not found
+func (s *Server) CryptoKey(name string) spdkrpc.AccelCryptoKeyCreateParams {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, exists := s.cryptoBdevs[name]
+	if !exists {
+		return spdkrpc.AccelCryptoKeyCreateParams{}
+	}
+	if c.keyName != "" {
+		key := s.accelKeys[c.keyName]
+		key.Name = ""
+		return key
+	}
+	return spdkrpc.AccelCryptoKeyCreateParams{
+		Cipher: c.params.Cipher,
+		Key:    c.params.Key,
+		Key2:   c.params.Key2,
+	}
+}
+
+func (s *Server) bdevCryptoCreate(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.BdevCryptoCreateParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Name == "" || (p.KeyName == "" && p.Key == "") {
+		return nil, errInvalidParams
+	}
+	if s.findBdev(p.Name) != nil {
+		return nil, errnoError(syscall.EEXIST)
+	}
+	if p.KeyName != "" {
+		if _, exists := s.accelKeys[p.KeyName]; !exists {
+			return nil, errnoError(syscall.ENOENT)
+		}
+	}
+	base := s.findBdev(p.BaseBdevName)
+	if base == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if s.claimed(base) {
+		return nil, errnoError(syscall.EBUSY)
+	}
+	s.cryptoBdevs[p.Name] = &cryptoBdev{uuid: uuid.New().String(), params: p, keyName: p.KeyName}
+	return p.Name, nil
+}
+
+func (s *Server) bdevCryptoDelete(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.cryptoBdevs[p.Name]; !exists {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if s.claimed(s.findBdev(p.Name)) {
+		return nil, errnoError(syscall.EBUSY)
+	}
+	delete(s.cryptoBdevs, p.Name)
+	return true, nil
+}
+
+func (s *Server) accelCryptoKeyCreate(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.AccelCryptoKeyCreateParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Name == "" || p.Cipher == "" || p.Key == "" {
+		return nil, errInvalidParams
+	}
+	if _, exists := s.accelKeys[p.Name]; exists {
+		return nil, errnoError(syscall.EEXIST)
+	}
+	s.accelKeys[p.Name] = p
+	return true, nil
+}
+
+func (s *Server) accelCryptoKeyDestroy(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		KeyName string `json:"key_name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.accelKeys[p.KeyName]; !exists {
+		return nil, errnoError(syscall.ENOENT)
+	}
+	for _, c := range s.cryptoBdevs {
+		if c.keyName == p.KeyName {
+			return nil, errnoError(syscall.EBUSY)
+		}
+	}
+	delete(s.accelKeys, p.KeyName)
+	return true, nil
+}
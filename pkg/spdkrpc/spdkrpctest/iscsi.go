@@ -0,0 +1,140 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+const iqnPrefix = "iqn.2016-06.io.spdk:"
+
+type portalGroup = spdkrpc.IscsiPortalGroup
+type initiatorGroup = spdkrpc.IscsiInitiatorGroup
+type targetNode = spdkrpc.IscsiTargetNode
+
+func (s *Server) iscsiCreatePortalGroup(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.IscsiPortalGroup
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.portalGroups[p.Tag]; exists || p.Tag <= 0 || len(p.Portals) == 0 {
+		return nil, errInvalidParams
+	}
+	s.portalGroups[p.Tag] = &p
+	return true, nil
+}
+
+func (s *Server) iscsiGetPortalGroups(json.RawMessage) (interface{}, error) {
+	tags := make([]int, 0, len(s.portalGroups))
+	for tag := range s.portalGroups {
+		tags = append(tags, tag)
+	}
+	sort.Ints(tags)
+	result := []spdkrpc.IscsiPortalGroup{}
+	for _, tag := range tags {
+		result = append(result, *s.portalGroups[tag])
+	}
+	return result, nil
+}
+
+func (s *Server) iscsiCreateInitiatorGroup(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.IscsiInitiatorGroup
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.initGroups[p.Tag]; exists || p.Tag <= 0 || len(p.Initiators) == 0 {
+		return nil, errInvalidParams
+	}
+	s.initGroups[p.Tag] = &p
+	return true, nil
+}
+
+func (s *Server) iscsiGetInitiatorGroups(json.RawMessage) (interface{}, error) {
+	tags := make([]int, 0, len(s.initGroups))
+	for tag := range s.initGroups {
+		tags = append(tags, tag)
+	}
+	sort.Ints(tags)
+	result := []spdkrpc.IscsiInitiatorGroup{}
+	for _, tag := range tags {
+		result = append(result, *s.initGroups[tag])
+	}
+	return result, nil
+}
+
+func (s *Server) iscsiCreateTargetNode(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.IscsiCreateTargetNodeParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	name := iqnPrefix + p.Name
+	if _, exists := s.targetNodes[name]; exists || p.Name == "" || len(p.Luns) == 0 {
+		return nil, errInvalidParams
+	}
+	for _, m := range p.PgIgMaps {
+		if s.portalGroups[m.PgTag] == nil || s.initGroups[m.IgTag] == nil {
+			return nil, errInvalidParams
+		}
+	}
+	for _, lun := range p.Luns {
+		if s.findBdev(lun.BdevName) == nil {
+			return nil, errInvalidParams
+		}
+	}
+	s.targetNodes[name] = &targetNode{
+		Name:       name,
+		AliasName:  p.AliasName,
+		Luns:       p.Luns,
+		PgIgMaps:   p.PgIgMaps,
+		QueueDepth: p.QueueDepth,
+	}
+	return true, nil
+}
+
+func (s *Server) iscsiDeleteTargetNode(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.targetNodes[p.Name]; !exists {
+		return nil, errInvalidParams
+	}
+	delete(s.targetNodes, p.Name)
+	return true, nil
+}
+
+func (s *Server) iscsiGetTargetNodes(json.RawMessage) (interface{}, error) {
+	names := make([]string, 0, len(s.targetNodes))
+	for name := range s.targetNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []spdkrpc.IscsiTargetNode{}
+	for _, name := range names {
+		result = append(result, *s.targetNodes[name])
+	}
+	return result, nil
+}
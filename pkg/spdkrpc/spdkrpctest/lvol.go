@@ -0,0 +1,347 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+const blockSize = 512
+
+type lvstore struct {
+	uuid          string
+	name          string
+	baseBdev      string
+	clusterSize   int64
+	totalClusters int64
+}
+
+// lvol or snapshot, clones refer to parent snapshot
+type lvol struct {
+	uuid      string
+	name      string
+	lvs       *lvstore
+	size      int64 // bytes, multiple of cluster size
+	allocated int64 // clusters owned by this lvol
+	thin      bool
+	snapshot  bool // read only
+	parent    *lvol
+}
+
+func (l *lvol) alias() string {
+	return l.lvs.name + "/" + l.name
+}
+
+func (s *Server) freeClusters(lvs *lvstore) int64 {
+	free := lvs.totalClusters
+	for _, l := range s.lvols {
+		if l.lvs == lvs {
+			free -= l.allocated
+		}
+	}
+	return free
+}
+
+func (s *Server) findLvstore(name string) *lvstore {
+	for _, lvs := range s.lvstores {
+		if lvs.name == name || lvs.uuid == name {
+			return lvs
+		}
+	}
+	return nil
+}
+
+// find lvol by uuid or alias
+func (s *Server) findLvol(name string) *lvol {
+	if l, exists := s.lvols[name]; exists {
+		return l
+	}
+	for _, l := range s.lvols {
+		if l.alias() == name {
+			return l
+		}
+	}
+	return nil
+}
+
+func (s *Server) nameExists(lvs *lvstore, name string) bool {
+	for _, l := range s.lvols {
+		if l.lvs == lvs && l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) clones(snapshot *lvol) []*lvol {
+	var clones []*lvol
+	for _, l := range s.lvols {
+		if l.parent == snapshot {
+			clones = append(clones, l)
+		}
+	}
+	return clones
+}
+
+func lvolBdev(l *lvol) *spdkrpc.Bdev {
+	return &spdkrpc.Bdev{
+		Name:        l.uuid,
+		Aliases:     []string{l.alias()},
+		ProductName: "Logical Volume",
+		BlockSize:   blockSize,
+		NumBlocks:   l.size / blockSize,
+		UUID:        l.uuid,
+	}
+}
+
+func clustersOf(lvs *lvstore, size int64) int64 {
+	return (size + lvs.clusterSize - 1) / lvs.clusterSize
+}
+
+func (s *Server) bdevLvolGetLvstores(json.RawMessage) (interface{}, error) {
+	result := []spdkrpc.LvStore{}
+	for _, lvs := range s.lvstores {
+		result = append(result, spdkrpc.LvStore{
+			UUID:          lvs.uuid,
+			Name:          lvs.name,
+			BaseBdev:      lvs.baseBdev,
+			FreeClusters:  s.freeClusters(lvs),
+			ClusterSize:   lvs.clusterSize,
+			TotalClusters: lvs.totalClusters,
+			BlockSize:     blockSize,
+		})
+	}
+	return result, nil
+}
+
+func (s *Server) bdevLvolCreate(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.BdevLvolCreateParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	lvs := s.findLvstore(p.LvsName)
+	if lvs == nil {
+		lvs = s.findLvstore(p.UUID)
+	}
+	if lvs == nil || p.LvolName == "" || p.Size <= 0 {
+		return nil, errInvalidParams
+	}
+	if s.nameExists(lvs, p.LvolName) {
+		return nil, errnoError(syscall.EEXIST)
+	}
+
+	clusters := clustersOf(lvs, p.Size)
+	l := &lvol{
+		uuid: uuid.New().String(),
+		name: p.LvolName,
+		lvs:  lvs,
+		size: clusters * lvs.clusterSize,
+		thin: p.ThinProvision,
+	}
+	if !l.thin {
+		if clusters > s.freeClusters(lvs) {
+			return nil, errnoError(syscall.ENOSPC)
+		}
+		l.allocated = clusters
+	}
+	s.lvols[l.uuid] = l
+	return l.uuid, nil
+}
+
+func (s *Server) bdevLvolDelete(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	l := s.findLvol(p.Name)
+	if l == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if s.claimed(lvolBdev(l)) {
+		return nil, errnoError(syscall.EBUSY)
+	}
+
+	// snapshot with one clone can be deleted, the clone takes over its data
+	if l.snapshot {
+		clones := s.clones(l)
+		if len(clones) > 1 {
+			return nil, errnoError(syscall.EPERM)
+		}
+		if len(clones) == 1 {
+			clones[0].allocated += l.allocated
+			clones[0].parent = l.parent
+		}
+	}
+	delete(s.lvols, l.uuid)
+	return true, nil
+}
+
+func (s *Server) bdevLvolResize(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	l := s.findLvol(p.Name)
+	if l == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if l.snapshot || p.Size <= 0 {
+		return nil, errInvalidParams
+	}
+
+	clusters := clustersOf(l.lvs, p.Size)
+	if !l.thin && l.parent == nil {
+		if clusters-l.allocated > s.freeClusters(l.lvs) {
+			return nil, errnoError(syscall.ENOSPC)
+		}
+		l.allocated = clusters
+	}
+	l.size = clusters * l.lvs.clusterSize
+	return true, nil
+}
+
+func (s *Server) bdevLvolSnapshot(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		LvolName     string `json:"lvol_name"`
+		SnapshotName string `json:"snapshot_name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	l := s.findLvol(p.LvolName)
+	if l == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if l.snapshot || p.SnapshotName == "" {
+		return nil, errInvalidParams
+	}
+	if s.nameExists(l.lvs, p.SnapshotName) {
+		return nil, errnoError(syscall.EEXIST)
+	}
+
+	// snapshot takes over data of the lvol, which becomes its clone
+	snapshot := &lvol{
+		uuid:      uuid.New().String(),
+		name:      p.SnapshotName,
+		lvs:       l.lvs,
+		size:      l.size,
+		allocated: l.allocated,
+		thin:      l.thin,
+		snapshot:  true,
+		parent:    l.parent,
+	}
+	l.allocated = 0
+	l.parent = snapshot
+	s.lvols[snapshot.uuid] = snapshot
+	return snapshot.uuid, nil
+}
+
+func (s *Server) bdevLvolClone(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		SnapshotName string `json:"snapshot_name"`
+		CloneName    string `json:"clone_name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := s.findLvol(p.SnapshotName)
+	if snapshot == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if !snapshot.snapshot || p.CloneName == "" {
+		return nil, errInvalidParams
+	}
+	if s.nameExists(snapshot.lvs, p.CloneName) {
+		return nil, errnoError(syscall.EEXIST)
+	}
+
+	clone := &lvol{
+		uuid:   uuid.New().String(),
+		name:   p.CloneName,
+		lvs:    snapshot.lvs,
+		size:   snapshot.size,
+		thin:   true,
+		parent: snapshot,
+	}
+	s.lvols[clone.uuid] = clone
+	return clone.uuid, nil
+}
+
+func (s *Server) bdevLvolInflate(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	l := s.findLvol(p.Name)
+	if l == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if l.snapshot {
+		return nil, errInvalidParams
+	}
+
+	clusters := clustersOf(l.lvs, l.size)
+	if clusters-l.allocated > s.freeClusters(l.lvs) {
+		return nil, errnoError(syscall.ENOSPC)
+	}
+	l.allocated = clusters
+	l.thin = false
+	l.parent = nil
+	return true, nil
+}
+
+func (s *Server) bdevLvolRename(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		OldName string `json:"old_name"`
+		NewName string `json:"new_name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	l := s.findLvol(p.OldName)
+	if l == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if p.NewName == "" || strings.Contains(p.NewName, "/") {
+		return nil, errInvalidParams
+	}
+	if s.nameExists(l.lvs, p.NewName) {
+		return nil, errnoError(syscall.EEXIST)
+	}
+	l.name = p.NewName
+	return true, nil
+}
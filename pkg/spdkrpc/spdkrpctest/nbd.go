@@ -0,0 +1,97 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// nbd devices are only recorded, nothing is created on host
+func (s *Server) nbdStartDisk(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		BdevName  string `json:"bdev_name"`
+		NbdDevice string `json:"nbd_device"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if s.findBdev(p.BdevName) == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if p.NbdDevice == "" {
+		// pick first free device like spdk
+		for i := 0; ; i++ {
+			device := fmt.Sprintf("/dev/nbd%d", i)
+			if _, exists := s.nbdDisks[device]; !exists {
+				p.NbdDevice = device
+				break
+			}
+		}
+	} else if _, exists := s.nbdDisks[p.NbdDevice]; exists {
+		return nil, errnoError(syscall.EBUSY)
+	}
+	s.nbdDisks[p.NbdDevice] = p.BdevName
+	return p.NbdDevice, nil
+}
+
+func (s *Server) nbdStopDisk(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		NbdDevice string `json:"nbd_device"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.nbdDisks[p.NbdDevice]; !exists {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	delete(s.nbdDisks, p.NbdDevice)
+	return true, nil
+}
+
+func (s *Server) nbdGetDisks(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		NbdDevice string `json:"nbd_device"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	result := []spdkrpc.NbdDisk{}
+	if p.NbdDevice != "" {
+		bdev, exists := s.nbdDisks[p.NbdDevice]
+		if !exists {
+			return nil, errnoError(syscall.ENODEV)
+		}
+		return append(result, spdkrpc.NbdDisk{BdevName: bdev, NbdDevice: p.NbdDevice}), nil
+	}
+	devices := make([]string, 0, len(s.nbdDisks))
+	for device := range s.nbdDisks {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		result = append(result, spdkrpc.NbdDisk{BdevName: s.nbdDisks[device], NbdDevice: device})
+	}
+	return result, nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// subsystems exported by all fake targets in the process, so a target can
+// attach namespaces of another one like bdev_nvme over real fabrics
+var fabric = struct {
+	mtx     sync.Mutex // never held when taking lock of a server
+	exports map[string]*export
+}{
+	exports: make(map[string]*export),
+}
+
+// subsystem reachable through fabrics, with its first namespace
+type export struct {
+	owner     *Server
+	uuid      string
+	numBlocks int64
+	listeners []spdkrpc.NvmfListenAddress
+}
+
+// nvme controller attached to a remote subsystem, namespace 1 is the bdev
+// <name>n1, it disappears when the subsystem is not reachable
+type nvmeCtrlr struct {
+	params spdkrpc.BdevNvmeAttachControllerParams
+}
+
+func (c *nvmeCtrlr) bdevName() string {
+	return c.params.Name + "n1"
+}
+
+// refresh export of a subsystem after it's changed, s.mtx is held
+func (s *Server) updateExport(nqn string) {
+	var e *export
+	ss, exists := s.subsystems[nqn]
+	if exists && !s.fabricDown && len(ss.namespaces) > 0 && len(ss.listeners) > 0 {
+		if b := s.findBdev(ss.namespaces[0].BdevName); b != nil {
+			e = &export{
+				owner:     s,
+				uuid:      ss.namespaces[0].UUID,
+				numBlocks: b.NumBlocks,
+				listeners: append([]spdkrpc.NvmfListenAddress{}, ss.listeners...),
+			}
+		}
+	}
+
+	fabric.mtx.Lock()
+	defer fabric.mtx.Unlock()
+	if e != nil {
+		fabric.exports[nqn] = e
+	} else if old, exists := fabric.exports[nqn]; exists && old.owner == s {
+		delete(fabric.exports, nqn)
+	}
+}
+
+// remove all exports of the server, e.g., on close
+func (s *Server) removeExports() {
+	fabric.mtx.Lock()
+	defer fabric.mtx.Unlock()
+	for nqn, e := range fabric.exports {
+		if e.owner == s {
+			delete(fabric.exports, nqn)
+		}
+	}
+}
+
+// exported subsystem reachable at the address, nil if not found
+func lookupExport(params *spdkrpc.BdevNvmeAttachControllerParams) *export {
+	fabric.mtx.Lock()
+	defer fabric.mtx.Unlock()
+	e, exists := fabric.exports[params.SubNqn]
+	if !exists {
+		return nil
+	}
+	for _, l := range e.listeners {
+		if strings.EqualFold(l.TrType, params.TrType) && l.TrAddr == params.TrAddr && l.TrSvcID == params.TrSvcID {
+			return e
+		}
+	}
+	return nil
+}
+
+// SetFabricDown simulates network failure between the target and initiators
+// attached to its subsystems, bdevs of attached controllers disappear
+func (s *Server) SetFabricDown(down bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.fabricDown = down
+	for nqn := range s.subsystems {
+		s.updateExport(nqn)
+	}
+}
+
+// bdev of attached nvme controller, nil if not found or not reachable
+func (s *Server) findNvmeBdev(name string) *spdkrpc.Bdev {
+	for _, c := range s.nvmeCtrlrs {
+		if c.bdevName() != name {
+			continue
+		}
+		e := lookupExport(&c.params)
+		if e == nil {
+			return nil
+		}
+		return &spdkrpc.Bdev{
+			Name:        name,
+			ProductName: "NVMe disk",
+			BlockSize:   blockSize,
+			NumBlocks:   e.numBlocks,
+			UUID:        e.uuid,
+		}
+	}
+	return nil
+}
+
+func (s *Server) bdevNvmeAttachController(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.BdevNvmeAttachControllerParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Name == "" || p.SubNqn == "" {
+		return nil, errInvalidParams
+	}
+	if _, exists := s.nvmeCtrlrs[p.Name]; exists {
+		return nil, errnoError(syscall.EEXIST)
+	}
+	if lookupExport(&p) == nil {
+		return nil, errnoError(syscall.ENXIO)
+	}
+	c := &nvmeCtrlr{params: p}
+	s.nvmeCtrlrs[p.Name] = c
+	return []string{c.bdevName()}, nil
+}
+
+func (s *Server) bdevNvmeDetachController(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.nvmeCtrlrs[p.Name]; !exists {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	delete(s.nvmeCtrlrs, p.Name)
+	return true, nil
+}
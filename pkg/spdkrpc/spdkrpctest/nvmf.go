@@ -0,0 +1,236 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+const discoveryNqn = "nqn.2014-08.org.nvmexpress.discovery"
+
+type subsystem struct {
+	params     spdkrpc.NvmfCreateSubsystemParams
+	namespaces []spdkrpc.NvmfNamespace
+	listeners  []spdkrpc.NvmfListenAddress
+}
+
+func invalidParams(format string, args ...interface{}) error {
+	return &rpcError{Code: errInvalidParams.Code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) nvmfCreateTransport(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.NvmfCreateTransportParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	trType := strings.ToUpper(p.TrType)
+	if trType != "TCP" && trType != "RDMA" {
+		return nil, invalidParams("Transport type '%s' unavailable", p.TrType)
+	}
+	for _, t := range s.transports {
+		if t == trType {
+			return nil, invalidParams("Transport type '%s' already exists", p.TrType)
+		}
+	}
+	s.transports = append(s.transports, trType)
+	return true, nil
+}
+
+func (s *Server) nvmfGetTransports(json.RawMessage) (interface{}, error) {
+	result := []spdkrpc.NvmfTransport{}
+	for _, t := range s.transports {
+		result = append(result, spdkrpc.NvmfTransport{TrType: t, MaxQueueDepth: 128})
+	}
+	return result, nil
+}
+
+func (s *Server) nvmfCreateSubsystem(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.NvmfCreateSubsystemParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(p.Nqn, "nqn.") {
+		return nil, invalidParams("Invalid NQN %s", p.Nqn)
+	}
+	if _, exists := s.subsystems[p.Nqn]; exists || p.Nqn == discoveryNqn {
+		return nil, invalidParams("Unable to create subsystem %s", p.Nqn)
+	}
+	if len(p.SerialNumber) > 20 || len(p.ModelNumber) > 40 {
+		return nil, invalidParams("Invalid SN %s or MN %s", p.SerialNumber, p.ModelNumber)
+	}
+	s.subsystems[p.Nqn] = &subsystem{params: p}
+	return true, nil
+}
+
+func (s *Server) nvmfDeleteSubsystem(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Nqn string `json:"nqn"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.subsystems[p.Nqn]; !exists {
+		return nil, invalidParams("Unable to find subsystem with NQN %s", p.Nqn)
+	}
+	delete(s.subsystems, p.Nqn)
+	s.updateExport(p.Nqn)
+	return true, nil
+}
+
+func (s *Server) nvmfSubsystemAddNs(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Nqn       string                `json:"nqn"`
+		Namespace spdkrpc.NvmfNamespace `json:"namespace"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	ss, exists := s.subsystems[p.Nqn]
+	if !exists {
+		return nil, invalidParams("Unable to find subsystem with NQN %s", p.Nqn)
+	}
+	b := s.findBdev(p.Namespace.BdevName)
+	if b == nil {
+		return nil, invalidParams("Unable to add ns, bdev %s not found", p.Namespace.BdevName)
+	}
+
+	ns := p.Namespace
+	if ns.NGUID != "" {
+		if b, err := hex.DecodeString(ns.NGUID); err != nil || len(b) != 16 {
+			return nil, invalidParams("Invalid NGUID %s", ns.NGUID)
+		}
+	}
+	if ns.UUID != "" {
+		if _, err := uuid.Parse(ns.UUID); err != nil {
+			return nil, invalidParams("Invalid UUID %s", ns.UUID)
+		}
+	}
+	maxNsID := 0
+	for _, existing := range ss.namespaces {
+		if existing.NsID == ns.NsID {
+			return nil, invalidParams("Unable to add ns, nsid %d in use", ns.NsID)
+		}
+		if ns.UUID != "" && strings.EqualFold(existing.UUID, ns.UUID) {
+			return nil, invalidParams("Unable to add ns, uuid %s in use", ns.UUID)
+		}
+		if existing.NsID > maxNsID {
+			maxNsID = existing.NsID
+		}
+	}
+	if ns.NsID == 0 {
+		ns.NsID = maxNsID + 1
+	}
+	if ns.UUID == "" {
+		ns.UUID = b.UUID
+	}
+	ss.namespaces = append(ss.namespaces, ns)
+	s.updateExport(p.Nqn)
+	return ns.NsID, nil
+}
+
+func (s *Server) nvmfSubsystemRemoveNs(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Nqn  string `json:"nqn"`
+		NsID int    `json:"nsid"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	ss, exists := s.subsystems[p.Nqn]
+	if !exists {
+		return nil, invalidParams("Unable to find subsystem with NQN %s", p.Nqn)
+	}
+	for i := range ss.namespaces {
+		if ss.namespaces[i].NsID == p.NsID {
+			ss.namespaces = append(ss.namespaces[:i], ss.namespaces[i+1:]...)
+			s.updateExport(p.Nqn)
+			return true, nil
+		}
+	}
+	return nil, errInvalidParams
+}
+
+func (s *Server) nvmfSubsystemAddListener(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Nqn           string                    `json:"nqn"`
+		ListenAddress spdkrpc.NvmfListenAddress `json:"listen_address"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	ss, exists := s.subsystems[p.Nqn]
+	if !exists {
+		return nil, invalidParams("Unable to find subsystem with NQN %s", p.Nqn)
+	}
+	created := false
+	for _, t := range s.transports {
+		created = created || strings.EqualFold(t, p.ListenAddress.TrType)
+	}
+	if !created {
+		return nil, invalidParams("Unable to find transport %s", p.ListenAddress.TrType)
+	}
+	for _, listener := range ss.listeners {
+		if listener == p.ListenAddress {
+			return nil, invalidParams("Listener already exists")
+		}
+	}
+	ss.listeners = append(ss.listeners, p.ListenAddress)
+	s.updateExport(p.Nqn)
+	return true, nil
+}
+
+func (s *Server) nvmfGetSubsystems(json.RawMessage) (interface{}, error) {
+	result := []spdkrpc.NvmfSubsystem{{
+		Nqn:             discoveryNqn,
+		Subtype:         "Discovery",
+		ListenAddresses: []spdkrpc.NvmfListenAddress{},
+		AllowAnyHost:    true,
+	}}
+
+	nqns := make([]string, 0, len(s.subsystems))
+	for nqn := range s.subsystems {
+		nqns = append(nqns, nqn)
+	}
+	sort.Strings(nqns)
+	for _, nqn := range nqns {
+		ss := s.subsystems[nqn]
+		result = append(result, spdkrpc.NvmfSubsystem{
+			Nqn:             nqn,
+			Subtype:         "NVMe",
+			ListenAddresses: append([]spdkrpc.NvmfListenAddress{}, ss.listeners...),
+			AllowAnyHost:    ss.params.AllowAnyHost,
+			SerialNumber:    ss.params.SerialNumber,
+			ModelNumber:     ss.params.ModelNumber,
+			Namespaces:      append([]spdkrpc.NvmfNamespace{}, ss.namespaces...),
+		})
+	}
+	return result, nil
+}
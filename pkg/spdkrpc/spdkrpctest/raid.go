@@ -0,0 +1,193 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"sort"
+	"syscall"
+
+	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// raid1 bdev, base bdev slot is emptied when the base bdev disappears, and
+// refilled by bdev_raid_add_base_bdev, rebuild completes immediately
+type raidBdev struct {
+	uuid      string
+	name      string
+	bases     []string // empty if removed
+	numBlocks int64
+}
+
+func (r *raidBdev) discovered() int {
+	n := 0
+	for _, base := range r.bases {
+		if base != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *raidBdev) state() string {
+	if r.discovered() == 0 {
+		return "offline"
+	}
+	return "online"
+}
+
+// remove disappeared base bdevs from raids, s.mtx is held
+func (s *Server) syncRaids() {
+	for _, r := range s.raidBdevs {
+		for i, base := range r.bases {
+			if base != "" && s.findBdev(base) == nil {
+				r.bases[i] = ""
+			}
+		}
+	}
+}
+
+func (s *Server) findRaidBdev(name string) *spdkrpc.Bdev {
+	r, exists := s.raidBdevs[name]
+	if !exists || r.discovered() == 0 {
+		return nil
+	}
+	return &spdkrpc.Bdev{
+		Name:        name,
+		ProductName: "Raid Volume",
+		BlockSize:   blockSize,
+		NumBlocks:   r.numBlocks,
+		UUID:        r.uuid,
+	}
+}
+
+func (s *Server) bdevRaidCreate(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.BdevRaidCreateParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Name == "" || p.RaidLevel != "raid1" || len(p.BaseBdevs) < 2 {
+		return nil, errInvalidParams
+	}
+	if s.findBdev(p.Name) != nil {
+		return nil, errnoError(syscall.EEXIST)
+	}
+	r := &raidBdev{uuid: uuid.New().String(), name: p.Name}
+	for _, name := range p.BaseBdevs {
+		b := s.findBdev(name)
+		if b == nil {
+			return nil, errnoError(syscall.ENODEV)
+		}
+		if s.claimed(b) {
+			return nil, errnoError(syscall.EBUSY)
+		}
+		if r.numBlocks == 0 || b.NumBlocks < r.numBlocks {
+			r.numBlocks = b.NumBlocks
+		}
+		r.bases = append(r.bases, name)
+	}
+	s.raidBdevs[p.Name] = r
+	return true, nil
+}
+
+func (s *Server) bdevRaidDelete(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.raidBdevs[p.Name]; !exists {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if b := s.findBdev(p.Name); b != nil && s.claimed(b) {
+		return nil, errnoError(syscall.EBUSY)
+	}
+	delete(s.raidBdevs, p.Name)
+	return true, nil
+}
+
+func (s *Server) bdevRaidAddBaseBdev(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		RaidBdev string `json:"raid_bdev"`
+		BaseBdev string `json:"base_bdev"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	r, exists := s.raidBdevs[p.RaidBdev]
+	if !exists {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	b := s.findBdev(p.BaseBdev)
+	if b == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	if s.claimed(b) {
+		return nil, errnoError(syscall.EBUSY)
+	}
+	for i, base := range r.bases {
+		if base == "" {
+			r.bases[i] = p.BaseBdev
+			return true, nil
+		}
+	}
+	return nil, errInvalidParams
+}
+
+func (s *Server) bdevRaidGetBdevs(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Category string `json:"category"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Category != "all" && p.Category != "online" && p.Category != "configuring" && p.Category != "offline" {
+		return nil, errInvalidParams
+	}
+
+	names := make([]string, 0, len(s.raidBdevs))
+	for name := range s.raidBdevs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []spdkrpc.RaidBdev{}
+	for _, name := range names {
+		r := s.raidBdevs[name]
+		if p.Category != "all" && p.Category != r.state() {
+			continue
+		}
+		raid := spdkrpc.RaidBdev{
+			Name:                   r.name,
+			State:                  r.state(),
+			RaidLevel:              "raid1",
+			NumBaseBdevs:           len(r.bases),
+			NumBaseBdevsDiscovered: r.discovered(),
+		}
+		for _, base := range r.bases {
+			raid.BaseBdevs = append(raid.BaseBdevs, spdkrpc.RaidBaseBdev{Name: base, IsConfigured: base != ""})
+		}
+		result = append(result, raid)
+	}
+	return result, nil
+}
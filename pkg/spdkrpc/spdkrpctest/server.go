@@ -0,0 +1,378 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package spdkrpctest provides an in-memory fake spdk target for tests
+//
+// Server speaks SPDK JSON-RPC over http like spdk/scripts/rpc_http_proxy.py,
+// and implements the subset of rpc methods used by the driver: lvstores,
+// lvols, snapshots, clones, crypto and raid1 bdevs, NVMe-oF subsystems and
+// initiator, iSCSI target nodes, vhost controllers and nbd disks.
+// Fake targets in the same process reach each other's subsystems through
+// bdev_nvme_attach_controller, see SetFabricDown to break the link.
+// Failures can be injected per method, see Fault.
+package spdkrpctest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// EnvRPCURL names environment variable to run tests against a real spdk
+// target instead, e.g., SPDKCSI_TEST_RPC_URL=http://127.0.0.1:9009
+const EnvRPCURL = "SPDKCSI_TEST_RPC_URL"
+
+// Options of fake spdk target, zero values pick defaults
+type Options struct {
+	User     string   // basic auth, not checked if empty
+	Password string   //
+	Version  string   // reported by spdk_get_version, "SPDK v21.01" by default
+	Methods  []string // supported methods, all implemented methods by default
+
+	// lvstores to create, one 1GiB lvstore "lvs0" by default
+	LvStores []LvStoreOptions
+
+	// directory of vhost controller sockets, "/var/tmp" by default, sockets
+	// are not created
+	VhostSocketDir string
+}
+
+// LvStoreOptions of a lvstore
+type LvStoreOptions struct {
+	Name        string
+	SizeMiB     int64
+	ClusterSize int64 // 4MiB by default
+}
+
+// Fault makes matching calls fail or slow down
+type Fault struct {
+	Method     string        // rpc method to match, empty matches all
+	Count      int           // calls to affect, 0 for all until ClearFaults
+	Code       int           // json-rpc error code, e.g., -28 for ENOSPC
+	Message    string        // json-rpc error message
+	HTTPStatus int           // reply http error instead, e.g., 503
+	Delay      time.Duration // delay response, e.g., to trigger timeout
+}
+
+// Server is a fake spdk target serving jsonrpc over http
+type Server struct {
+	*httptest.Server
+
+	opts Options
+
+	mtx     sync.Mutex // protect all below
+	faults  []*Fault
+	calls   map[string]int
+	methods map[string]bool // nil to support all implemented methods
+
+	lvstores     []*lvstore
+	lvols        map[string]*lvol // by uuid
+	transports   []string
+	subsystems   map[string]*subsystem // by nqn
+	portalGroups map[int]*portalGroup
+	initGroups   map[int]*initiatorGroup
+	targetNodes  map[string]*targetNode // by full name with iqn prefix
+	vhostCtrlrs  map[string]*vhostController
+	nbdDisks     map[string]string // nbd device to bdev name
+	cryptoBdevs  map[string]*cryptoBdev
+	accelKeys    map[string]spdkrpc.AccelCryptoKeyCreateParams
+	raidBdevs    map[string]*raidBdev
+	nvmeCtrlrs   map[string]*nvmeCtrlr
+	fabricDown   bool // subsystems not reachable by other targets
+}
+
+type handler func(s *Server, params json.RawMessage) (interface{}, error)
+
+// implemented methods, initialized in init as rpc_get_methods refers to it
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"rpc_get_methods":              (*Server).rpcGetMethods,
+		"spdk_get_version":             (*Server).spdkGetVersion,
+		"bdev_get_bdevs":               (*Server).bdevGetBdevs,
+		"bdev_lvol_get_lvstores":       (*Server).bdevLvolGetLvstores,
+		"bdev_lvol_create":             (*Server).bdevLvolCreate,
+		"bdev_lvol_delete":             (*Server).bdevLvolDelete,
+		"bdev_lvol_resize":             (*Server).bdevLvolResize,
+		"bdev_lvol_snapshot":           (*Server).bdevLvolSnapshot,
+		"bdev_lvol_clone":              (*Server).bdevLvolClone,
+		"bdev_lvol_inflate":            (*Server).bdevLvolInflate,
+		"bdev_lvol_rename":             (*Server).bdevLvolRename,
+		"nvmf_create_transport":        (*Server).nvmfCreateTransport,
+		"nvmf_get_transports":          (*Server).nvmfGetTransports,
+		"nvmf_create_subsystem":        (*Server).nvmfCreateSubsystem,
+		"nvmf_delete_subsystem":        (*Server).nvmfDeleteSubsystem,
+		"nvmf_subsystem_add_ns":        (*Server).nvmfSubsystemAddNs,
+		"nvmf_subsystem_remove_ns":     (*Server).nvmfSubsystemRemoveNs,
+		"nvmf_subsystem_add_listener":  (*Server).nvmfSubsystemAddListener,
+		"nvmf_get_subsystems":          (*Server).nvmfGetSubsystems,
+		"iscsi_create_portal_group":    (*Server).iscsiCreatePortalGroup,
+		"iscsi_get_portal_groups":      (*Server).iscsiGetPortalGroups,
+		"iscsi_create_initiator_group": (*Server).iscsiCreateInitiatorGroup,
+		"iscsi_get_initiator_groups":   (*Server).iscsiGetInitiatorGroups,
+		"iscsi_create_target_node":     (*Server).iscsiCreateTargetNode,
+		"iscsi_delete_target_node":     (*Server).iscsiDeleteTargetNode,
+		"iscsi_get_target_nodes":       (*Server).iscsiGetTargetNodes,
+		"vhost_create_blk_controller":  (*Server).vhostCreateBlkController,
+		"vhost_delete_controller":      (*Server).vhostDeleteController,
+		"vhost_get_controllers":        (*Server).vhostGetControllers,
+		"nbd_start_disk":               (*Server).nbdStartDisk,
+		"nbd_stop_disk":                (*Server).nbdStopDisk,
+		"nbd_get_disks":                (*Server).nbdGetDisks,
+		"bdev_crypto_create":           (*Server).bdevCryptoCreate,
+		"bdev_crypto_delete":           (*Server).bdevCryptoDelete,
+		"accel_crypto_key_create":      (*Server).accelCryptoKeyCreate,
+		"accel_crypto_key_destroy":     (*Server).accelCryptoKeyDestroy,
+		"bdev_raid_create":             (*Server).bdevRaidCreate,
+		"bdev_raid_delete":             (*Server).bdevRaidDelete,
+		"bdev_raid_add_base_bdev":      (*Server).bdevRaidAddBaseBdev,
+		"bdev_raid_get_bdevs":          (*Server).bdevRaidGetBdevs,
+		"bdev_nvme_attach_controller":  (*Server).bdevNvmeAttachController,
+		"bdev_nvme_detach_controller":  (*Server).bdevNvmeDetachController,
+	}
+}
+
+// NewServer starts a fake spdk target, caller should Close it after use
+func NewServer(opts Options) *Server {
+	if opts.Version == "" {
+		opts.Version = "SPDK v21.01"
+	}
+	if len(opts.LvStores) == 0 {
+		opts.LvStores = []LvStoreOptions{{Name: "lvs0", SizeMiB: 1024}}
+	}
+	if opts.VhostSocketDir == "" {
+		opts.VhostSocketDir = "/var/tmp"
+	}
+
+	s := &Server{
+		opts:         opts,
+		calls:        make(map[string]int),
+		lvols:        make(map[string]*lvol),
+		subsystems:   make(map[string]*subsystem),
+		portalGroups: make(map[int]*portalGroup),
+		initGroups:   make(map[int]*initiatorGroup),
+		targetNodes:  make(map[string]*targetNode),
+		vhostCtrlrs:  make(map[string]*vhostController),
+		nbdDisks:     make(map[string]string),
+		cryptoBdevs:  make(map[string]*cryptoBdev),
+		accelKeys:    make(map[string]spdkrpc.AccelCryptoKeyCreateParams),
+		raidBdevs:    make(map[string]*raidBdev),
+		nvmeCtrlrs:   make(map[string]*nvmeCtrlr),
+	}
+	if len(opts.Methods) > 0 {
+		s.methods = make(map[string]bool)
+		for _, method := range opts.Methods {
+			s.methods[method] = true
+		}
+	}
+	for _, lvsOpts := range opts.LvStores {
+		clusterSize := lvsOpts.ClusterSize
+		if clusterSize == 0 {
+			clusterSize = 4 * 1024 * 1024
+		}
+		clusters := lvsOpts.SizeMiB * 1024 * 1024 / clusterSize
+		s.lvstores = append(s.lvstores, &lvstore{
+			uuid:          uuid.New().String(),
+			name:          lvsOpts.Name,
+			baseBdev:      "Malloc" + fmt.Sprint(len(s.lvstores)),
+			clusterSize:   clusterSize,
+			totalClusters: clusters,
+		})
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts down the server, its subsystems become unreachable
+func (s *Server) Close() {
+	s.removeExports()
+	s.Server.Close()
+}
+
+// Inject adds a fault, faults are matched in order of injection
+func (s *Server) Inject(fault Fault) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes all injected faults
+func (s *Server) ClearFaults() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = nil
+}
+
+// Calls returns how many times method is called, including failed calls
+func (s *Server) Calls(method string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.calls[method]
+}
+
+// take a matching fault, nil if none
+func (s *Server) takeFault(method string) *Fault {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i, fault := range s.faults {
+		if fault.Method != "" && fault.Method != method {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// error response with negative errno code and strerror message, like spdk
+func errnoError(errno syscall.Errno) error {
+	msg := errno.Error()
+	return &rpcError{Code: -int(errno), Message: strings.ToUpper(msg[:1]) + msg[1:]}
+}
+
+// json-rpc 2.0 pre-defined errors
+var (
+	errInvalidParams  = &rpcError{Code: -32602, Message: "Invalid parameters"}
+	errMethodNotFound = &rpcError{Code: -32601, Message: "Method not found"}
+)
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.User != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != s.opts.User || password != s.opts.Password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var request struct {
+		ID     int32           `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mtx.Lock()
+	s.calls[request.Method]++
+	s.mtx.Unlock()
+
+	result, err := s.handle(r.Context(), w, request.Method, request.Params)
+	if err == errHTTPStatusSent {
+		return
+	}
+
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+	if err != nil {
+		rpcErr, ok := err.(*rpcError)
+		if !ok {
+			rpcErr = &rpcError{Code: -32603, Message: err.Error()}
+		}
+		response["error"] = rpcErr
+	} else {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response) // nolint:errcheck // we can do little
+}
+
+var errHTTPStatusSent = fmt.Errorf("http status sent")
+
+func (s *Server) handle(ctx context.Context, w http.ResponseWriter, method string, params json.RawMessage) (interface{}, error) {
+	fault := s.takeFault(method)
+	if fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if fault.HTTPStatus != 0 {
+			w.WriteHeader(fault.HTTPStatus)
+			return nil, errHTTPStatusSent
+		}
+		if fault.Code != 0 {
+			return nil, &rpcError{Code: fault.Code, Message: fault.Message}
+		}
+	}
+
+	h, exists := handlers[method]
+	if !exists || (s.methods != nil && !s.methods[method]) {
+		return nil, errMethodNotFound
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.syncRaids()
+	return h(s, params)
+}
+
+// decode params, missing params are treated as empty object
+func decode(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if json.Unmarshal(params, v) != nil {
+		return errInvalidParams
+	}
+	return nil
+}
+
+func (s *Server) rpcGetMethods(json.RawMessage) (interface{}, error) {
+	var methods []string
+	for method := range handlers {
+		if s.methods == nil || s.methods[method] {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	return methods, nil
+}
+
+func (s *Server) spdkGetVersion(json.RawMessage) (interface{}, error) {
+	return map[string]string{"version": s.opts.Version}, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+func TestFaults(t *testing.T) {
+	server := NewServer(Options{User: "user", Password: "pass"})
+	defer server.Close()
+	client, err := spdkrpc.NewClient(server.URL, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// injected errno maps to sentinel error, only Count calls are affected
+	server.Inject(Fault{Method: "bdev_lvol_create", Count: 1, Code: -28, Message: "No space left on device"})
+	params := spdkrpc.BdevLvolCreateParams{LvolName: "lvol0", Size: 1 << 20, LvsName: "lvs0"}
+	_, err = client.BdevLvolCreate(ctx, &params)
+	if !errors.Is(err, spdkrpc.ErrNoSpaceLeft) {
+		t.Fatalf("expect ErrNoSpaceLeft: %v", err)
+	}
+	lvolID, err := client.BdevLvolCreate(ctx, &params)
+	if err != nil {
+		t.Fatalf("BdevLvolCreate: %s", err)
+	}
+	_, err = client.BdevLvolCreate(ctx, &params)
+	if !errors.Is(err, spdkrpc.ErrAlreadyExists) {
+		t.Fatalf("expect ErrAlreadyExists: %v", err)
+	}
+
+	// idempotent read is retried over http errors
+	server.Inject(Fault{Method: "bdev_get_bdevs", Count: 2, HTTPStatus: 503})
+	bdevs, err := client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{Name: "lvs0/lvol0"})
+	if err != nil || len(bdevs) != 1 || bdevs[0].Name != lvolID {
+		t.Fatalf("BdevGetBdevs: %v, %v", bdevs, err)
+	}
+	if calls := server.Calls("bdev_get_bdevs"); calls != 3 {
+		t.Fatalf("expect 3 calls, got %d", calls)
+	}
+
+	// delayed response hits caller deadline
+	server.Inject(Fault{Delay: time.Second})
+	ctxTimeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = client.BdevLvolDelete(ctxTimeout, lvolID)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded: %v", err)
+	}
+	server.ClearFaults()
+
+	// exported lvol cannot be deleted
+	err = client.NvmfCreateSubsystem(ctx, &spdkrpc.NvmfCreateSubsystemParams{Nqn: "nqn.2020-04.io.spdk.csi:test"})
+	if err != nil {
+		t.Fatalf("NvmfCreateSubsystem: %s", err)
+	}
+	_, err = client.NvmfSubsystemAddNs(ctx, "nqn.2020-04.io.spdk.csi:test", &spdkrpc.NvmfNamespace{BdevName: lvolID})
+	if err != nil {
+		t.Fatalf("NvmfSubsystemAddNs: %s", err)
+	}
+	err = client.BdevLvolDelete(ctx, lvolID)
+	if !errors.Is(err, spdkrpc.ErrBusy) {
+		t.Fatalf("expect busy lvol: %v", err)
+	}
+	err = client.NvmfDeleteSubsystem(ctx, "nqn.2020-04.io.spdk.csi:test")
+	if err != nil {
+		t.Fatalf("NvmfDeleteSubsystem: %s", err)
+	}
+	err = client.BdevLvolDelete(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("BdevLvolDelete: %s", err)
+	}
+	_, err = client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{Name: lvolID})
+	if !errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+		t.Fatalf("expect ErrNoSuchDevice: %v", err)
+	}
+
+	// wrong credentials
+	client, err = spdkrpc.NewClient(server.URL, "user", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.BdevLvolGetLvstores(ctx)
+	if err == nil {
+		t.Fatal("expect unauthorized")
+	}
+}
+
+func TestSnapshotClone(t *testing.T) {
+	server := NewServer(Options{LvStores: []LvStoreOptions{{Name: "lvs0", SizeMiB: 64}}})
+	defer server.Close()
+	client, err := spdkrpc.NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	freeClusters := func() int64 {
+		lvss, err := client.BdevLvolGetLvstores(ctx)
+		if err != nil || len(lvss) != 1 {
+			t.Fatalf("BdevLvolGetLvstores: %v, %v", lvss, err)
+		}
+		return lvss[0].FreeClusters
+	}
+	total := freeClusters()
+
+	// thick lvol allocates clusters, too large one fails
+	lvolID, err := client.BdevLvolCreate(ctx, &spdkrpc.BdevLvolCreateParams{LvolName: "lvol0", Size: 8 << 20, LvsName: "lvs0"})
+	if err != nil || freeClusters() != total-2 {
+		t.Fatalf("BdevLvolCreate: %v, free %d", err, freeClusters())
+	}
+	_, err = client.BdevLvolCreate(ctx, &spdkrpc.BdevLvolCreateParams{LvolName: "lvol1", Size: 64 << 20, LvsName: "lvs0"})
+	if !errors.Is(err, spdkrpc.ErrNoSpaceLeft) {
+		t.Fatalf("expect ErrNoSpaceLeft: %v", err)
+	}
+
+	// snapshot takes over clusters, clone of it is thin
+	snapshotID, err := client.BdevLvolSnapshot(ctx, lvolID, "snap0")
+	if err != nil {
+		t.Fatalf("BdevLvolSnapshot: %s", err)
+	}
+	cloneID, err := client.BdevLvolClone(ctx, snapshotID, "clone0")
+	if err != nil || freeClusters() != total-2 {
+		t.Fatalf("BdevLvolClone: %v, free %d", err, freeClusters())
+	}
+	_, err = client.BdevLvolClone(ctx, lvolID, "clone1")
+	if err == nil {
+		t.Fatal("clone of writable lvol should fail")
+	}
+
+	// snapshot with two clones cannot be deleted
+	err = client.BdevLvolDelete(ctx, snapshotID)
+	if err == nil {
+		t.Fatal("snapshot with two clones should not be deleted")
+	}
+
+	// inflated clone is independent of snapshot
+	err = client.BdevLvolInflate(ctx, cloneID)
+	if err != nil || freeClusters() != total-4 {
+		t.Fatalf("BdevLvolInflate: %v, free %d", err, freeClusters())
+	}
+	err = client.BdevLvolRename(ctx, cloneID, "renamed")
+	if err != nil {
+		t.Fatalf("BdevLvolRename: %s", err)
+	}
+	err = client.BdevLvolDelete(ctx, "lvs0/renamed")
+	if err != nil {
+		t.Fatalf("BdevLvolDelete: %s", err)
+	}
+
+	// snapshot with one clone can be deleted
+	err = client.BdevLvolDelete(ctx, snapshotID)
+	if err != nil || freeClusters() != total-2 {
+		t.Fatalf("BdevLvolDelete snapshot: %v, free %d", err, freeClusters())
+	}
+	err = client.BdevLvolDelete(ctx, lvolID)
+	if err != nil || freeClusters() != total {
+		t.Fatalf("BdevLvolDelete: %v, free %d", err, freeClusters())
+	}
+}
+
+func TestCrypto(t *testing.T) {
+	server := NewServer(Options{})
+	defer server.Close()
+	client, err := spdkrpc.NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	lvolID, err := client.BdevLvolCreate(ctx, &spdkrpc.BdevLvolCreateParams{LvolName: "lvol0", Size: 4 << 20, LvsName: "lvs0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := spdkrpc.AccelCryptoKeyCreateParams{Name: "key0", Cipher: "AES_CBC", Key: "00112233445566778899aabbccddeeff"}
+	err = client.AccelCryptoKeyCreate(ctx, &key)
+	if err != nil {
+		t.Fatalf("AccelCryptoKeyCreate: %s", err)
+	}
+	_, err = client.BdevCryptoCreate(ctx, &spdkrpc.BdevCryptoCreateParams{BaseBdevName: "lvs0/lvol0", Name: "crypto0", KeyName: "unknown"})
+	if !errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+		t.Fatalf("expect ErrNoSuchDevice: %v", err)
+	}
+	name, err := client.BdevCryptoCreate(ctx, &spdkrpc.BdevCryptoCreateParams{BaseBdevName: "lvs0/lvol0", Name: "crypto0", KeyName: "key0"})
+	if err != nil || name != "crypto0" {
+		t.Fatalf("BdevCryptoCreate: %s, %v", name, err)
+	}
+	key.Name = ""
+	if server.CryptoKey("crypto0") != key {
+		t.Fatalf("unexpected key: %+v", server.CryptoKey("crypto0"))
+	}
+	bdevs, err := client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{Name: "crypto0"})
+	if err != nil || len(bdevs) != 1 || bdevs[0].NumBlocks != 4<<20/blockSize {
+		t.Fatalf("BdevGetBdevs: %v, %v", bdevs, err)
+	}
+
+	// stacked bdevs and keys in use are torn down from top to bottom
+	err = client.BdevLvolDelete(ctx, lvolID)
+	if err == nil {
+		t.Fatal("lvol under crypto bdev should not be deleted")
+	}
+	err = client.AccelCryptoKeyDestroy(ctx, "key0")
+	if err == nil {
+		t.Fatal("key in use should not be destroyed")
+	}
+	err = client.BdevCryptoDelete(ctx, "crypto0")
+	if err != nil {
+		t.Fatalf("BdevCryptoDelete: %s", err)
+	}
+	err = client.AccelCryptoKeyDestroy(ctx, "key0")
+	if err != nil {
+		t.Fatalf("AccelCryptoKeyDestroy: %s", err)
+	}
+	err = client.BdevLvolDelete(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("BdevLvolDelete: %s", err)
+	}
+}
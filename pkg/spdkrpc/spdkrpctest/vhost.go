@@ -0,0 +1,98 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpctest
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+type vhostController = spdkrpc.VhostController
+
+func (s *Server) vhostCreateBlkController(params json.RawMessage) (interface{}, error) {
+	var p spdkrpc.VhostCreateBlkControllerParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Ctrlr == "" {
+		return nil, errInvalidParams
+	}
+	if _, exists := s.vhostCtrlrs[p.Ctrlr]; exists {
+		return nil, errnoError(syscall.EEXIST)
+	}
+	if s.findBdev(p.DevName) == nil {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	ctrlr := &vhostController{
+		Ctrlr:   p.Ctrlr,
+		Cpumask: p.Cpumask,
+		Socket:  filepath.Join(s.opts.VhostSocketDir, p.Ctrlr),
+	}
+	if ctrlr.Cpumask == "" {
+		ctrlr.Cpumask = "0x1"
+	}
+	ctrlr.BackendSpecific.Block = &spdkrpc.VhostBlkBackend{Bdev: p.DevName, Readonly: p.Readonly}
+	s.vhostCtrlrs[p.Ctrlr] = ctrlr
+	return true, nil
+}
+
+func (s *Server) vhostDeleteController(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Ctrlr string `json:"ctrlr"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.vhostCtrlrs[p.Ctrlr]; !exists {
+		return nil, errnoError(syscall.ENODEV)
+	}
+	delete(s.vhostCtrlrs, p.Ctrlr)
+	return true, nil
+}
+
+func (s *Server) vhostGetControllers(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	result := []spdkrpc.VhostController{}
+	if p.Name != "" {
+		ctrlr, exists := s.vhostCtrlrs[p.Name]
+		if !exists {
+			return nil, errnoError(syscall.ENODEV)
+		}
+		return append(result, *ctrlr), nil
+	}
+	names := make([]string, 0, len(s.vhostCtrlrs))
+	for name := range s.vhostCtrlrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, *s.vhostCtrlrs[name])
+	}
+	return result, nil
+}
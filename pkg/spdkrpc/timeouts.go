@@ -0,0 +1,82 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout applies to methods without specific timeout
+const DefaultTimeout = 20 * time.Second
+
+// Timeouts maps rpc method to its timeout, implements flag.Value in format
+// "method=duration,...", e.g., "bdev_lvol_create=5m,bdev_lvol_delete=5m"
+type Timeouts map[string]time.Duration
+
+func (t *Timeouts) String() string {
+	var items []string
+	for method, timeout := range *t {
+		items = append(items, method+"="+timeout.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value
+func (t *Timeouts) Set(value string) error {
+	if *t == nil {
+		*t = make(Timeouts)
+	}
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid rpc timeout: %s", item)
+		}
+		timeout, err := time.ParseDuration(kv[1])
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid rpc timeout: %s", item)
+		}
+		(*t)[kv[0]] = timeout
+	}
+	return nil
+}
+
+// slow methods, e.g., clearing lvol data with write_zeroes, deserve longer
+// timeout than DefaultTimeout
+var timeouts = Timeouts{
+	"bdev_lvol_create": 2 * time.Minute,
+	"bdev_lvol_delete": 2 * time.Minute,
+	"bdev_lvol_resize": 2 * time.Minute,
+}
+
+// SetTimeouts overrides default timeouts of methods, not safe to be called
+// concurrently with Client.Call
+func SetTimeouts(overrides Timeouts) {
+	for method, timeout := range overrides {
+		timeouts[method] = timeout
+	}
+}
+
+func timeout(method string) time.Duration {
+	if timeout, exists := timeouts[method]; exists {
+		return timeout
+	}
+	return DefaultTimeout
+}
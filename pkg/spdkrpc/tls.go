@@ -0,0 +1,123 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TLSConfig of https rpcURL, certificates and keys are PEM encoded
+type TLSConfig struct {
+	CACert     []byte // CA bundle to verify server, system roots if empty
+	ClientCert []byte // client certificate and key, for mutual tls
+	ClientKey  []byte
+	ServerName string // name in server certificate, host of rpcURL if empty
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+
+	if len(c.CACert) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(c.CACert) {
+			return nil, errors.New("no valid certificate in CA bundle")
+		}
+	}
+
+	if len(c.ClientCert) > 0 || len(c.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// SetTLSConfig replaces tls config of https rpcURL, e.g., on certificate
+// renewal. New config applies to new connections, idle connections are
+// closed so they don't outlive the old certificates.
+func (client *Client) SetTLSConfig(config *TLSConfig) error {
+	t, ok := client.transport.(*httpTransport)
+	if !ok || !t.https {
+		return fmt.Errorf("tls not applicable to rpcURL %s", client.url)
+	}
+
+	tlsConfig, err := config.build()
+	if err != nil {
+		return err
+	}
+	t.tlsConfig.Store(tlsConfig)
+	t.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// dial tls connection with latest tls config, handshake bounded by ctx
+func (t *httpTransport) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	config := t.tlsConfig.Load().(*tls.Config).Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	var dialer net.Dialer
+	rawConn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(tlsHandshakeTimeout)
+	}
+	conn := tls.Client(rawConn, config)
+	err = conn.SetDeadline(deadline)
+	if err == nil {
+		err = conn.Handshake()
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// server certificate rejected
+func isCertError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issue a certificate signed by ca, self signed if ca is nil
+func newTestCert(t *testing.T, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "spdkcsi-ca", nil)
+	serverCert := newTestCert(t, "spdk-node", ca)
+	clientCert := newTestCert(t, "spdkcsi", ca)
+
+	// spdk jsonrpc proxy requiring client certificate signed by ca
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID int32 `json:"id"`
+		}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck // test only
+			"jsonrpc": "2.0",
+			"id":      request.ID,
+			"result":  r.TLS.PeerCertificates[0].Subject.CommonName,
+		})
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	keyPair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// server not trusted by system roots
+	err = client.Call(ctx, "spdk_get_version", nil, nil)
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		t.Fatalf("untrusted server should fail without retry: %v", err)
+	}
+
+	// server trusted, but no client certificate
+	err = client.SetTLSConfig(&TLSConfig{CACert: ca.certPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call(ctx, "bdev_lvol_create", nil, nil)
+	if err == nil {
+		t.Fatal("server should reject client without certificate")
+	}
+
+	// mutual tls, server name differs from url host
+	err = client.SetTLSConfig(&TLSConfig{
+		CACert:     ca.certPEM,
+		ClientCert: clientCert.certPEM,
+		ClientKey:  clientCert.keyPEM,
+		ServerName: "spdk-node",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cn string
+	err = client.Call(ctx, "spdk_get_version", nil, &cn)
+	if err != nil || cn != "spdkcsi" {
+		t.Fatalf("mutual tls: cn=%s, err=%v", cn, err)
+	}
+
+	// wrong server name
+	err = client.SetTLSConfig(&TLSConfig{
+		CACert:     ca.certPEM,
+		ClientCert: clientCert.certPEM,
+		ClientKey:  clientCert.keyPEM,
+		ServerName: "other-node",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call(ctx, "spdk_get_version", nil, nil)
+	if !isCertError(err) {
+		t.Fatalf("server name mismatch should fail: %v", err)
+	}
+
+	// invalid settings are rejected, previous config is kept
+	err = client.SetTLSConfig(&TLSConfig{CACert: []byte("garbage")})
+	if err == nil {
+		t.Fatal("invalid CA bundle should be rejected")
+	}
+	err = client.SetTLSConfig(&TLSConfig{ClientCert: clientCert.certPEM, ClientKey: ca.keyPEM})
+	if err == nil {
+		t.Fatal("mismatched client key should be rejected")
+	}
+
+	// not applicable to plain http
+	plain, err := NewClient("http://127.0.0.1:9009", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.SetTLSConfig(&TLSConfig{}) == nil {
+		t.Fatal("tls should not apply to http rpcURL")
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdkrpc
+
+import (
+	"context"
+)
+
+// VhostCreateBlkControllerParams of vhost_create_blk_controller, Ctrlr is
+// also the socket name in vhost socket directory of spdk target
+type VhostCreateBlkControllerParams struct {
+	Ctrlr    string `json:"ctrlr"`
+	DevName  string `json:"dev_name"`
+	Cpumask  string `json:"cpumask,omitempty"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// VhostCreateBlkController creates a vhost-user-blk controller over a bdev
+func (client *Client) VhostCreateBlkController(ctx context.Context, params *VhostCreateBlkControllerParams) error {
+	return client.callBool(ctx, "vhost_create_blk_controller", params)
+}
+
+// VhostDeleteController deletes a vhost controller and its socket
+func (client *Client) VhostDeleteController(ctx context.Context, ctrlr string) error {
+	params := struct {
+		Ctrlr string `json:"ctrlr"`
+	}{
+		Ctrlr: ctrlr,
+	}
+	return client.callBool(ctx, "vhost_delete_controller", &params)
+}
+
+// VhostBlkBackend is the block backend of a vhost-user-blk controller
+type VhostBlkBackend struct {
+	Bdev     string `json:"bdev"`
+	Readonly bool   `json:"readonly"`
+}
+
+// VhostController is an item of vhost_get_controllers result
+type VhostController struct {
+	Ctrlr           string `json:"ctrlr"`
+	Cpumask         string `json:"cpumask"`
+	Socket          string `json:"socket"` // unix socket path on spdk target
+	BackendSpecific struct {
+		Block *VhostBlkBackend `json:"block,omitempty"`
+	} `json:"backend_specific"`
+}
+
+// VhostGetControllers returns the named controller, or all if name is empty
+func (client *Client) VhostGetControllers(ctx context.Context, name string) ([]VhostController, error) {
+	var params interface{}
+	if name != "" {
+		params = struct {
+			Name string `json:"name"`
+		}{
+			Name: name,
+		}
+	}
+	var result []VhostController
+	err := client.Call(ctx, "vhost_get_controllers", params, &result)
+	return result, err
+}
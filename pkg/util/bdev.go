@@ -0,0 +1,284 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// VolumeCondition reports volume health per CSI VolumeCondition
+type VolumeCondition struct {
+	Abnormal bool
+	Message  string
+}
+
+// bdevs stacked on a lvol, from bottom to top:
+// - lvol
+// - raid1 over lvol and remote replicas attached through NVMe-oF
+// - crypto
+// the topmost bdev is exported to initiator
+type bdevStack struct {
+	replicas      []map[string]string // volume info of remote replicas
+	replicaCtrlrs []string            // nvme controllers attached to replicas
+	raidBdev      string
+	cryptoBdev    string
+}
+
+// bdev exported to initiator
+func (stack *bdevStack) bdevName(lvolID string) string {
+	switch {
+	case stack.cryptoBdev != "":
+		return stack.cryptoBdev
+	case stack.raidBdev != "":
+		return stack.raidBdev
+	default:
+		return lvolID
+	}
+}
+
+// stack crypto bdev on top of current topmost bdev
+func (client *rpcClient) encryptStack(ctx context.Context, lvolID string, stack *bdevStack, key *CryptoKey) error {
+	if stack.cryptoBdev != "" {
+		return nil
+	}
+
+	cryptoBdev, err := client.createCryptoBdev(ctx, stack.bdevName(lvolID), key)
+	if err != nil {
+		return err
+	}
+	stack.cryptoBdev = cryptoBdev
+
+	klog.V(5).Infof("volume encrypted: %s, %s", lvolID, cryptoBdev)
+	return nil
+}
+
+// attach remote replicas and build raid1 over lvol and replicas
+func (client *rpcClient) replicateStack(ctx context.Context, lvolID string, stack *bdevStack, replicas []map[string]string) (err error) {
+	if stack.raidBdev != "" {
+		return nil
+	}
+	if stack.cryptoBdev != "" {
+		return fmt.Errorf("cannot replicate encrypted volume: %s", lvolID)
+	}
+	err = client.Capabilities().Require(FeatureReplicate...)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			client.detachReplicas(ctx, stack)
+		}
+	}()
+
+	baseBdevs := []string{lvolID}
+	for _, replica := range replicas {
+		ctrlr := replicaCtrlrName(replica)
+		bdevs, err := client.attachNVMeCtrlr(ctx, ctrlr, replica)
+		if err != nil {
+			return err
+		}
+		stack.replicaCtrlrs = append(stack.replicaCtrlrs, ctrlr)
+		if len(bdevs) != 1 {
+			return fmt.Errorf("replica %s exports %d namespaces", replica["nqn"], len(bdevs))
+		}
+		baseBdevs = append(baseBdevs, bdevs[0])
+	}
+
+	raidBdev := "raid-" + lvolID
+	err = client.createRaid1(ctx, raidBdev, baseBdevs)
+	if err != nil {
+		return err
+	}
+	stack.raidBdev = raidBdev
+	stack.replicas = replicas
+
+	klog.V(5).Infof("volume replicated: %s, %s: %v", lvolID, raidBdev, baseBdevs)
+	return nil
+}
+
+// tear down stacked bdevs from top to bottom, lvol itself is not touched
+func (client *rpcClient) deleteStack(ctx context.Context, stack *bdevStack) error {
+	if stack.cryptoBdev != "" {
+		err := client.deleteCryptoBdev(ctx, stack.cryptoBdev)
+		if err != nil && !errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+			return err
+		}
+		stack.cryptoBdev = ""
+	}
+
+	if stack.raidBdev != "" {
+		err := client.BdevRaidDelete(ctx, stack.raidBdev)
+		if err != nil && !errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+			return err
+		}
+		stack.raidBdev = ""
+	}
+
+	client.detachReplicas(ctx, stack)
+	stack.replicas = nil
+	return nil
+}
+
+func (client *rpcClient) detachReplicas(ctx context.Context, stack *bdevStack) {
+	for _, ctrlr := range stack.replicaCtrlrs {
+		err := client.BdevNvmeDetachController(ctx, ctrlr)
+		if err != nil {
+			klog.Errorf("failed to detach replica controller %s: %s", ctrlr, err)
+		}
+	}
+	stack.replicaCtrlrs = nil
+}
+
+// check topmost bdev, and raid status for replicated volume
+func (client *rpcClient) stackCondition(ctx context.Context, lvolID string, stack *bdevStack) (*VolumeCondition, error) {
+	if stack.raidBdev == "" {
+		exists, err := client.bdevExists(ctx, stack.bdevName(lvolID))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return &VolumeCondition{Abnormal: true, Message: "bdev not found: " + stack.bdevName(lvolID)}, nil
+		}
+		return &VolumeCondition{Message: "online"}, nil
+	}
+
+	raid, err := client.getRaid(ctx, stack.raidBdev)
+	if err != nil {
+		return nil, err
+	}
+	if raid == nil {
+		return &VolumeCondition{Abnormal: true, Message: "raid bdev not found: " + stack.raidBdev}, nil
+	}
+	if raid.Process != nil && raid.Process.Type == "rebuild" {
+		return &VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("rebuilding %s: %.1f%%", raid.Process.Target, raid.Process.Progress.Percent),
+		}, nil
+	}
+	if raid.State != "online" || raid.NumBaseBdevsDiscovered < raid.NumBaseBdevs {
+		return &VolumeCondition{
+			Abnormal: true,
+			Message: fmt.Sprintf("%s: %d of %d replicas available", raid.State,
+				raid.NumBaseBdevsDiscovered, raid.NumBaseBdevs),
+		}, nil
+	}
+	return &VolumeCondition{Message: "online"}, nil
+}
+
+// reattach lost replicas and add them back to raid, which starts rebuild
+func (client *rpcClient) repairStack(ctx context.Context, lvolID string, stack *bdevStack) error {
+	if stack.raidBdev == "" {
+		return nil
+	}
+	err := client.Capabilities().Require(FeatureRepair...)
+	if err != nil {
+		return err
+	}
+	raid, err := client.getRaid(ctx, stack.raidBdev)
+	if err != nil {
+		return err
+	}
+	if raid == nil {
+		return fmt.Errorf("raid bdev not found: %s", stack.raidBdev)
+	}
+
+	configured := make(map[string]bool)
+	for _, base := range raid.BaseBdevs {
+		if base.IsConfigured {
+			configured[base.Name] = true
+		}
+	}
+
+	for _, replica := range stack.replicas {
+		ctrlr := replicaCtrlrName(replica)
+		bdevs, err := client.attachNVMeCtrlr(ctx, ctrlr, replica)
+		if err != nil && !errors.Is(err, spdkrpc.ErrAlreadyExists) {
+			klog.Errorf("failed to reattach replica %s of volume %s: %s", replica["nqn"], lvolID, err)
+			continue
+		}
+		if len(bdevs) == 0 {
+			// controller still attached, bdev name follows spdk naming rule
+			bdevs = []string{ctrlr + "n1"}
+		}
+		if configured[bdevs[0]] {
+			continue
+		}
+		err = client.BdevRaidAddBaseBdev(ctx, stack.raidBdev, bdevs[0])
+		if err != nil {
+			return err
+		}
+		klog.Infof("rebuilding replica %s of volume %s", bdevs[0], lvolID)
+	}
+	return nil
+}
+
+// nvme controller name of a remote replica, unique per replica lvol
+func replicaCtrlrName(replica map[string]string) string {
+	return "replica-" + replica["model"]
+}
+
+// attach remote NVMe-oF namespace as local bdevs, returns bdev names
+func (client *rpcClient) attachNVMeCtrlr(ctx context.Context, name string, volumeInfo map[string]string) ([]string, error) {
+	return client.BdevNvmeAttachController(ctx, &spdkrpc.BdevNvmeAttachControllerParams{
+		Name:    name,
+		TrType:  volumeInfo["targetType"],
+		TrAddr:  volumeInfo["targetAddr"],
+		AdrFam:  cfgAddrFamily,
+		TrSvcID: volumeInfo["targetPort"],
+		SubNqn:  volumeInfo["nqn"],
+	})
+}
+
+func (client *rpcClient) createRaid1(ctx context.Context, name string, baseBdevs []string) error {
+	return client.BdevRaidCreate(ctx, &spdkrpc.BdevRaidCreateParams{
+		Name:      name,
+		RaidLevel: "raid1",
+		BaseBdevs: baseBdevs,
+	})
+}
+
+// returns nil if raid bdev not found
+func (client *rpcClient) getRaid(ctx context.Context, name string) (*spdkrpc.RaidBdev, error) {
+	result, err := client.BdevRaidGetBdevs(ctx, "all")
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		if result[i].Name == name {
+			return &result[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (client *rpcClient) bdevExists(ctx context.Context, name string) (bool, error) {
+	result, err := client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{Name: name})
+	if errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(result) > 0, nil
+}
@@ -16,15 +16,21 @@ limitations under the License.
 
 package util
 
+import (
+	"time"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
 const (
 	// TODO: move hardcoded settings to config map
-	cfgRPCTimeoutSeconds = 20
 	cfgLvolClearMethod   = "unmap" // none, unmap, write_zeroes
 	cfgLvolThinProvision = true
 	cfgNVMfSvcPort       = "4420"
 	cfgISCSISvcPort      = "3260"
 	cfgAllowAnyHost      = true
 	cfgAddrFamily        = "IPv4" // IPv4, IPv6, IB, FC
+	cfgCryptoPMD         = "crypto_aesni_mb"
 )
 
 // Config stores parsed command line parameters
@@ -33,6 +39,23 @@ type Config struct {
 	DriverVersion string
 	Endpoint      string
 	NodeID        string
+	MetricsAddr   string // metrics listener address, disabled if empty
+
+	// max time to drain in-flight requests on SIGTERM/SIGINT
+	ShutdownTimeout time.Duration
+
+	// spdk rpc timeout overrides per method
+	RPCTimeouts spdkrpc.Timeouts
+
+	// node local directory to persist staged volumes
+	StateDir string
+
+	// how node connects to nvmf target, NVMfConnectorNative or NVMfConnectorCLI
+	NVMfConnector string
+
+	// rpc url of node local spdk target serving nbd and ephemeral volumes,
+	// disabled if empty
+	LocalRPCURL string
 
 	IsControllerServer bool
 	IsNodeServer       bool
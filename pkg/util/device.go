@@ -0,0 +1,286 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+// block devices are looked up in sysfs on uevents, and polled periodically in
+// case uevents are missed or the netlink socket is not available
+var (
+	devicePollInterval         = time.Second
+	devicePollIntervalNoUevent = 100 * time.Millisecond
+	deviceTimeout              = 20 * time.Second
+)
+
+// nvme namespace block device, hidden multipath paths(nvme0c1n1) excluded
+var nvmeNamespaceRegexp = regexp.MustCompile(`^nvme\d+n\d+$`)
+
+// deviceFinder returns the device path, or empty string if not found
+type deviceFinder func() (string, error)
+
+// find nvme namespace of the subsystem, uuid is optional
+// /sys/block/nvme0n1/device/subsysnqn, /sys/block/nvme0n1/uuid
+//
+// Kernel name, e.g., /dev/nvme0n1, may point to another namespace after
+// reconnecting, namespace of known uuid is returned as udev link instead,
+// /dev/disk/by-id/nvme-uuid.<uuid>, it's not found until the link is created.
+func findNVMeDevice(nqn, uuid string) (string, error) {
+	blocks, err := filepath.Glob(filepath.Join(sysfsRoot, "block/nvme*"))
+	if err != nil {
+		return "", err
+	}
+	for _, block := range blocks {
+		name := filepath.Base(block)
+		if !nvmeNamespaceRegexp.MatchString(name) {
+			continue
+		}
+		// device is controller, or subsystem if native multipath is enabled
+		subsysnqn, err := readSysfsAttr(block, "device/subsysnqn")
+		if err != nil || subsysnqn != nqn {
+			continue // device may be gone
+		}
+		if uuid != "" {
+			nsUUID, err := readSysfsAttr(block, "uuid")
+			if err != nil || !strings.EqualFold(nsUUID, uuid) {
+				continue
+			}
+			return deviceLink(name, "disk/by-id/nvme-uuid."+strings.ToLower(uuid))
+		}
+		return deviceNode(name)
+	}
+	return "", nil
+}
+
+// find scsi disk of the lun in iscsi session logged into target
+// /sys/class/iscsi_session/session1/device/target2:0:0/2:0:0:0/block/sda
+func findISCSIDevice(iqn string, lun int) (string, error) {
+	disks, err := findISCSIDisks(iqn, lun)
+	if err != nil || len(disks) == 0 {
+		return "", err
+	}
+	return deviceNode(disks[0])
+}
+
+// scsi disks of the lun in all iscsi sessions logged into target, one per path
+func findISCSIDisks(iqn string, lun int) ([]string, error) {
+	sessionDirs, err := findSysfsDirs(filepath.Join(sysfsRoot, "class/iscsi_session/session*"), "targetname", iqn)
+	if err != nil {
+		return nil, err
+	}
+	var disks []string
+	for _, sessionDir := range sessionDirs {
+		blocks, err := filepath.Glob(filepath.Join(sessionDir, fmt.Sprintf("device/target*/*:*:*:%d/block/*", lun)))
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			disks = append(disks, filepath.Base(block))
+		}
+	}
+	return disks, nil
+}
+
+// find dm-multipath map holding any of the disks, returns /dev/mapper/<name>
+// /sys/block/sda/holders/dm-0, /sys/block/dm-0/dm/{uuid,name}
+func findMultipathDevice(disks []string) (string, error) {
+	for _, disk := range disks {
+		holders, err := filepath.Glob(filepath.Join(sysfsRoot, "block", disk, "holders/dm-*"))
+		if err != nil {
+			return "", err
+		}
+		for _, holder := range holders {
+			dmDir := filepath.Join(sysfsRoot, "block", filepath.Base(holder))
+			uuid, err := readSysfsAttr(dmDir, "dm/uuid")
+			if err != nil || !strings.HasPrefix(uuid, "mpath-") {
+				continue // not multipath, e.g., lvm or crypt on the disk
+			}
+			name, err := readSysfsAttr(dmDir, "dm/name")
+			if err != nil {
+				continue
+			}
+			return deviceNode(filepath.Join("mapper", name))
+		}
+	}
+	return "", nil
+}
+
+// nbd device of spdk nbd_start_disk, e.g., /dev/nbd0, is connected once its
+// pid attribute shows up, device node exists since nbd module is loaded
+func findNbdDevice(nbdDevice string) (string, error) {
+	name := filepath.Base(nbdDevice)
+	_, err := os.Stat(filepath.Join(sysfsRoot, "block", name, "pid"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return deviceNode(name)
+}
+
+// device node created by devtmpfs, not ready if not exists yet
+func deviceNode(name string) (string, error) {
+	path := filepath.Join(devRoot, name)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// udev link of the device, e.g., disk/by-id/xxx -> ../../nvme0n1, empty if
+// link not exists or points to another device
+func deviceLink(name, link string) (string, error) {
+	path := filepath.Join(devRoot, link)
+	target, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if filepath.Base(target) != name {
+		return "", nil
+	}
+	return path, nil
+}
+
+// wait for device comes up or timeout
+func waitForDeviceReady(ctx context.Context, find deviceFinder, timeout time.Duration) (string, error) {
+	var devicePath string
+	err := waitForDevice(ctx, timeout, func() (bool, error) {
+		var err error
+		devicePath, err = find()
+		return devicePath != "", err
+	})
+	if err == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out waiting device ready")
+	}
+	return devicePath, err
+}
+
+// wait for device gone or timeout
+func waitForDeviceGone(ctx context.Context, find deviceFinder, timeout time.Duration) error {
+	err := waitForDevice(ctx, timeout, func() (bool, error) {
+		devicePath, err := find()
+		return devicePath == "", err
+	})
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("timed out waiting device gone")
+	}
+	return err
+}
+
+// check cond on block device uevents and periodically until it's met
+func waitForDevice(ctx context.Context, timeout time.Duration, cond func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// subscribe before first check to not miss events in between
+	interval := devicePollInterval
+	events, err := watchBlockUevents(ctx)
+	if err != nil {
+		klog.V(4).Infof("uevents not available, polling: %s", err)
+		interval = devicePollIntervalNoUevent
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		done, err := cond()
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-events:
+			if !ok {
+				events = nil // socket error, keep polling
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// subscribe kernel uevents, channel is signaled on block device events and
+// closed when ctx is done
+func watchBlockUevents(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// multicast group 1: kernel uevents
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1})
+	if err != nil {
+		unix.Close(fd) // nolint:errcheck // we can do little
+		return nil, err
+	}
+	// nonblocking fd is managed by runtime poller, close unblocks read
+	file := os.NewFile(uintptr(fd), "uevent")
+
+	events := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		file.Close() // nolint:errcheck // we can do little
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := file.Read(buf)
+			// receive buffer overrun, block events may be lost
+			overrun := errors.Is(err, unix.ENOBUFS)
+			if err != nil && !overrun {
+				return
+			}
+			if overrun || isBlockUevent(buf[:n]) {
+				select {
+				case events <- struct{}{}:
+				default: // pending event not consumed yet
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// uevent message: "add@/devices/...\0ACTION=add\0SUBSYSTEM=block\0..."
+func isBlockUevent(msg []byte) bool {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if bytes.Equal(field, []byte("SUBSYSTEM=block")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replace sysfs and devfs roots with temporary directories
+func fakeDeviceRoots(t *testing.T) {
+	var err error
+	sysfsRoot, err = ioutil.TempDir("", "spdkcsi-sysfs*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devRoot, err = ioutil.TempDir("", "spdkcsi-dev*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(sysfsRoot)
+		os.RemoveAll(devRoot)
+		sysfsRoot = "/sys"
+		devRoot = "/dev"
+	})
+}
+
+func writeDevice(t *testing.T, name string) string {
+	path := filepath.Join(devRoot, name)
+	err := ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// udev link to device node, e.g., disk/by-id/xxx -> ../../nvme0n1
+func writeDeviceLink(t *testing.T, link, name string) string {
+	path := filepath.Join(devRoot, link)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := filepath.Rel(filepath.Dir(path), filepath.Join(devRoot, name))
+	err = os.Symlink(target, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFindNVMeDevice(t *testing.T) {
+	fakeDeviceRoots(t)
+	const nqn = "nqn.2020-04.io.spdk.csi:uuid:test"
+	const uuid = "a5c3d5e1-0fbb-4a54-9c47-3a2d5d1e3f01"
+
+	path, err := findNVMeDevice(nqn, "")
+	if err != nil || path != "" {
+		t.Fatalf("should not find device: %s, %v", path, err)
+	}
+
+	// similar nqn, hidden multipath path, and namespace without device node
+	writeSysfs(t, "block/nvme0n1/device", map[string]string{"subsysnqn": nqn + "-1"})
+	writeDevice(t, "nvme0n1")
+	writeSysfs(t, "block/nvme1c1n1/device", map[string]string{"subsysnqn": nqn})
+	writeDevice(t, "nvme1c1n1")
+	writeSysfs(t, "block/nvme1n1/device", map[string]string{"subsysnqn": nqn})
+	writeSysfs(t, "block/nvme1n1", map[string]string{"uuid": uuid})
+	path, err = findNVMeDevice(nqn, "")
+	if err != nil || path != "" {
+		t.Fatalf("should not find device: %s, %v", path, err)
+	}
+
+	devicePath := writeDevice(t, "nvme1n1")
+	path, err = findNVMeDevice(nqn, "")
+	if err != nil || path != devicePath {
+		t.Fatalf("findNVMeDevice: %s, %v", path, err)
+	}
+	// namespace of known uuid is found by stable udev link
+	path, err = findNVMeDevice(nqn, "A5C3D5E1-0FBB-4A54-9C47-3A2D5D1E3F01")
+	if err != nil || path != "" {
+		t.Fatalf("should wait for udev link: %s, %v", path, err)
+	}
+	linkPath := writeDeviceLink(t, "disk/by-id/nvme-uuid."+uuid, "nvme0n1")
+	path, err = findNVMeDevice(nqn, uuid)
+	if err != nil || path != "" {
+		t.Fatalf("link to another device: %s, %v", path, err)
+	}
+	os.Remove(linkPath)
+	writeDeviceLink(t, "disk/by-id/nvme-uuid."+uuid, "nvme1n1")
+	path, err = findNVMeDevice(nqn, "A5C3D5E1-0FBB-4A54-9C47-3A2D5D1E3F01")
+	if err != nil || path != linkPath {
+		t.Fatalf("findNVMeDevice by uuid: %s, %v", path, err)
+	}
+	path, err = findNVMeDevice(nqn, "00000000-0000-0000-0000-000000000000")
+	if err != nil || path != "" {
+		t.Fatalf("uuid should not match: %s, %v", path, err)
+	}
+}
+
+func TestFindISCSIDevice(t *testing.T) {
+	fakeDeviceRoots(t)
+	const iqn = "iqn.2016-06.io.spdk:test"
+
+	writeSysfs(t, "class/iscsi_session/session1", map[string]string{"targetname": iqn + "-1"})
+	writeSysfs(t, "class/iscsi_session/session1/device/target2:0:0/2:0:0:0/block/sda", nil)
+	writeDevice(t, "sda")
+	writeSysfs(t, "class/iscsi_session/session2", map[string]string{"targetname": iqn})
+	writeSysfs(t, "class/iscsi_session/session2/device/target3:0:0/3:0:0:1/block/sdb", nil)
+	writeDevice(t, "sdb")
+	path, err := findISCSIDevice(iqn, 0)
+	if err != nil || path != "" {
+		t.Fatalf("should not find device: %s, %v", path, err)
+	}
+
+	writeSysfs(t, "class/iscsi_session/session2/device/target3:0:0/3:0:0:0/block/sdc", nil)
+	devicePath := writeDevice(t, "sdc")
+	path, err = findISCSIDevice(iqn, 0)
+	if err != nil || path != devicePath {
+		t.Fatalf("findISCSIDevice: %s, %v", path, err)
+	}
+}
+
+func TestWaitForDevice(t *testing.T) {
+	fakeDeviceRoots(t)
+	// fake devices don't trigger uevents
+	devicePollInterval = 10 * time.Millisecond
+	defer func() {
+		devicePollInterval = time.Second
+	}()
+
+	// device shows up shortly, devRoot is reset by cleanup after test returns
+	devicePath := filepath.Join(devRoot, "sda")
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(devicePath, nil, 0600) // nolint:errcheck // test only
+	}()
+	find := func() (string, error) { return deviceNode("sda") }
+	path, err := waitForDeviceReady(context.Background(), find, time.Second)
+	<-written
+	if err != nil || path != devicePath {
+		t.Fatalf("waitForDeviceReady: %s, %v", path, err)
+	}
+
+	err = waitForDeviceGone(context.Background(), find, 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("should time out")
+	}
+	os.Remove(path)
+	err = waitForDeviceGone(context.Background(), find, time.Second)
+	if err != nil {
+		t.Fatalf("waitForDeviceGone: %s", err)
+	}
+}
+
+func TestIsBlockUevent(t *testing.T) {
+	block := []byte("add@/devices/virtual/nvme-fabrics/ctl/nvme0/nvme0n1\x00ACTION=add\x00SUBSYSTEM=block\x00DEVNAME=nvme0n1\x00")
+	if !isBlockUevent(block) {
+		t.Fatal("should be block uevent")
+	}
+	other := []byte("add@/devices/virtual/nvme-fabrics/ctl/nvme0\x00ACTION=add\x00SUBSYSTEM=nvme\x00DEVNAME=nvme0\x00")
+	if isBlockUevent(other) {
+		t.Fatal("should not be block uevent")
+	}
+}
+
+func TestWatchBlockUevents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := watchBlockUevents(ctx)
+	if err != nil {
+		t.Skipf("uevents not available: %s", err)
+	}
+
+	// channel is closed after ctx is done
+	cancel()
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			t.Fatal("uevent channel not closed")
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// lvol of an ephemeral volume is named after CSI volume id, so node server
+// finds it again after restart, and lvols of unknown volumes are orphans
+const ephemeralLvolPrefix = "csi-eph-"
+
+// ErrEphemeralUnsupported is returned if spdk node is not node local
+var ErrEphemeralUnsupported = errors.New("ephemeral volume requires node local spdk, see --local-rpc-url")
+
+func ephemeralLvolName(volumeID string) string {
+	// volume id is too long for lvol name, at most 63 characters
+	return ephemeralLvolPrefix + uuid.NewSHA1(uuid.NameSpaceOID, []byte(volumeID)).String()
+}
+
+func ephemeralNode(ctx context.Context, node SpdkNode) (*nodeNBD, error) {
+	nbd, ok := node.(*nodeNBD)
+	if !ok {
+		return nil, ErrEphemeralUnsupported
+	}
+	err := nbd.client.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nbd, nil
+}
+
+// CreateEphemeralVolume creates lvol of ephemeral volume on node local spdk,
+// or finds the one created before, and returns volume context of initiator
+func CreateEphemeralVolume(ctx context.Context, node SpdkNode, volumeID string, sizeMiB int64) (map[string]string, error) {
+	nbd, err := ephemeralNode(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	name := ephemeralLvolName(volumeID)
+	lvolID, err := nbd.client.findLvol(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if lvolID == "" {
+		lvstores, err := nbd.LvStores(ctx)
+		if err != nil {
+			return nil, err
+		}
+		lvsName := ""
+		for i := range lvstores {
+			if lvstores[i].FreeSizeMiB > sizeMiB {
+				lvsName = lvstores[i].Name
+				break
+			}
+		}
+		if lvsName == "" {
+			return nil, spdkrpc.ErrNoSpaceLeft
+		}
+		lvolID, err = nbd.client.createVolumeNamed(ctx, name, lvsName, sizeMiB)
+		if err != nil {
+			return nil, err
+		}
+		klog.V(5).Infof("ephemeral volume created: %s, lvol: %s", volumeID, lvolID)
+	}
+
+	return map[string]string{
+		"targetType": "nbd",
+		"bdev":       lvolID,
+	}, nil
+}
+
+// DeleteEphemeralVolume stops nbd disk of the lvol, if any, and deletes it,
+// no error if already deleted
+func DeleteEphemeralVolume(ctx context.Context, node SpdkNode, volumeID string) error {
+	nbd, err := ephemeralNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	lvolID, err := nbd.client.findLvol(ctx, ephemeralLvolName(volumeID))
+	if err != nil || lvolID == "" {
+		return err
+	}
+	err = nbd.client.deleteEphemeralLvol(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("ephemeral volume deleted: %s, lvol: %s", volumeID, lvolID)
+	return nil
+}
+
+// DeleteOrphanEphemeralVolumes deletes ephemeral lvols not belonging to any
+// of volumeIDs, e.g., node state is lost. volumeIDs is called after lvols are
+// listed, so lvols being created are not taken as orphans.
+func DeleteOrphanEphemeralVolumes(ctx context.Context, node SpdkNode, volumeIDs func() []string) error {
+	nbd, err := ephemeralNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	bdevs, err := nbd.client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{})
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, volumeID := range volumeIDs() {
+		known[ephemeralLvolName(volumeID)] = true
+	}
+	for i := range bdevs {
+		name := ephemeralLvolAlias(&bdevs[i])
+		if name == "" || known[name] {
+			continue
+		}
+		klog.Warningf("deleting orphan ephemeral lvol %s(%s)", name, bdevs[i].Name)
+		err = nbd.client.deleteEphemeralLvol(ctx, bdevs[i].Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// name part of lvs/name alias if bdev is an ephemeral lvol, empty otherwise
+func ephemeralLvolAlias(bdev *spdkrpc.Bdev) string {
+	for _, alias := range bdev.Aliases {
+		i := strings.IndexByte(alias, '/')
+		if i >= 0 && strings.HasPrefix(alias[i+1:], ephemeralLvolPrefix) {
+			return alias[i+1:]
+		}
+	}
+	return ""
+}
+
+// uuid of lvol named name in any lvstore, empty if not found
+func (client *rpcClient) findLvol(ctx context.Context, name string) (string, error) {
+	lvstores, err := client.BdevLvolGetLvstores(ctx)
+	if err != nil {
+		return "", err
+	}
+	for i := range lvstores {
+		bdevs, err := client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{Name: lvstores[i].Name + "/" + name})
+		if errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(bdevs) > 0 {
+			return bdevs[0].Name, nil
+		}
+	}
+	return "", nil
+}
+
+// stop nbd disk left by node server, then delete the lvol
+func (client *rpcClient) deleteEphemeralLvol(ctx context.Context, lvolID string) error {
+	nbdDevice, err := findNbdDisk(ctx, client.Client, lvolID)
+	if err != nil {
+		return err
+	}
+	if nbdDevice != "" {
+		err = client.NbdStopDisk(ctx, nbdDevice)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.deleteVolume(ctx, lvolID)
+	if errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
+)
+
+func TestEphemeralVolume(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	defer server.Close()
+
+	ctx := context.Background()
+	node, err := NewSpdkNode(server.URL, "", "", "nbd", "", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+
+	// created once, found by name afterwards
+	volumeContext, err := CreateEphemeralVolume(ctx, node, "csi-volume0", 4)
+	if err != nil || volumeContext["targetType"] != "nbd" || volumeContext["bdev"] == "" {
+		t.Fatalf("CreateEphemeralVolume: %v, %v", volumeContext, err)
+	}
+	again, err := CreateEphemeralVolume(ctx, node, "csi-volume0", 4)
+	if err != nil || again["bdev"] != volumeContext["bdev"] {
+		t.Fatalf("CreateEphemeralVolume not idempotent: %v, %v", again, err)
+	}
+	if calls := server.Calls("bdev_lvol_create"); calls != 1 {
+		t.Fatalf("expect 1 bdev_lvol_create, got %d", calls)
+	}
+	_, err = CreateEphemeralVolume(ctx, node, "csi-volume1", 4)
+	if err != nil {
+		t.Fatalf("CreateEphemeralVolume: %s", err)
+	}
+
+	// nbd disk left by node server is stopped
+	_, err = node.(*nodeNBD).client.NbdStartDisk(ctx, volumeContext["bdev"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = DeleteEphemeralVolume(ctx, node, "csi-volume0")
+		if err != nil {
+			t.Fatalf("DeleteEphemeralVolume: %s", err)
+		}
+	}
+	if calls := server.Calls("bdev_lvol_delete"); calls != 1 {
+		t.Fatalf("expect 1 bdev_lvol_delete, got %d", calls)
+	}
+
+	// lvols of known volumes and non ephemeral lvols are kept
+	lvs, _ := node.LvStores(ctx)
+	lvolID, err := node.CreateVolume(ctx, lvs[0].Name, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateEphemeralVolume(ctx, node, "csi-volume2", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteOrphanEphemeralVolumes(ctx, node, func() []string { return []string{"csi-volume2"} })
+	if err != nil {
+		t.Fatalf("DeleteOrphanEphemeralVolumes: %s", err)
+	}
+	client := node.(*nodeNBD).client
+	for volumeID, expect := range map[string]bool{"csi-volume1": false, "csi-volume2": true} {
+		found, err := client.findLvol(ctx, ephemeralLvolName(volumeID))
+		if err != nil || (found != "") != expect {
+			t.Fatalf("volume %s: expect exists %v, got %q, %v", volumeID, expect, found, err)
+		}
+	}
+	err = node.DeleteVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("non ephemeral lvol deleted: %s", err)
+	}
+}
+
+func TestEphemeralUnsupported(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	defer server.Close()
+
+	ctx := context.Background()
+	node, err := NewSpdkNode(server.URL, "", "", "nvme-tcp", "127.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+	_, err = CreateEphemeralVolume(ctx, node, "csi-volume0", 4)
+	if !errors.Is(err, ErrEphemeralUnsupported) {
+		t.Fatalf("expect ErrEphemeralUnsupported: %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+	"k8s.io/klog"
+)
+
+// nvme fabrics connectors, see SetNVMfConnector
+const (
+	NVMfConnectorNative = "native"   // /dev/nvme-fabrics and sysfs
+	NVMfConnectorCLI    = "nvme-cli" // nvme connect/disconnect
+)
+
+// sentinel errors, see FabricsError for how kernel errors are mapped
+var (
+	// same controller exists, connect is a duplicated request
+	ErrFabricsAlreadyConnected = errors.New("nvme fabrics: already connected")
+	// target refused connection or not reachable, request may be retried
+	ErrFabricsUnreachable = errors.New("nvme fabrics: target unreachable")
+	// kernel rejected connect options, e.g., unknown transport
+	ErrFabricsInvalidOptions = errors.New("nvme fabrics: invalid options")
+	// nvme-fabrics kernel module not loaded
+	ErrFabricsNotSupported = errors.New("nvme fabrics: not supported")
+)
+
+// FabricsError is a failed nvme fabrics operation
+//
+// Use errors.Is to check against sentinel errors, e.g., ErrFabricsUnreachable,
+// or errors.As to get the details.
+type FabricsError struct {
+	Op    string // connect, disconnect
+	Arg   string // connect options or controller
+	Errno syscall.Errno
+}
+
+func (e *FabricsError) Error() string {
+	return fmt.Sprintf("nvme fabrics %s %s: %s", e.Op, e.Arg, e.Errno)
+}
+
+// Is reports whether the error maps to target sentinel error
+func (e *FabricsError) Is(target error) bool {
+	sentinel := fabricsErrnoSentinels[e.Errno]
+	return sentinel != nil && sentinel == target
+}
+
+// kernel returns negative errno on writing /dev/nvme-fabrics
+var fabricsErrnoSentinels = map[syscall.Errno]error{
+	syscall.EALREADY:     ErrFabricsAlreadyConnected,
+	syscall.ECONNREFUSED: ErrFabricsUnreachable,
+	syscall.ECONNRESET:   ErrFabricsUnreachable,
+	syscall.EHOSTUNREACH: ErrFabricsUnreachable,
+	syscall.ENETUNREACH:  ErrFabricsUnreachable,
+	syscall.ETIMEDOUT:    ErrFabricsUnreachable,
+	syscall.EINVAL:       ErrFabricsInvalidOptions,
+	syscall.ENOENT:       ErrFabricsNotSupported,
+	syscall.ENODEV:       ErrFabricsNotSupported,
+}
+
+func newFabricsError(op, arg string, err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return &FabricsError{Op: op, Arg: arg, Errno: errno}
+	}
+	return fmt.Errorf("nvme fabrics %s %s: %w", op, arg, err)
+}
+
+// host identity sent to target, same files nvme-cli reads, kernel generates
+// a random host nqn if not set
+var (
+	hostNQNFile = "/etc/nvme/hostnqn"
+	hostIDFile  = "/etc/nvme/hostid"
+)
+
+// nvmfFabrics connects to and disconnects from nvme fabrics subsystems
+type nvmfFabrics interface {
+	connect(ctx context.Context, opts *fabricsOptions) error
+	disconnect(ctx context.Context, nqn string) error
+}
+
+var fabrics nvmfFabrics = fabricsNative{}
+
+// SetNVMfConnector selects how nvmf initiator connects to target, not safe to
+// be called concurrently with initiators
+func SetNVMfConnector(connector string) error {
+	switch connector {
+	case NVMfConnectorNative:
+		fabrics = fabricsNative{}
+	case NVMfConnectorCLI:
+		fabrics = fabricsCLI{}
+	default:
+		return fmt.Errorf("unknown nvmf connector: %s", connector)
+	}
+	return nil
+}
+
+// nvmf host connection parameter in storage class, passed to node in volume
+// context, nvme-cli flag is the kernel option with "_" replaced by "-"
+type nvmfHostParam struct {
+	key      string // storage class parameter
+	option   string // kernel connect option
+	isBool   bool   // option without value, set if true
+	min, max int    // valid range of integer parameter
+}
+
+// see linux/drivers/nvme/host/fabrics.c
+var nvmfHostParams = []nvmfHostParam{
+	{key: "nrIoQueues", option: "nr_io_queues", min: 1, max: math.MaxInt32},
+	{key: "queueSize", option: "queue_size", min: 16, max: 1024},
+	{key: "keepAliveTmo", option: "keep_alive_tmo", min: 0, max: math.MaxInt32},
+	{key: "ctrlLossTmo", option: "ctrl_loss_tmo", min: -1, max: math.MaxInt32}, // -1 to reconnect forever
+	{key: "reconnectDelay", option: "reconnect_delay", min: 1, max: math.MaxInt32},
+	{key: "hdrDigest", option: "hdr_digest", isBool: true},
+	{key: "dataDigest", option: "data_digest", isBool: true},
+}
+
+// host identity parameters, default to /etc/nvme/{hostnqn,hostid}
+const (
+	nvmfHostNQNParam = "hostNqn"
+	nvmfHostIDParam  = "hostId"
+	maxNQNLen        = 223
+)
+
+// ValidateNVMfHostParams checks nvmf host connection parameters in storage
+// class or volume context, parameters not set are left to kernel defaults
+func ValidateNVMfHostParams(params map[string]string) error {
+	for _, param := range nvmfHostParams {
+		value, exists := params[param.key]
+		if !exists {
+			continue
+		}
+		if param.isBool {
+			_, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", param.key, value)
+			}
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < param.min || n > param.max {
+			return fmt.Errorf("invalid %s: %s, must be in [%d, %d]", param.key, value, param.min, param.max)
+		}
+	}
+	if hostNQN, exists := params[nvmfHostNQNParam]; exists {
+		if !strings.HasPrefix(hostNQN, "nqn.") || len(hostNQN) > maxNQNLen || strings.ContainsAny(hostNQN, ", ") {
+			return fmt.Errorf("invalid %s: %s", nvmfHostNQNParam, hostNQN)
+		}
+	}
+	if hostID, exists := params[nvmfHostIDParam]; exists {
+		_, err := uuid.Parse(hostID)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", nvmfHostIDParam, hostID)
+		}
+	}
+	return nil
+}
+
+// connect options, see linux/drivers/nvme/host/fabrics.c
+type fabricsOptions struct {
+	transport string // tcp, rdma
+	traddr    string
+	trsvcid   string
+	nqn       string
+	hostnqn   string            // optional
+	hostid    string            // optional
+	params    map[string]string // validated host parameters, see nvmfHostParams
+}
+
+func newFabricsOptions(transport, traddr, trsvcid, nqn string, params map[string]string) *fabricsOptions {
+	return &fabricsOptions{
+		transport: transport,
+		traddr:    traddr,
+		trsvcid:   trsvcid,
+		nqn:       nqn,
+		hostnqn:   params[nvmfHostNQNParam],
+		hostid:    params[nvmfHostIDParam],
+		params:    params,
+	}
+}
+
+// host parameters set in options, calls fn with kernel option and value,
+// value is empty for boolean option
+func (opts *fabricsOptions) forEachParam(fn func(option, value string)) {
+	for _, param := range nvmfHostParams {
+		value, exists := opts.params[param.key]
+		if !exists {
+			continue
+		}
+		if param.isBool {
+			if isSet, _ := strconv.ParseBool(value); isSet {
+				fn(param.option, "")
+			}
+			continue
+		}
+		fn(param.option, value)
+	}
+}
+
+// comma separated key=value pairs written to /dev/nvme-fabrics
+func (opts *fabricsOptions) String() string {
+	pairs := []string{
+		"transport=" + opts.transport,
+		"traddr=" + opts.traddr,
+		"trsvcid=" + opts.trsvcid,
+		"nqn=" + opts.nqn,
+	}
+	if opts.hostnqn != "" {
+		pairs = append(pairs, "hostnqn="+opts.hostnqn)
+	}
+	if opts.hostid != "" {
+		pairs = append(pairs, "hostid="+opts.hostid)
+	}
+	opts.forEachParam(func(option, value string) {
+		if value == "" {
+			pairs = append(pairs, option)
+		} else {
+			pairs = append(pairs, option+"="+value)
+		}
+	})
+	return strings.Join(pairs, ",")
+}
+
+// nvme-cli connect flags
+func (opts *fabricsOptions) cliArgs() []string {
+	args := []string{"-t", opts.transport, "-a", opts.traddr, "-s", opts.trsvcid, "-n", opts.nqn}
+	if opts.hostnqn != "" {
+		args = append(args, "--hostnqn="+opts.hostnqn)
+	}
+	if opts.hostid != "" {
+		args = append(args, "--hostid="+opts.hostid)
+	}
+	opts.forEachParam(func(option, value string) {
+		flag := "--" + strings.ReplaceAll(option, "_", "-")
+		if value != "" {
+			flag += "=" + value
+		}
+		args = append(args, flag)
+	})
+	return args
+}
+
+// fill in host identity from files if not set, missing files are ignored
+func (opts *fabricsOptions) setHostIdentity() {
+	if opts.hostnqn == "" {
+		opts.hostnqn = readHostFile(hostNQNFile)
+	}
+	if opts.hostid == "" {
+		opts.hostid = readHostFile(hostIDFile)
+	}
+}
+
+func readHostFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// opens /dev/nvme-fabrics, replaced in tests
+var openFabrics = func() (io.ReadWriteCloser, error) {
+	return os.OpenFile(filepath.Join(devRoot, "nvme-fabrics"), os.O_RDWR, 0)
+}
+
+// talks to kernel directly, writes connect options to /dev/nvme-fabrics and
+// deletes controllers through sysfs
+type fabricsNative struct{}
+
+// kernel connects synchronously in write(2) and cannot be interrupted, when
+// ctx is done the write is still waited for, and the connection is deleted
+// if it succeeds, so the failed call leaves no controller behind
+func (fabrics fabricsNative) connect(ctx context.Context, opts *fabricsOptions) error {
+	opts.setHostIdentity()
+	options := opts.String()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fabricsConnect(options)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	if <-done == nil {
+		klog.Warningf("nvme fabrics connected after %s, disconnecting: %s", ctx.Err(), opts.nqn)
+		err := fabrics.disconnect(context.Background(), opts.nqn)
+		if err != nil {
+			klog.Errorf("failed to disconnect %s: %s", opts.nqn, err)
+		}
+	}
+	return ctx.Err()
+}
+
+func fabricsConnect(options string) error {
+	klog.Infof("nvme fabrics connect: %s", options)
+	f, err := openFabrics()
+	if err != nil {
+		return newFabricsError("connect", options, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte(options))
+	if err != nil {
+		return newFabricsError("connect", options, err)
+	}
+
+	// kernel responds with the created controller, e.g., instance=0,cntlid=1
+	response := make([]byte, 256)
+	n, err := f.Read(response)
+	if err != nil {
+		return newFabricsError("connect", options, err)
+	}
+	var instance, cntlid int
+	_, err = fmt.Sscanf(string(response[:n]), "instance=%d,cntlid=%d", &instance, &cntlid)
+	if err != nil {
+		return fmt.Errorf("nvme fabrics connect %s: unexpected response %q", options, response[:n])
+	}
+	klog.Infof("nvme fabrics connected: nvme%d, cntlid %d", instance, cntlid)
+	return nil
+}
+
+// deletes all controllers connected to the subsystem, no error if none found
+func (fabricsNative) disconnect(ctx context.Context, nqn string) error {
+	// /sys/class/nvme/nvme0/{subsysnqn,delete_controller}
+	ctrlrDirs, err := filepath.Glob(filepath.Join(sysfsRoot, "class/nvme/nvme*"))
+	if err != nil {
+		return err
+	}
+	for _, ctrlrDir := range ctrlrDirs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		subsysnqn, err := readSysfsAttr(ctrlrDir, "subsysnqn")
+		if err != nil || subsysnqn != nqn {
+			continue // controller may be gone
+		}
+		klog.Infof("nvme fabrics disconnect: %s", filepath.Base(ctrlrDir))
+		err = ioutil.WriteFile(filepath.Join(ctrlrDir, "delete_controller"), []byte("1"), 0)
+		if err != nil && !os.IsNotExist(err) {
+			return newFabricsError("disconnect", filepath.Base(ctrlrDir), err)
+		}
+	}
+	return nil
+}
+
+// shells out to nvme-cli, errors are logged only and caller goes on checking
+// device status in case caused by duplicated request
+type fabricsCLI struct{}
+
+func (fabricsCLI) connect(ctx context.Context, opts *fabricsOptions) error {
+	// nvme connect -t tcp -a 192.168.1.100 -s 4420 -n "nqn"
+	cmdLine := append([]string{"nvme", "connect"}, opts.cliArgs()...)
+	err := execWithTimeout(ctx, cmdLine, 40)
+	if err != nil {
+		klog.Errorf("command %v failed: %s", cmdLine, err)
+	}
+	return nil
+}
+
+func (fabricsCLI) disconnect(ctx context.Context, nqn string) error {
+	// nvme disconnect -n "nqn"
+	cmdLine := []string{"nvme", "disconnect", "-n", nqn}
+	err := execWithTimeout(ctx, cmdLine, 40)
+	if err != nil {
+		klog.Errorf("command %v failed: %s", cmdLine, err)
+	}
+	return nil
+}
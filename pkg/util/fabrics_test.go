@@ -0,0 +1,267 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fake /dev/nvme-fabrics, fails write with errno if set, write blocks until
+// block is closed if not nil
+type fakeFabricsDev struct {
+	written  bytes.Buffer
+	response string
+	errno    syscall.Errno
+	block    chan struct{}
+}
+
+func (dev *fakeFabricsDev) Write(p []byte) (int, error) {
+	if dev.block != nil {
+		<-dev.block
+	}
+	if dev.errno != 0 {
+		return 0, &os.PathError{Op: "write", Path: "/dev/nvme-fabrics", Err: dev.errno}
+	}
+	return dev.written.Write(p)
+}
+
+func (dev *fakeFabricsDev) Read(p []byte) (int, error) {
+	return copy(p, dev.response), nil
+}
+
+func (dev *fakeFabricsDev) Close() error {
+	return nil
+}
+
+// replace /dev/nvme-fabrics and host identity files
+func fakeFabrics(t *testing.T, dev *fakeFabricsDev) {
+	dir, err := ioutil.TempDir("", "spdkcsi-nvme*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedOpen, savedNQN, savedID := openFabrics, hostNQNFile, hostIDFile
+	openFabrics = func() (io.ReadWriteCloser, error) { return dev, nil }
+	hostNQNFile = filepath.Join(dir, "hostnqn")
+	hostIDFile = filepath.Join(dir, "hostid")
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		openFabrics, hostNQNFile, hostIDFile = savedOpen, savedNQN, savedID
+	})
+}
+
+func TestFabricsConnect(t *testing.T) {
+	dev := &fakeFabricsDev{response: "instance=3,cntlid=1\n"}
+	fakeFabrics(t, dev)
+	err := ioutil.WriteFile(hostNQNFile, []byte("nqn.2014-08.org.nvmexpress:uuid:host\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &fabricsOptions{transport: "tcp", traddr: "127.0.0.1", trsvcid: "4420", nqn: "nqn.2020-04.io.spdk.csi:uuid:test"}
+	err = fabricsNative{}.connect(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	expected := "transport=tcp,traddr=127.0.0.1,trsvcid=4420,nqn=nqn.2020-04.io.spdk.csi:uuid:test," +
+		"hostnqn=nqn.2014-08.org.nvmexpress:uuid:host"
+	if dev.written.String() != expected {
+		t.Fatalf("unexpected options: %s", dev.written.String())
+	}
+
+	dev.response = "bad response"
+	err = fabricsNative{}.connect(context.Background(), opts)
+	if err == nil {
+		t.Fatal("should fail on bad response")
+	}
+}
+
+func TestValidateNVMfHostParams(t *testing.T) {
+	testCases := []struct {
+		params map[string]string
+		valid  bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"fsType": "ext4", "nrIoQueues": "4", "queueSize": "1024", "keepAliveTmo": "0"}, true},
+		{map[string]string{"ctrlLossTmo": "-1", "reconnectDelay": "10", "hdrDigest": "true", "dataDigest": "false"}, true},
+		{map[string]string{"hostNqn": "nqn.2014-08.org.nvmexpress:uuid:host", "hostId": "c5e3a2b4-1f3d-4b0e-9a7c-2d8f6e1b0a93"}, true},
+		{map[string]string{"nrIoQueues": "0"}, false},
+		{map[string]string{"queueSize": "2048"}, false},
+		{map[string]string{"keepAliveTmo": "-1"}, false},
+		{map[string]string{"ctrlLossTmo": "-2"}, false},
+		{map[string]string{"reconnectDelay": "1s"}, false},
+		{map[string]string{"hdrDigest": "yes"}, false},
+		{map[string]string{"hostNqn": "host"}, false},
+		{map[string]string{"hostNqn": "nqn.host,ctrl_loss_tmo=0"}, false},
+		{map[string]string{"hostId": "host"}, false},
+	}
+	for _, tc := range testCases {
+		err := ValidateNVMfHostParams(tc.params)
+		if (err == nil) != tc.valid {
+			t.Fatalf("%v: valid %v, got %v", tc.params, tc.valid, err)
+		}
+	}
+}
+
+func TestFabricsOptions(t *testing.T) {
+	opts := newFabricsOptions("tcp", "127.0.0.1", "4420", "nqn.test", map[string]string{
+		"targetType":   "TCP",
+		"hostNqn":      "nqn.host",
+		"queueSize":    "128",
+		"ctrlLossTmo":  "-1",
+		"hdrDigest":    "true",
+		"dataDigest":   "false",
+		"keepAliveTmo": "5",
+	})
+	expected := "transport=tcp,traddr=127.0.0.1,trsvcid=4420,nqn=nqn.test,hostnqn=nqn.host," +
+		"queue_size=128,keep_alive_tmo=5,ctrl_loss_tmo=-1,hdr_digest"
+	if opts.String() != expected {
+		t.Fatalf("unexpected options: %s", opts.String())
+	}
+	expectedArgs := []string{"-t", "tcp", "-a", "127.0.0.1", "-s", "4420", "-n", "nqn.test", "--hostnqn=nqn.host",
+		"--queue-size=128", "--keep-alive-tmo=5", "--ctrl-loss-tmo=-1", "--hdr-digest"}
+	if !reflect.DeepEqual(opts.cliArgs(), expectedArgs) {
+		t.Fatalf("unexpected args: %v", opts.cliArgs())
+	}
+}
+
+func TestFabricsConnectErrors(t *testing.T) {
+	dev := &fakeFabricsDev{}
+	fakeFabrics(t, dev)
+
+	testCases := []struct {
+		errno    syscall.Errno
+		sentinel error
+	}{
+		{syscall.EALREADY, ErrFabricsAlreadyConnected},
+		{syscall.ECONNREFUSED, ErrFabricsUnreachable},
+		{syscall.ETIMEDOUT, ErrFabricsUnreachable},
+		{syscall.EINVAL, ErrFabricsInvalidOptions},
+	}
+	opts := &fabricsOptions{transport: "rdma", traddr: "127.0.0.1", trsvcid: "4420", nqn: "nqn.test"}
+	for _, tc := range testCases {
+		dev.errno = tc.errno
+		err := fabricsNative{}.connect(context.Background(), opts)
+		if !errors.Is(err, tc.sentinel) {
+			t.Fatalf("%s: unexpected error: %v", tc.errno, err)
+		}
+		var fabricsErr *FabricsError
+		if !errors.As(err, &fabricsErr) || fabricsErr.Errno != tc.errno || fabricsErr.Op != "connect" {
+			t.Fatalf("%s: unexpected error: %#v", tc.errno, err)
+		}
+	}
+
+	// nvme-fabrics module not loaded
+	openFabrics = func() (io.ReadWriteCloser, error) {
+		return nil, &os.PathError{Op: "open", Path: "/dev/nvme-fabrics", Err: syscall.ENOENT}
+	}
+	err := fabricsNative{}.connect(context.Background(), opts)
+	if !errors.Is(err, ErrFabricsNotSupported) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// connection made after cancelled is deleted
+func TestFabricsConnectCancelled(t *testing.T) {
+	fakeDeviceRoots(t)
+	writeSysfs(t, "class/nvme/nvme0", map[string]string{"subsysnqn": "nqn.test", "delete_controller": ""})
+	dev := &fakeFabricsDev{response: "instance=0,cntlid=1", block: make(chan struct{})}
+	fakeFabrics(t, dev)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	time.AfterFunc(100*time.Millisecond, func() { close(dev.block) })
+	opts := &fabricsOptions{transport: "tcp", traddr: "127.0.0.1", trsvcid: "4420", nqn: "nqn.test"}
+	err := fabricsNative{}.connect(ctx, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sysfsRoot, "class/nvme/nvme0/delete_controller"))
+	if err != nil || string(data) != "1" {
+		t.Fatalf("controller not deleted: %q, %v", data, err)
+	}
+
+	// failed connection needs no cleanup
+	writeSysfs(t, "class/nvme/nvme0", map[string]string{"subsysnqn": "nqn.test", "delete_controller": ""})
+	dev.errno = syscall.ECONNREFUSED
+	dev.block = make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(dev.block) })
+	err = fabricsNative{}.connect(ctx, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled: %v", err)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(sysfsRoot, "class/nvme/nvme0/delete_controller"))
+	if string(data) == "1" {
+		t.Fatal("controller should not be deleted")
+	}
+}
+
+func TestFabricsDisconnect(t *testing.T) {
+	fakeDeviceRoots(t)
+	writeSysfs(t, "class/nvme/nvme0", map[string]string{"subsysnqn": "nqn.test0", "delete_controller": ""})
+	writeSysfs(t, "class/nvme/nvme1", map[string]string{"subsysnqn": "nqn.test1", "delete_controller": ""})
+
+	err := fabricsNative{}.disconnect(context.Background(), "nqn.test1")
+	if err != nil {
+		t.Fatalf("disconnect: %s", err)
+	}
+	for ctrlr, expected := range map[string]string{"nvme0": "\n", "nvme1": "1"} {
+		data, err := ioutil.ReadFile(filepath.Join(sysfsRoot, "class/nvme", ctrlr, "delete_controller"))
+		if err != nil || string(data) != expected {
+			t.Fatalf("%s: delete_controller %q, %v", ctrlr, data, err)
+		}
+	}
+
+	// no controller connected
+	err = fabricsNative{}.disconnect(context.Background(), "nqn.test2")
+	if err != nil {
+		t.Fatalf("disconnect: %s", err)
+	}
+}
+
+func TestInitiatorNVMfConnectNative(t *testing.T) {
+	dev := &fakeFabricsDev{response: "instance=0,cntlid=1"}
+	fakeFabrics(t, dev)
+	fakeDeviceRoots(t)
+
+	nvmf := &initiatorNVMf{targetType: "TCP", targetAddr: "127.0.0.1", targetPort: "4420", nqn: "nqn.test"}
+
+	// connect failure is returned without waiting for device
+	dev.errno = syscall.ECONNREFUSED
+	_, err := nvmf.Connect(context.Background())
+	if !errors.Is(err, ErrFabricsUnreachable) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// duplicated connect goes on finding device
+	dev.errno = syscall.EALREADY
+	writeSysfs(t, "block/nvme0n1/device", map[string]string{"subsysnqn": "nqn.test"})
+	devicePath := writeDevice(t, "nvme0n1")
+	path, err := nvmf.Connect(context.Background())
+	if err != nil || path != devicePath {
+		t.Fatalf("Connect: %s, %v", path, err)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+// rpc methods needed by optional features, check with Capabilities.Require
+// before starting an operation, so it fails early without side effects
+var (
+	FeatureSnapshot  = []string{"bdev_lvol_snapshot"}
+	FeatureClone     = []string{"bdev_lvol_clone", "bdev_lvol_resize"}
+	FeatureEncrypt   = []string{"bdev_crypto_create", "bdev_crypto_delete"}
+	FeatureReplicate = []string{
+		"bdev_nvme_attach_controller", "bdev_nvme_detach_controller",
+		"bdev_raid_create", "bdev_raid_delete", "bdev_raid_get_bdevs",
+	}
+	FeatureRepair = []string{"bdev_raid_add_base_bdev"}
+)
+
+// rpc methods a node cannot work without
+var (
+	requiredLvolMethods = []string{
+		"bdev_lvol_get_lvstores", "bdev_lvol_create", "bdev_lvol_delete", "bdev_get_bdevs",
+	}
+	requiredNVMfMethods = []string{
+		"nvmf_create_transport", "nvmf_get_transports", "nvmf_create_subsystem", "nvmf_delete_subsystem",
+		"nvmf_subsystem_add_ns", "nvmf_subsystem_remove_ns", "nvmf_subsystem_add_listener",
+	}
+	requiredISCSIMethods = []string{
+		"iscsi_create_portal_group", "iscsi_get_portal_groups", "iscsi_create_initiator_group",
+		"iscsi_get_initiator_groups", "iscsi_create_target_node", "iscsi_delete_target_node",
+	}
+	requiredVhostMethods = []string{
+		"vhost_create_blk_controller", "vhost_delete_controller", "vhost_get_controllers",
+	}
+	requiredNBDMethods = []string{"nbd_start_disk", "nbd_stop_disk", "nbd_get_disks"}
+)
@@ -18,46 +18,79 @@ package util
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"k8s.io/klog"
+	"k8s.io/utils/exec"
+
+	"github.com/spdk/spdk-csi/pkg/metrics"
 )
 
-// SpdkCsiInitiator defines interface for NVMeoF/iSCSI initiator
+// SpdkCsiInitiator defines interface for NVMeoF/iSCSI/vhost/nbd initiator
 //
 // - Connect initiates target connection and returns local block device filename
-//   e.g., /dev/disk/by-id/nvme-SPDK_Controller1_SPDK00000000000001
+//   e.g., /dev/nvme0n1, found in sysfs by subsystem nqn or iscsi target, or
+//   vhost-user-blk socket path, or nbd device started on node local spdk
 // - Disconnect terminates target connection
+// - Condition reports health of the connection, e.g., NVMe controller or
+//   iSCSI session state
 //
+// - Connect and Disconnect abort when ctx is done
 // - Caller(node service) should serialize calls to same initiator
 // - Implementation should be idempotent to duplicated requests
 type SpdkCsiInitiator interface {
-	Connect() (string, error)
-	Disconnect() error
+	Connect(ctx context.Context) (string, error)
+	Disconnect(ctx context.Context) error
+	Condition() *VolumeCondition
 }
 
+// sysfs and devfs mount points, replaced in tests
+var (
+	sysfsRoot = "/sys"
+	devRoot   = "/dev"
+)
+
+// runs initiator commands(nvme, iscsiadm), replaced in tests
+var execRunner exec.Interface = exec.New()
+
 func NewSpdkCsiInitiator(volumeContext map[string]string) (SpdkCsiInitiator, error) {
 	targetType := strings.ToLower(volumeContext["targetType"])
 	switch targetType {
 	case "rdma", "tcp":
+		err := ValidateNVMfHostParams(volumeContext)
+		if err != nil {
+			return nil, err
+		}
 		return &initiatorNVMf{
 			// see util/nvmf.go VolumeInfo()
 			targetType: volumeContext["targetType"],
 			targetAddr: volumeContext["targetAddr"],
 			targetPort: volumeContext["targetPort"],
 			nqn:        volumeContext["nqn"],
-			model:      volumeContext["model"],
+			uuid:       volumeContext["uuid"],
+			hostParams: volumeContext,
 		}, nil
 	case "iscsi":
+		// portals not set by older controller or static volume
+		portals := volumeContext["portals"]
+		if portals == "" {
+			portals = net.JoinHostPort(volumeContext["targetAddr"], volumeContext["targetPort"])
+		}
 		return &initiatorISCSI{
-			targetAddr: volumeContext["targetAddr"],
-			targetPort: volumeContext["targetPort"],
-			iqn:        volumeContext["iqn"],
+			portals: strings.Split(portals, ","),
+			iqn:     volumeContext["iqn"],
 		}, nil
+	case "vhost":
+		return &initiatorVhost{socketPath: volumeContext["socketPath"]}, nil
+	case "nbd":
+		return &initiatorNBD{bdev: volumeContext["bdev"]}, nil
 	default:
 		return nil, fmt.Errorf("unknown initiator: %s", targetType)
 	}
@@ -69,120 +102,394 @@ type initiatorNVMf struct {
 	targetAddr string
 	targetPort string
 	nqn        string
-	model      string
+	uuid       string            // namespace uuid, optional
+	hostParams map[string]string // storage class parameters, see nvmfHostParams
 }
 
-func (nvmf *initiatorNVMf) Connect() (string, error) {
-	// nvme connect -t tcp -a 192.168.1.100 -s 4420 -n "nqn"
-	cmdLine := []string{"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
-		"-a", nvmf.targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn}
-	err := execWithTimeout(cmdLine, 40)
-	if err != nil {
-		// go on checking device status in case caused by duplicated request
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+func (nvmf *initiatorNVMf) Connect(ctx context.Context) (devicePath string, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("nvmf", "connect", start, err)
+	}()
+
+	err = fabrics.connect(ctx, newFabricsOptions(strings.ToLower(nvmf.targetType),
+		nvmf.targetAddr, nvmf.targetPort, nvmf.nqn, nvmf.hostParams))
+	if err != nil && !errors.Is(err, ErrFabricsAlreadyConnected) {
+		return "", err
 	}
 
-	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
-	devicePath, err := waitForDeviceReady(deviceGlob, 20)
+	devicePath, err = waitForDeviceReady(ctx, nvmf.findDevice, deviceTimeout)
 	if err != nil {
 		return "", err
 	}
 	return devicePath, nil
 }
 
-func (nvmf *initiatorNVMf) Disconnect() error {
-	// nvme disconnect -n "nqn"
-	cmdLine := []string{"nvme", "disconnect", "-n", nvmf.nqn}
-	err := execWithTimeout(cmdLine, 40)
+func (nvmf *initiatorNVMf) Disconnect(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("nvmf", "disconnect", start, err)
+	}()
+
+	err = fabrics.disconnect(ctx, nvmf.nqn)
 	if err != nil {
-		// go on checking device status in case caused by duplicate request
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+		return err
 	}
 
-	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
-	return waitForDeviceGone(deviceGlob, 20)
+	return waitForDeviceGone(ctx, nvmf.findDevice, deviceTimeout)
 }
 
-type initiatorISCSI struct {
-	targetAddr string
-	targetPort string
-	iqn        string
+func (nvmf *initiatorNVMf) findDevice() (string, error) {
+	return findNVMeDevice(nvmf.nqn, nvmf.uuid)
 }
 
-func (iscsi *initiatorISCSI) Connect() (string, error) {
-	// iscsiadm -m discovery -t sendtargets -p ip:port
-	target := iscsi.targetAddr + ":" + iscsi.targetPort
-	cmdLine := []string{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", target}
-	err := execWithTimeout(cmdLine, 40)
+// Condition checks state of NVMe controller connected to the subsystem
+func (nvmf *initiatorNVMf) Condition() *VolumeCondition {
+	// /sys/class/nvme/nvme0/{subsysnqn,state}
+	ctrlrDir, err := findSysfsDir(filepath.Join(sysfsRoot, "class/nvme/nvme*"), "subsysnqn", nvmf.nqn)
 	if err != nil {
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+		return &VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if ctrlrDir == "" {
+		return &VolumeCondition{Abnormal: true, Message: "nvme controller not found: " + nvmf.nqn}
 	}
-	// iscsiadm -m node -T "iqn" -p ip:port --login
-	cmdLine = []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--login"}
-	err = execWithTimeout(cmdLine, 40)
+	state, err := readSysfsAttr(ctrlrDir, "state")
 	if err != nil {
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+		return &VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if state != "live" {
+		return &VolumeCondition{Abnormal: true, Message: fmt.Sprintf("nvme controller %s: %s", filepath.Base(ctrlrDir), state)}
+	}
+	return &VolumeCondition{Message: "nvme controller live"}
+}
+
+// iSCSI initiator implementation, logs into all portals and returns the
+// dm-multipath device if there are more than one portal
+type initiatorISCSI struct {
+	portals []string // ip:port
+	iqn     string
+}
+
+func (iscsi *initiatorISCSI) multipath() bool {
+	return len(iscsi.portals) > 1
+}
+
+func (iscsi *initiatorISCSI) Connect(ctx context.Context) (devicePath string, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("iscsi", "connect", start, err)
+	}()
+
+	for _, portal := range iscsi.portals {
+		// iscsiadm -m discovery -t sendtargets -p ip:port
+		cmdLine := []string{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portal}
+		err = execWithTimeout(ctx, cmdLine, 40)
+		if err != nil {
+			klog.Errorf("command %v failed: %s", cmdLine, err)
+		}
+		// iscsiadm -m node -T "iqn" -p ip:port --login
+		cmdLine = []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", portal, "--login"}
+		err = execWithTimeout(ctx, cmdLine, 40)
+		if err != nil {
+			// go on with other paths, multipath device works with any path
+			klog.Errorf("command %v failed: %s", cmdLine, err)
+		}
 	}
 
-	deviceGlob := fmt.Sprintf("/dev/disk/by-path/*%s*", iscsi.iqn)
-	devicePath, err := waitForDeviceReady(deviceGlob, 20)
+	// path device must not be used with multipath configured, once mounted
+	// it cannot be claimed by multipathd
+	find := iscsi.findPath
+	if iscsi.multipath() {
+		find = iscsi.findDevice
+	}
+	devicePath, err = waitForDeviceReady(ctx, find, deviceTimeout)
 	if err != nil {
+		if iscsi.multipath() {
+			return "", fmt.Errorf("multipath device of %s not assembled, is multipathd running: %w", iscsi.iqn, err)
+		}
 		return "", err
 	}
 	return devicePath, nil
 }
 
-func (iscsi *initiatorISCSI) Disconnect() error {
-	target := iscsi.targetAddr + ":" + iscsi.targetPort
-	// iscsiadm -m node -T "iqn" -p ip:port --logout
-	cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--logout"}
-	err := execWithTimeout(cmdLine, 40)
+func (iscsi *initiatorISCSI) Disconnect(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("iscsi", "disconnect", start, err)
+	}()
+
+	// paths must not be removed under multipath device with pending io
+	if iscsi.multipath() {
+		err = iscsi.removeMultipath(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, portal := range iscsi.portals {
+		// iscsiadm -m node -T "iqn" -p ip:port --logout
+		cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", portal, "--logout"}
+		err = execWithTimeout(ctx, cmdLine, 40)
+		if err != nil {
+			klog.Errorf("command %v failed: %s", cmdLine, err)
+		}
+	}
+
+	return waitForDeviceGone(ctx, iscsi.findPath, deviceTimeout)
+}
+
+// flush buffered io and remove multipath map, no error if map not exists
+func (iscsi *initiatorISCSI) removeMultipath(ctx context.Context) error {
+	devicePath, err := iscsi.findDevice()
+	if err != nil || devicePath == "" {
+		return err
+	}
+
+	// blockdev --flushbufs /dev/mapper/mpatha
+	cmdLine := []string{"blockdev", "--flushbufs", devicePath}
+	err = execWithTimeout(ctx, cmdLine, 40)
 	if err != nil {
 		klog.Errorf("command %v failed: %s", cmdLine, err)
 	}
+	// multipath -f mpatha, fails if map is in use
+	cmdLine = []string{"multipath", "-f", filepath.Base(devicePath)}
+	err = execWithTimeout(ctx, cmdLine, 40)
+	if err != nil {
+		return fmt.Errorf("remove multipath device %s: %w", devicePath, err)
+	}
+	return nil
+}
 
-	deviceGlob := fmt.Sprintf("/dev/disk/by-path/*%s*", iscsi.iqn)
-	return waitForDeviceGone(deviceGlob, 20)
+// multipath device of all paths, spdk target exports volume as lun 0, see
+// util/iscsi.go
+func (iscsi *initiatorISCSI) findDevice() (string, error) {
+	disks, err := findISCSIDisks(iscsi.iqn, 0)
+	if err != nil || len(disks) == 0 {
+		return "", err
+	}
+	return findMultipathDevice(disks)
 }
 
-// wait for device file comes up or timeout
-func waitForDeviceReady(deviceGlob string, seconds int) (string, error) {
-	for i := 0; i <= seconds; i++ {
-		time.Sleep(time.Second)
-		matches, err := filepath.Glob(deviceGlob)
+// any scsi disk of the target, gone after logging out all paths
+func (iscsi *initiatorISCSI) findPath() (string, error) {
+	return findISCSIDevice(iscsi.iqn, 0)
+}
+
+// Condition checks state of iSCSI sessions logged into the target, abnormal
+// if any path is not logged in or multipath device is gone
+func (iscsi *initiatorISCSI) Condition() *VolumeCondition {
+	// /sys/class/iscsi_session/session1/{targetname,state}
+	sessionDirs, err := findSysfsDirs(filepath.Join(sysfsRoot, "class/iscsi_session/session*"), "targetname", iscsi.iqn)
+	if err != nil {
+		return &VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if len(sessionDirs) == 0 {
+		return &VolumeCondition{Abnormal: true, Message: "iscsi session not found: " + iscsi.iqn}
+	}
+	for _, sessionDir := range sessionDirs {
+		state, err := readSysfsAttr(sessionDir, "state")
 		if err != nil {
-			return "", err
+			return &VolumeCondition{Abnormal: true, Message: err.Error()}
+		}
+		if state != "LOGGED_IN" {
+			return &VolumeCondition{Abnormal: true, Message: fmt.Sprintf("iscsi %s: %s", filepath.Base(sessionDir), state)}
+		}
+	}
+	if len(sessionDirs) < len(iscsi.portals) {
+		return &VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("iscsi %d of %d paths logged in", len(sessionDirs), len(iscsi.portals)),
+		}
+	}
+	if iscsi.multipath() {
+		devicePath, err := iscsi.findDevice()
+		if err != nil {
+			return &VolumeCondition{Abnormal: true, Message: err.Error()}
 		}
-		// two symbol links under /dev/disk/by-id/ to same device
-		if len(matches) >= 1 {
-			return matches[0], nil
+		if devicePath == "" {
+			return &VolumeCondition{Abnormal: true, Message: "iscsi multipath device not found"}
 		}
 	}
-	return "", fmt.Errorf("timed out waiting device ready: %s", deviceGlob)
+	return &VolumeCondition{Message: "iscsi session logged in"}
 }
 
-// wait for device file gone or timeout
-func waitForDeviceGone(deviceGlob string, seconds int) error {
-	for i := 0; i <= seconds; i++ {
-		time.Sleep(time.Second)
-		matches, err := filepath.Glob(deviceGlob)
+// vhost-user-blk "initiator", no kernel block device is created, the socket of
+// vhost controller on local spdk target is passed to vm runtime as is
+type initiatorVhost struct {
+	socketPath string
+}
+
+// Connect waits for the socket and returns its path
+func (vhost *initiatorVhost) Connect(ctx context.Context) (socketPath string, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("vhost", "connect", start, err)
+	}()
+
+	return waitForDeviceReady(ctx, vhost.findSocket, deviceTimeout)
+}
+
+// Disconnect does nothing, the socket is deleted with vhost controller when
+// volume is unpublished by controller service
+func (vhost *initiatorVhost) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+func (vhost *initiatorVhost) findSocket() (string, error) {
+	info, err := os.Stat(vhost.socketPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("not a socket: %s", vhost.socketPath)
+	}
+	return vhost.socketPath, nil
+}
+
+// Condition checks the socket exists, vm side connection is not visible here
+func (vhost *initiatorVhost) Condition() *VolumeCondition {
+	socketPath, err := vhost.findSocket()
+	if err != nil {
+		return &VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if socketPath == "" {
+		return &VolumeCondition{Abnormal: true, Message: "vhost socket not found: " + vhost.socketPath}
+	}
+	return &VolumeCondition{Message: "vhost socket ready"}
+}
+
+// nbd "initiator" of node local spdk target, see SetLocalRPC
+//
+// nbd disks outlive node server, they are looked up by bdev on local spdk
+// instead of remembered, so staging is idempotent across restarts
+type initiatorNBD struct {
+	bdev string
+}
+
+// bound local rpc calls in Condition which has no request context
+const nbdQueryTimeout = 10 * time.Second
+
+// Connect starts nbd disk on local spdk if bdev is not exported yet
+func (nbd *initiatorNBD) Connect(ctx context.Context) (devicePath string, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("nbd", "connect", start, err)
+	}()
+
+	client, err := localSpdk(ctx)
+	if err != nil {
+		return "", err
+	}
+	nbdDevice, err := findNbdDisk(ctx, client, nbd.bdev)
+	if err != nil {
+		return "", err
+	}
+	if nbdDevice == "" {
+		nbdDevice, err = client.NbdStartDisk(ctx, nbd.bdev, "")
 		if err != nil {
-			return err
+			return "", err
 		}
-		if len(matches) == 0 {
-			return nil
+		klog.Infof("nbd disk started: %s, bdev: %s", nbdDevice, nbd.bdev)
+	}
+
+	return waitForDeviceReady(ctx, func() (string, error) {
+		return findNbdDevice(nbdDevice)
+	}, deviceTimeout)
+}
+
+// Disconnect stops nbd disk of the bdev, if any
+func (nbd *initiatorNBD) Disconnect(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveInitiator("nbd", "disconnect", start, err)
+	}()
+
+	client, err := localSpdk(ctx)
+	if err != nil {
+		return err
+	}
+	nbdDevice, err := findNbdDisk(ctx, client, nbd.bdev)
+	if err != nil || nbdDevice == "" {
+		return err
+	}
+	err = client.NbdStopDisk(ctx, nbdDevice)
+	if err != nil {
+		return err
+	}
+	klog.Infof("nbd disk stopped: %s, bdev: %s", nbdDevice, nbd.bdev)
+
+	return waitForDeviceGone(ctx, func() (string, error) {
+		return findNbdDevice(nbdDevice)
+	}, deviceTimeout)
+}
+
+// Condition checks the bdev is still exported, e.g., not lost on spdk restart
+func (nbd *initiatorNBD) Condition() *VolumeCondition {
+	ctx, cancel := context.WithTimeout(context.Background(), nbdQueryTimeout)
+	defer cancel()
+
+	client, err := localSpdk(ctx)
+	if err != nil {
+		return &VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	nbdDevice, err := findNbdDisk(ctx, client, nbd.bdev)
+	if err != nil {
+		return &VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if nbdDevice == "" {
+		return &VolumeCondition{Abnormal: true, Message: "nbd disk not found: " + nbd.bdev}
+	}
+	return &VolumeCondition{Message: "nbd disk " + nbdDevice + " started"}
+}
+
+// find sysfs directory matching the glob whose attribute equals value
+// returns empty string if not found
+func findSysfsDir(dirGlob, attr, value string) (string, error) {
+	dirs, err := findSysfsDirs(dirGlob, attr, value)
+	if err != nil || len(dirs) == 0 {
+		return "", err
+	}
+	return dirs[0], nil
+}
+
+// find all sysfs directories matching the glob whose attribute equals value
+func findSysfsDirs(dirGlob, attr, value string) ([]string, error) {
+	dirs, err := filepath.Glob(dirGlob)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, dir := range dirs {
+		v, err := readSysfsAttr(dir, attr)
+		if err != nil {
+			continue // device may be gone
 		}
+		if v == value {
+			found = append(found, dir)
+		}
+	}
+	return found, nil
+}
+
+func readSysfsAttr(dir, attr string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return "", err
 	}
-	return fmt.Errorf("timed out waiting device gone: %s", deviceGlob)
+	return strings.TrimSpace(string(data)), nil
 }
 
-// exec shell command with timeout(in seconds)
-func execWithTimeout(cmdLine []string, timeout int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+// exec shell command with timeout(in seconds), command is killed if
+// parent ctx is done
+func execWithTimeout(parent context.Context, cmdLine []string, timeout int) error {
+	ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Second)
 	defer cancel()
 
 	klog.Infof("running command: %v", cmdLine)
-	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
+	cmd := execRunner.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
 	output, err := cmd.CombinedOutput()
 
 	if ctx.Err() == context.DeadlineExceeded {
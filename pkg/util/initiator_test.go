@@ -18,8 +18,17 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
 )
 
 func TestExecWithTimeoutPositive(t *testing.T) {
@@ -54,7 +63,251 @@ func TestExecWithTimeoutTimeout(t *testing.T) {
 
 func runExecWithTimeout(cmdLine []string, timeout int) (int, error) {
 	start := time.Now()
-	err := execWithTimeout(cmdLine, timeout)
+	err := execWithTimeout(context.Background(), cmdLine, timeout)
 	elapsed := int(time.Since(start) / time.Second)
 	return elapsed, err
 }
+
+func TestInitiatorCondition(t *testing.T) {
+	var err error
+	sysfsRoot, err = ioutil.TempDir("", "spdkcsi-sysfs*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(sysfsRoot)
+		sysfsRoot = "/sys"
+	}()
+
+	nvmf := &initiatorNVMf{nqn: "nqn.2020-04.io.spdk.csi:uuid:test"}
+	iscsi := &initiatorISCSI{iqn: "iqn.2016-06.io.spdk:test"}
+
+	// not connected
+	if !nvmf.Condition().Abnormal || !iscsi.Condition().Abnormal {
+		t.Fatal("should be abnormal")
+	}
+
+	writeSysfs(t, "class/nvme/nvme0", map[string]string{"subsysnqn": "nqn.other", "state": "live"})
+	writeSysfs(t, "class/nvme/nvme1", map[string]string{"subsysnqn": nvmf.nqn, "state": "connecting"})
+	writeSysfs(t, "class/iscsi_session/session1", map[string]string{"targetname": iscsi.iqn, "state": "FAILED"})
+	if !nvmf.Condition().Abnormal || !iscsi.Condition().Abnormal {
+		t.Fatal("should be abnormal")
+	}
+
+	writeSysfs(t, "class/nvme/nvme1", map[string]string{"state": "live"})
+	writeSysfs(t, "class/iscsi_session/session1", map[string]string{"state": "LOGGED_IN"})
+	if nvmf.Condition().Abnormal || iscsi.Condition().Abnormal {
+		t.Fatal("should be normal")
+	}
+}
+
+func writeSysfs(t *testing.T, dir string, attrs map[string]string) {
+	dir = filepath.Join(sysfsRoot, dir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attr, value := range attrs {
+		err = ioutil.WriteFile(filepath.Join(dir, attr), []byte(value+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInitiatorNVMfConnect(t *testing.T) {
+	var commands [][]string
+	execRunner = fakeExec(&commands)
+	fabrics = fabricsCLI{}
+	defer func() {
+		execRunner = exec.New()
+		fabrics = fabricsNative{}
+	}()
+	fakeDeviceRoots(t)
+
+	initiator, err := NewSpdkCsiInitiator(map[string]string{
+		"targetType": "TCP",
+		"targetAddr": "127.0.0.1",
+		"targetPort": "4420",
+		"nqn":        "nqn.2020-04.io.spdk.csi:uuid:test",
+		"model":      "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// namespace shows up after connect
+	writeSysfs(t, "block/nvme0n1/device", map[string]string{"subsysnqn": "nqn.2020-04.io.spdk.csi:uuid:test"})
+	devicePath := writeDevice(t, "nvme0n1")
+	path, err := initiator.Connect(context.Background())
+	if err != nil || path != devicePath {
+		t.Fatalf("Connect: %s, %v", path, err)
+	}
+
+	// namespace is gone after disconnect
+	os.RemoveAll(filepath.Join(sysfsRoot, "block/nvme0n1"))
+	err = initiator.Disconnect(context.Background())
+	if err != nil {
+		t.Fatalf("Disconnect: %s", err)
+	}
+
+	expected := [][]string{
+		{"nvme", "connect", "-t", "tcp", "-a", "127.0.0.1", "-s", "4420", "-n", "nqn.2020-04.io.spdk.csi:uuid:test"},
+		{"nvme", "disconnect", "-n", "nqn.2020-04.io.spdk.csi:uuid:test"},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("unexpected commands: %v", commands)
+	}
+}
+
+func TestInitiatorDeviceTimeout(t *testing.T) {
+	var commands [][]string
+	execRunner = fakeExec(&commands)
+	defer func() {
+		execRunner = exec.New()
+	}()
+	fakeDeviceRoots(t)
+
+	iscsi := &initiatorISCSI{portals: []string{"127.0.0.1:3260"}, iqn: "iqn.2016-06.io.spdk:test"}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := iscsi.Connect(ctx)
+	if err == nil {
+		t.Fatal("should fail without device")
+	}
+	if len(commands) != 2 || commands[0][0] != "iscsiadm" || commands[1][len(commands[1])-1] != "--login" {
+		t.Fatalf("unexpected commands: %v", commands)
+	}
+}
+
+func TestInitiatorISCSIMultipath(t *testing.T) {
+	var commands [][]string
+	execRunner = fakeExec(&commands)
+	defer func() {
+		execRunner = exec.New()
+	}()
+	fakeDeviceRoots(t)
+
+	const iqn = "iqn.2016-06.io.spdk:test"
+	initiator, err := NewSpdkCsiInitiator(map[string]string{
+		"targetType": "iscsi",
+		"targetAddr": "10.0.0.1",
+		"targetPort": "3260",
+		"portals":    "10.0.0.1:3260,10.0.1.1:3260",
+		"iqn":        iqn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two paths assembled into one multipath device
+	for i, disk := range []string{"sdb", "sdc"} {
+		session := fmt.Sprintf("class/iscsi_session/session%d", i+1)
+		writeSysfs(t, session, map[string]string{"targetname": iqn, "state": "LOGGED_IN"})
+		writeSysfs(t, fmt.Sprintf("%s/device/target%d:0:0/%d:0:0:0/block/%s", session, i+2, i+2, disk), nil)
+		writeSysfs(t, "block/"+disk+"/holders/dm-0", nil)
+		writeDevice(t, disk)
+	}
+	writeSysfs(t, "block/dm-0/dm", map[string]string{"uuid": "mpath-360000000000000000e00000000010001", "name": "mpatha"})
+	err = os.MkdirAll(filepath.Join(devRoot, "mapper"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devicePath := writeDevice(t, "mapper/mpatha")
+
+	path, err := initiator.Connect(context.Background())
+	if err != nil || path != devicePath {
+		t.Fatalf("Connect: %s, %v", path, err)
+	}
+	if condition := initiator.Condition(); condition.Abnormal {
+		t.Fatalf("should be normal: %s", condition.Message)
+	}
+
+	// map is removed before logging out all paths
+	os.Remove(filepath.Join(devRoot, "sdb"))
+	os.Remove(filepath.Join(devRoot, "sdc"))
+	err = initiator.Disconnect(context.Background())
+	if err != nil {
+		t.Fatalf("Disconnect: %s", err)
+	}
+
+	expected := [][]string{
+		{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", "10.0.0.1:3260"},
+		{"iscsiadm", "-m", "node", "-T", iqn, "-p", "10.0.0.1:3260", "--login"},
+		{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", "10.0.1.1:3260"},
+		{"iscsiadm", "-m", "node", "-T", iqn, "-p", "10.0.1.1:3260", "--login"},
+		{"blockdev", "--flushbufs", devicePath},
+		{"multipath", "-f", "mpatha"},
+		{"iscsiadm", "-m", "node", "-T", iqn, "-p", "10.0.0.1:3260", "--logout"},
+		{"iscsiadm", "-m", "node", "-T", iqn, "-p", "10.0.1.1:3260", "--logout"},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("unexpected commands: %v", commands)
+	}
+
+	// one path lost
+	writeSysfs(t, "class/iscsi_session/session2", map[string]string{"targetname": "iqn.other"})
+	if condition := initiator.Condition(); !condition.Abnormal {
+		t.Fatal("should be abnormal with one path")
+	}
+}
+
+func TestInitiatorISCSIMultipathNotAssembled(t *testing.T) {
+	var commands [][]string
+	execRunner = fakeExec(&commands)
+	defer func() {
+		execRunner = exec.New()
+	}()
+	fakeDeviceRoots(t)
+
+	const iqn = "iqn.2016-06.io.spdk:test"
+	iscsi := &initiatorISCSI{portals: []string{"10.0.0.1:3260", "10.0.1.1:3260"}, iqn: iqn}
+
+	// both paths logged in, no multipathd to assemble the map
+	for i, disk := range []string{"sdb", "sdc"} {
+		session := fmt.Sprintf("class/iscsi_session/session%d", i+1)
+		writeSysfs(t, session, map[string]string{"targetname": iqn, "state": "LOGGED_IN"})
+		writeSysfs(t, fmt.Sprintf("%s/device/target%d:0:0/%d:0:0:0/block/%s", session, i+2, i+2, disk), nil)
+		writeDevice(t, disk)
+	}
+
+	// single path device is never returned
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	path, err := iscsi.Connect(ctx)
+	if err == nil {
+		t.Fatalf("should fail without multipath device: %s", path)
+	}
+	if condition := iscsi.Condition(); !condition.Abnormal {
+		t.Fatal("should be abnormal without multipath device")
+	}
+
+	// no map to remove, paths logged out
+	os.Remove(filepath.Join(devRoot, "sdb"))
+	os.Remove(filepath.Join(devRoot, "sdc"))
+	err = iscsi.Disconnect(context.Background())
+	if err != nil {
+		t.Fatalf("Disconnect: %s", err)
+	}
+	for _, cmdLine := range commands {
+		if cmdLine[0] == "multipath" || cmdLine[0] == "blockdev" {
+			t.Fatalf("unexpected command: %v", cmdLine)
+		}
+	}
+}
+
+// fake exec runner records command lines and always succeeds
+func fakeExec(commands *[][]string) *testingexec.FakeExec {
+	fake := &testingexec.FakeExec{}
+	for i := 0; i < 10; i++ {
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			*commands = append(*commands, append([]string{cmd}, args...))
+			return &testingexec.FakeCmd{
+				CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) { return nil, nil, nil },
+				},
+			}
+		})
+	}
+	return fake
+}
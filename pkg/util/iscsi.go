@@ -16,10 +16,14 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"net"
+	"strings"
 
 	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
 )
 
 const (
@@ -31,179 +35,141 @@ const (
 )
 
 type nodeISCSI struct {
-	client     *rpcClient
-	targetAddr string
+	lvolNode
+	targetAddr string // first portal
 	targetPort string
-	lvols      map[string]*lvolISCSI
-	mtx        sync.Mutex // for concurrent access to lvols map
+	portals    []spdkrpc.IscsiPortal // client node logs into all portals with multipath
 }
 
 type lvolISCSI struct {
 	published bool
+	bdevStack
 }
 
 func (lvol *lvolISCSI) reset() {
 	lvol.published = false
 }
 
+// targetAddr is comma separated portal IPs, e.g., "10.0.0.1,10.0.1.1"
 func newISCSI(client *rpcClient, targetAddr string) *nodeISCSI {
-	return &nodeISCSI{
-		client:     client,
-		targetAddr: targetAddr,
-		targetPort: cfgISCSISvcPort,
-		lvols:      make(map[string]*lvolISCSI),
+	var portals []spdkrpc.IscsiPortal
+	for _, host := range strings.Split(targetAddr, ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			portals = append(portals, spdkrpc.IscsiPortal{Host: host, Port: cfgISCSISvcPort})
+		}
+	}
+	if len(portals) == 0 {
+		portals = []spdkrpc.IscsiPortal{{Host: targetAddr, Port: cfgISCSISvcPort}}
 	}
-}
 
-func (node *nodeISCSI) Info() string {
-	return node.client.info()
+	return &nodeISCSI{
+		lvolNode: newLvolNode(client, func() lvolState {
+			return &lvolISCSI{}
+		}),
+		targetAddr: portals[0].Host,
+		targetPort: portals[0].Port,
+		portals:    portals,
+	}
 }
 
-func (node *nodeISCSI) LvStores() ([]LvStore, error) {
-	return node.client.lvStores()
+func (node *nodeISCSI) lvol(lvolID string) *lvolISCSI {
+	lvol, _ := node.lookup(lvolID).(*lvolISCSI)
+	return lvol
 }
 
 // VolumeInfo returns a string:string map containing information necessary
 // for CSI node(initiator) to connect to this target and identify the disk.
 func (node *nodeISCSI) VolumeInfo(lvolID string) (map[string]string, error) {
-	node.mtx.Lock()
-	_, exists := node.lvols[lvolID]
-	node.mtx.Unlock()
-
-	if !exists {
+	if node.lvol(lvolID) == nil {
 		return nil, fmt.Errorf("volume not exists: %s", lvolID)
 	}
 
+	portals := make([]string, len(node.portals))
+	for i, portal := range node.portals {
+		portals[i] = net.JoinHostPort(portal.Host, portal.Port)
+	}
+
 	return map[string]string{
 		"targetAddr": node.targetAddr,
 		"targetPort": node.targetPort,
+		"portals":    strings.Join(portals, ","),
 		"iqn":        iqnPrefixName + lvolID,
 		"targetType": "iscsi",
 	}, nil
 }
 
-// CreateVolume creates a logical volume and returns volume ID
-func (node *nodeISCSI) CreateVolume(lvsName string, sizeMiB int64) (string, error) {
-	lvolID, err := node.client.createVolume(lvsName, sizeMiB)
-	if err != nil {
-		return "", err
-	}
-
-	node.mtx.Lock()
-	defer node.mtx.Unlock()
-
-	_, exists := node.lvols[lvolID]
-	if exists {
-		return "", fmt.Errorf("volume ID already exists: %s", lvolID)
-	}
-	node.lvols[lvolID] = &lvolISCSI{}
-
-	klog.V(5).Infof("volume created: %s", lvolID)
-	return lvolID, nil
-}
-
-func (node *nodeISCSI) CreateSnapshot(lvolName, snapshotName string) (string, error) {
-	snapshotID, err := node.client.snapshot(lvolName, snapshotName)
-	if err != nil {
-		return "", err
-	}
-
-	klog.V(5).Infof("snapshot created: %s", snapshotID)
-	return snapshotID, nil
-}
-
-func (node *nodeISCSI) DeleteVolume(lvolID string) error {
-	err := node.client.deleteVolume(lvolID)
-	if err != nil {
-		return err
-	}
-
-	node.mtx.Lock()
-	defer node.mtx.Unlock()
-
-	delete(node.lvols, lvolID)
-
-	klog.V(5).Infof("volume deleted: %s", lvolID)
-	return nil
-}
-
 // PublishVolume exports a volume through ISCSI target
-func (node *nodeISCSI) PublishVolume(lvolID string) error {
+func (node *nodeISCSI) PublishVolume(ctx context.Context, lvolID string) error {
 	var err error
 
-	node.mtx.Lock()
-	lvol, exists := node.lvols[lvolID]
-	node.mtx.Unlock()
-
-	if !exists {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
 		return ErrVolumeDeleted
 	}
 	if lvol.published {
 		return ErrVolumePublished
 	}
 
-	err = node.createPortalGroup()
+	err = node.createPortalGroup(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = node.createInitiatorGroup()
+	err = node.createInitiatorGroup(ctx)
 	if err != nil {
 		return err
 	}
 	// lvolID is unique and can be used as the target name
 	var targetName = lvolID
-	err = node.iscsiCreateTargetNode(targetName, lvolID)
+	err = node.iscsiCreateTargetNode(ctx, targetName, lvol.bdevName(lvolID))
 	if err != nil {
 		return err
 	}
 
-	node.lvols[lvolID].published = true
+	lvol.published = true
 	return nil
 }
 
-func (node *nodeISCSI) createPortalGroup() error {
-	err := node.iscsiGetPortalGroups()
+func (node *nodeISCSI) createPortalGroup(ctx context.Context) error {
+	err := node.iscsiGetPortalGroups(ctx)
 	if err == nil {
 		return nil // port group already exists
 	}
 
-	err = node.iscsiCreatePortalGroup()
+	err = node.iscsiCreatePortalGroup(ctx)
 	if err == nil {
 		return nil // creation succeeds
 	}
 	// we may fail due to concurrent calls, check portal group availability again
-	return node.iscsiGetPortalGroups()
+	return node.iscsiGetPortalGroups(ctx)
 }
 
-func (node *nodeISCSI) createInitiatorGroup() error {
-	err := node.iscsiGetInitiatorGroups()
+func (node *nodeISCSI) createInitiatorGroup(ctx context.Context) error {
+	err := node.iscsiGetInitiatorGroups(ctx)
 	if err == nil {
 		return nil
 	}
 
-	err = node.iscsiCreateInitiatorGroup([]string{"ANY"}, []string{"ANY"})
+	err = node.iscsiCreateInitiatorGroup(ctx, []string{"ANY"}, []string{"ANY"})
 	if err == nil {
 		return nil
 	}
 
-	return node.iscsiGetInitiatorGroups()
+	return node.iscsiGetInitiatorGroups(ctx)
 }
 
-func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
+func (node *nodeISCSI) UnpublishVolume(ctx context.Context, lvolID string) error {
 	var err error
-	node.mtx.Lock()
-	lvol, exists := node.lvols[lvolID]
-	node.mtx.Unlock()
-
-	if !exists {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
 		return ErrVolumeDeleted
 	}
 	if !lvol.published {
 		return ErrVolumeUnpublished
 	}
 
-	err = node.iscsiDeleteTargetNode(lvolID)
+	err = node.iscsiDeleteTargetNode(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -214,111 +180,42 @@ func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
 }
 
 // Add a portal group
-func (node *nodeISCSI) iscsiCreatePortalGroup() error {
-	type Portals struct {
-		Host string `json:"host"`
-		Port string `json:"port"`
-	}
-	params := struct {
-		Portals []Portals `json:"portals"`
-		Tag     int       `json:"tag"`
-	}{
-		Portals: []Portals{{node.targetAddr, node.targetPort}},
+func (node *nodeISCSI) iscsiCreatePortalGroup(ctx context.Context) error {
+	return node.client.IscsiCreatePortalGroup(ctx, &spdkrpc.IscsiPortalGroup{
+		Portals: node.portals,
 		Tag:     numberPortalGroupTag,
-	}
-	var result bool
-	err := node.client.call("iscsi_create_portal_group", &params, &result)
-	if err != nil {
-		return err
-	}
-	if !result {
-		return fmt.Errorf("create iscsi portal group failure")
-	}
-	return nil
+	})
 }
 
 // Add an initiator group
-func (node *nodeISCSI) iscsiCreateInitiatorGroup(initiators, netmasks []string) error {
-	params := struct {
-		Initiators []string `json:"initiators"`
-		Tag        int      `json:"tag"`
-		Netmasks   []string `json:"netmasks"`
-	}{
+func (node *nodeISCSI) iscsiCreateInitiatorGroup(ctx context.Context, initiators, netmasks []string) error {
+	return node.client.IscsiCreateInitiatorGroup(ctx, &spdkrpc.IscsiInitiatorGroup{
 		Initiators: initiators,
 		Tag:        numberInitiatorGroupTag,
 		Netmasks:   netmasks,
-	}
-	var result bool
-	err := node.client.call("iscsi_create_initiator_group", &params, &result)
-	if err != nil {
-		return err
-	}
-	if !result {
-		return fmt.Errorf("create iscsi initiator group failure")
-	}
-	return nil
+	})
 }
 
 // Add an iSCSI target node
-func (node *nodeISCSI) iscsiCreateTargetNode(targetName, bdevName string) error {
-	type Luns struct {
-		LunID    int    `json:"lun_id"`
-		BdevName string `json:"bdev_name"`
-	}
-	type PgIgMaps struct {
-		IgTag int `json:"ig_tag"`
-		PgTag int `json:"pg_tag"`
-	}
-	params := struct {
-		Luns        []Luns     `json:"luns"`
-		Name        string     `json:"name"`
-		AliasName   string     `json:"alias_name"`
-		PgIgMaps    []PgIgMaps `json:"pg_ig_maps"`
-		DisableChap bool       `json:"disable_chap"`
-		QueueDepth  int        `json:"queue_depth"`
-	}{
-		Luns:        []Luns{{0, bdevName}},
+func (node *nodeISCSI) iscsiCreateTargetNode(ctx context.Context, targetName, bdevName string) error {
+	return node.client.IscsiCreateTargetNode(ctx, &spdkrpc.IscsiCreateTargetNodeParams{
+		Luns:        []spdkrpc.IscsiLun{{LunID: 0, BdevName: bdevName}},
 		Name:        targetName,
 		AliasName:   "iscsi-" + bdevName,
-		PgIgMaps:    []PgIgMaps{{numberPortalGroupTag, numberInitiatorGroupTag}},
+		PgIgMaps:    []spdkrpc.IscsiPgIgMap{{IgTag: numberInitiatorGroupTag, PgTag: numberPortalGroupTag}},
 		DisableChap: true,
 		QueueDepth:  targetQueueDepth,
-	}
-	var result bool
-	err := node.client.call("iscsi_create_target_node", &params, &result)
-	if err != nil {
-		return err
-	}
-	if !result {
-		return fmt.Errorf("create iscsi target node failure")
-	}
-	return nil
+	})
 }
 
 // Delete an iSCSI target node
-func (node *nodeISCSI) iscsiDeleteTargetNode(targetName string) error {
-	params := struct {
-		Name string `json:"name"`
-	}{
-		Name: iqnPrefixName + targetName,
-	}
-	var result bool
-	err := node.client.call("iscsi_delete_target_node", &params, &result)
-	if err != nil {
-		return err
-	}
-	if !result {
-		return fmt.Errorf("delete iscsi target node failure")
-	}
-	return nil
+func (node *nodeISCSI) iscsiDeleteTargetNode(ctx context.Context, targetName string) error {
+	return node.client.IscsiDeleteTargetNode(ctx, iqnPrefixName+targetName)
 }
 
 // Check if portal group is available
-func (node *nodeISCSI) iscsiGetPortalGroups() error {
-	var results []struct {
-		Tag int `json:"tag"`
-	}
-	err := node.client.call("iscsi_get_portal_groups", nil, &results)
+func (node *nodeISCSI) iscsiGetPortalGroups(ctx context.Context) error {
+	results, err := node.client.IscsiGetPortalGroups(ctx)
 	if err != nil {
 		return err
 	}
@@ -330,11 +227,8 @@ func (node *nodeISCSI) iscsiGetPortalGroups() error {
 	return fmt.Errorf("port group not available")
 }
 
-func (node *nodeISCSI) iscsiGetInitiatorGroups() error {
-	var results []struct {
-		Tag int `json:"tag"`
-	}
-	err := node.client.call("iscsi_get_initiator_groups", nil, &results)
+func (node *nodeISCSI) iscsiGetInitiatorGroups(ctx context.Context) error {
+	results, err := node.client.IscsiGetInitiatorGroups(ctx)
 	if err != nil {
 		return err
 	}
@@ -17,19 +17,23 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
 )
 
 const (
-	rpcURLISCSI  = "http://127.0.0.1:9009"
 	rpcUserISCSI = "spdkcsiuser"
 	rpcPassISCSI = "spdkcsipass"
 	trAddrISCSI  = "127.0.0.1"
 )
 
 func TestISCSI(t *testing.T) {
-	nodeIx, err := NewSpdkNode(rpcURLISCSI, rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI)
+	nodeIx, err := NewSpdkNode(testRPCURL(t), rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI, nil)
 	if err != nil {
 		t.Fatalf("NewSpdkNode: %s", err)
 	}
@@ -38,7 +42,9 @@ func TestISCSI(t *testing.T) {
 		t.Fatal("cannot cast to nodeISCSI")
 	}
 
-	lvs, err := node.LvStores()
+	ctx := context.Background()
+
+	lvs, err := node.LvStores(ctx)
 	if err != nil {
 		t.Fatalf("LvStores: %s", err)
 	}
@@ -49,7 +55,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("No free space: %s", lvs[0].Name)
 	}
 
-	lvolID, err := node.CreateVolume(lvs[0].Name, lvs[0].FreeSizeMiB)
+	lvolID, err := node.CreateVolume(ctx, lvs[0].Name, lvs[0].FreeSizeMiB)
 	if err != nil {
 		t.Fatalf("CreateVolume: %s", err)
 	}
@@ -58,7 +64,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("validateVolumeCreated: %s", err)
 	}
 
-	err = node.PublishVolume(lvolID)
+	err = node.PublishVolume(ctx, lvolID)
 	if err != nil {
 		t.Fatalf("PublishVolume: %s", err)
 	}
@@ -71,7 +77,7 @@ func TestISCSI(t *testing.T) {
 
 	snapshotName := "snapshot-pvc"
 	var snapshotID string
-	snapshotID, err = node.CreateSnapshot(lvolID, snapshotName)
+	snapshotID, err = node.CreateSnapshot(ctx, lvolID, snapshotName, false)
 	if err != nil {
 		t.Fatalf("CreateSnapshot: %s", err)
 	}
@@ -80,7 +86,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("validateCreateSnapshot: %s", err)
 	}
 
-	err = node.DeleteVolume(snapshotID)
+	err = node.DeleteVolume(ctx, snapshotID)
 	if err != nil {
 		t.Fatalf("DeleteSnapshot: %s", err)
 	}
@@ -89,12 +95,12 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("validateSnapshotDeleted: %s", err)
 	}
 
-	err = node.UnpublishVolume(lvolID)
+	err = node.UnpublishVolume(ctx, lvolID)
 	if err != nil {
 		t.Fatalf("UnpublishVolume: %s", err)
 	}
 
-	err = node.DeleteVolume(lvolID)
+	err = node.DeleteVolume(ctx, lvolID)
 	if err != nil {
 		t.Fatalf("DeleteVolume: %s", err)
 	}
@@ -105,6 +111,52 @@ func TestISCSI(t *testing.T) {
 	}
 }
 
+func TestISCSIMultiPortal(t *testing.T) {
+	nodeIx, err := NewSpdkNode(testRPCURL(t), rpcUserISCSI, rpcPassISCSI, "iscsi", "127.0.0.1, 127.0.0.2", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+	node := nodeIx.(*nodeISCSI)
+	ctx := context.Background()
+
+	lvs, err := node.LvStores(ctx)
+	if err != nil || len(lvs) == 0 {
+		t.Fatalf("LvStores: %v, %v", lvs, err)
+	}
+	lvolID, err := node.CreateVolume(ctx, lvs[0].Name, 4)
+	if err != nil {
+		t.Fatalf("CreateVolume: %s", err)
+	}
+	defer node.DeleteVolume(ctx, lvolID) // nolint:errcheck // cleanup
+	err = node.PublishVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("PublishVolume: %s", err)
+	}
+	defer node.UnpublishVolume(ctx, lvolID) // nolint:errcheck // cleanup
+
+	info, err := node.VolumeInfo(lvolID)
+	if err != nil {
+		t.Fatalf("VolumeInfo: %s", err)
+	}
+	if info["portals"] != "127.0.0.1:3260,127.0.0.2:3260" || info["targetAddr"] != "127.0.0.1" {
+		t.Fatalf("unexpected volume info: %v", info)
+	}
+
+	// portal group may be created by other tests on real spdk target
+	if os.Getenv(spdkrpctest.EnvRPCURL) != "" {
+		return
+	}
+	groups, err := node.client.IscsiGetPortalGroups(ctx)
+	if err != nil {
+		t.Fatalf("IscsiGetPortalGroups: %s", err)
+	}
+	for _, group := range groups {
+		if group.Tag == numberPortalGroupTag && len(group.Portals) != 2 {
+			t.Fatalf("unexpected portals: %v", group.Portals)
+		}
+	}
+}
+
 func iscsiValidateVolumeDeleted(node *nodeISCSI, lvolID string) error {
 	if iscsiValidateVolumeCreated(node, lvolID) == nil {
 		return fmt.Errorf("volume not deleted")
@@ -113,18 +165,7 @@ func iscsiValidateVolumeDeleted(node *nodeISCSI, lvolID string) error {
 }
 
 func iscsiValidateVolumeCreated(node *nodeISCSI, lvolID string) error {
-	params := struct {
-		Name string `json:"name"`
-	}{
-		Name: lvolID,
-	}
-
-	var result []struct {
-		BlockSize int64 `json:"block_size"`
-		NumBlocks int64 `json:"num_blocks"`
-	}
-
-	err := node.client.call("bdev_get_bdevs", &params, &result)
+	result, err := node.client.BdevGetBdevs(context.Background(), &spdkrpc.BdevGetBdevsParams{Name: lvolID})
 	if err != nil {
 		return err
 	}
@@ -138,11 +179,7 @@ func iscsiValidateVolumeCreated(node *nodeISCSI, lvolID string) error {
 
 func iscsiValidateVolumePublished(node *nodeISCSI, lvolID string) error {
 	iqn := "iqn.2016-06.io.spdk:" + lvolID
-	var result []struct {
-		Name string `json:"name"`
-	}
-
-	err := node.client.call("iscsi_get_target_nodes", nil, &result)
+	result, err := node.client.IscsiGetTargetNodes(context.Background())
 	if err != nil {
 		return err
 	}
@@ -17,16 +17,18 @@ limitations under the License.
 package util
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"net/http"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/spdk/spdk-csi/pkg/metrics"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
 )
 
 // SpdkNode defines interface for SPDK storage node
@@ -36,6 +38,17 @@ import (
 // - VolumeInfo returns a string map to be passed to client node. Client node
 //   needs these info to mount the target. E.g, target IP, service port, nqn.
 // - Create/Delete/Publish/UnpublishVolume per CSI controller service spec.
+// - EncryptVolume stacks a crypto bdev on the volume, ReplicateVolume builds
+//   raid1 over the volume and remote replicas. PublishVolume exports the
+//   topmost bdev, DeleteVolume tears down the stack from top to bottom.
+// - CloneVolume creates a writable volume from a snapshot. Snapshot of an
+//   encrypted volume is marked as encrypted on spdk target, SnapshotEncrypted
+//   reads the mark back so clones cannot lose encryption.
+// - Capabilities probes spdk target on first use and returns its version and
+//   supported rpc methods, optional features should be checked before use.
+// - VolumeCondition reports volume health, RepairVolume reattaches lost
+//   replicas and starts rebuild.
+// - SetTLSConfig replaces certificates of https rpcURL, e.g., on renewal.
 //
 // NOTE: concurrency, idempotency, message ordering
 //
@@ -72,15 +85,28 @@ import (
 // an already deleted volume. The baseline is there should be no code crash or
 // data corruption under these conditions. Implementation may try to detect and
 // report errors if possible.
+//
+// Context:
+// All methods talking to spdk target accept a context, normally the context of
+// the CSI request. Pending rpc calls are abandoned when the context is done, and
+// each call is further bounded by its per method timeout, see spdkrpc.Timeouts.
 type SpdkNode interface {
 	Info() string
-	LvStores() ([]LvStore, error)
+	LvStores(ctx context.Context) ([]LvStore, error)
 	VolumeInfo(lvolID string) (map[string]string, error)
-	CreateVolume(lvsName string, sizeMiB int64) (string, error)
-	DeleteVolume(lvolID string) error
-	PublishVolume(lvolID string) error
-	UnpublishVolume(lvolID string) error
-	CreateSnapshot(lvolName, snapshotName string) (string, error)
+	CreateVolume(ctx context.Context, lvsName string, sizeMiB int64) (string, error)
+	DeleteVolume(ctx context.Context, lvolID string) error
+	PublishVolume(ctx context.Context, lvolID string) error
+	UnpublishVolume(ctx context.Context, lvolID string) error
+	CreateSnapshot(ctx context.Context, lvolName, snapshotName string, encrypted bool) (string, error)
+	SnapshotEncrypted(ctx context.Context, snapshotID string) (bool, error)
+	EncryptVolume(ctx context.Context, lvolID string, key *CryptoKey) error
+	ReplicateVolume(ctx context.Context, lvolID string, replicas []map[string]string) error
+	CloneVolume(ctx context.Context, snapshotID string, sizeMiB int64) (string, error)
+	Capabilities(ctx context.Context) (*spdkrpc.Capabilities, error)
+	VolumeCondition(ctx context.Context, lvolID string) (*VolumeCondition, error)
+	RepairVolume(ctx context.Context, lvolID string) error
+	SetTLSConfig(config *spdkrpc.TLSConfig) error
 }
 
 // logical volume store
@@ -90,61 +116,100 @@ type LvStore struct {
 	FreeSizeMiB  int64
 }
 
-// errors deserve special care
-var (
-	// json response errors: errors.New("json: tag-string")
-	// matches if "tag-string" founded in json error string
-	ErrJSONNoSpaceLeft  = errors.New("json: No space left")
-	ErrJSONNoSuchDevice = errors.New("json: No such device")
+// key material of an encrypted volume, see bdev_crypto_create
+type CryptoKey struct {
+	Cipher string // AES_CBC, AES_XTS
+	Key    string
+	Key2   string // AES_XTS only
+}
 
-	// internal errors
+// errors deserve special care, spdk rpc errors are in package spdkrpc
+var (
 	ErrVolumeDeleted     = errors.New("volume deleted")
 	ErrVolumePublished   = errors.New("volume already published")
 	ErrVolumeUnpublished = errors.New("volume not published")
 )
 
-// jsonrpc http proxy
+// spdk rpc client with driver policies, e.g., volume naming, lvol settings
 type rpcClient struct {
-	rpcURL     string
-	rpcUser    string
-	rpcPass    string
-	httpClient *http.Client
-	rpcID      int32 // json request message ID, auto incremented
+	*spdkrpc.Client
+	required []string   // rpc methods of the target type
+	probeMtx sync.Mutex // serialize probing
 }
 
-func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string) (SpdkNode, error) {
-	client := rpcClient{
-		rpcURL:     rpcURL,
-		rpcUser:    rpcUser,
-		rpcPass:    rpcPass,
-		httpClient: &http.Client{Timeout: cfgRPCTimeoutSeconds * time.Second},
+// NewSpdkNode creates a SPDK storage node. Spdk target is not contacted until
+// first use, when it's probed for version and supported methods, and calls
+// fail if any required method is missing, see rpcClient.ready.
+// tlsConfig applies to https rpcURL only, nil to verify server with system roots.
+func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string,
+	tlsConfig *spdkrpc.TLSConfig) (SpdkNode, error) {
+	c, err := spdkrpc.NewClient(rpcURL, rpcUser, rpcPass)
+	if err != nil {
+		return nil, err
 	}
+	c.Observer = rpcObserver{}
+	if tlsConfig != nil {
+		err = c.SetTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := &rpcClient{Client: c}
 
+	var node SpdkNode
+	var required []string
 	switch strings.ToLower(targetType) {
 	case "nvme-rdma":
-		return newNVMf(&client, "RDMA", targetAddr), nil
+		node, required = newNVMf(client, "RDMA", targetAddr), requiredNVMfMethods
 	case "nvme-tcp":
-		return newNVMf(&client, "TCP", targetAddr), nil
+		node, required = newNVMf(client, "TCP", targetAddr), requiredNVMfMethods
 	case "iscsi":
-		return newISCSI(&client, targetAddr), nil
+		node, required = newISCSI(client, targetAddr), requiredISCSIMethods
+	case "vhost":
+		// targetAddr is vhost socket directory on client node, optional
+		node, required = newVhost(client, targetAddr), requiredVhostMethods
+	case "nbd":
+		// spdk target local to the node consuming its volumes
+		node, required = newNBD(client), requiredNBDMethods
 	default:
 		return nil, fmt.Errorf("unknown transport: %s", targetType)
 	}
+	client.required = append(required, requiredLvolMethods...)
+	return node, nil
 }
 
-func (client *rpcClient) info() string {
-	return client.rpcURL
-}
+// spdk target may be unreachable when driver starts, probe it on first use,
+// and again on next use if probing fails
+func (client *rpcClient) ready(ctx context.Context) error {
+	client.probeMtx.Lock()
+	defer client.probeMtx.Unlock()
 
-func (client *rpcClient) lvStores() ([]LvStore, error) {
-	var result []struct {
-		FreeClusters  int64  `json:"free_clusters"`
-		ClusterSize   int64  `json:"cluster_size"`
-		TotalClusters int64  `json:"total_data_clusters"`
-		Name          string `json:"name"`
+	if client.Capabilities() == nil {
+		err := client.Probe(ctx)
+		if err != nil {
+			return err
+		}
 	}
+	return client.Capabilities().Require(client.required...)
+}
+
+// export rpc calls and retries as prometheus metrics
+type rpcObserver struct{}
+
+func (rpcObserver) ObserveCall(url, method string, start time.Time, err error) {
+	metrics.ObserveSpdkRPC(url, method, start, err)
+}
+
+func (rpcObserver) ObserveRetry(url, method string) {
+	metrics.ObserveSpdkRPCRetry(url, method)
+}
 
-	err := client.call("bdev_lvol_get_lvstores", nil, &result)
+func (rpcObserver) ObserveRetryResult(url, method string, err error) {
+	metrics.ObserveSpdkRPCRetryResult(url, method, err)
+}
+
+func (client *rpcClient) lvStores(ctx context.Context) ([]LvStore, error) {
+	result, err := client.BdevLvolGetLvstores(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -160,146 +225,129 @@ func (client *rpcClient) lvStores() ([]LvStore, error) {
 	return lvs, nil
 }
 
-func (client *rpcClient) createVolume(lvsName string, sizeMiB int64) (string, error) {
-	params := struct {
-		LvolName      string `json:"lvol_name"`
-		Size          int64  `json:"size"`
-		LvsName       string `json:"lvs_name"`
-		ClearMethod   string `json:"clear_method"`
-		ThinProvision bool   `json:"thin_provision"`
-	}{
-		LvolName:      "csi-" + uuid.New().String(),
+func (client *rpcClient) createVolume(ctx context.Context, lvsName string, sizeMiB int64) (string, error) {
+	return client.createVolumeNamed(ctx, "csi-"+uuid.New().String(), lvsName, sizeMiB)
+}
+
+func (client *rpcClient) createVolumeNamed(ctx context.Context, name, lvsName string, sizeMiB int64) (string, error) {
+	// spdkrpc.ErrNoSpaceLeft may happen in concurrency
+	return client.BdevLvolCreate(ctx, &spdkrpc.BdevLvolCreateParams{
+		LvolName:      name,
 		Size:          sizeMiB * 1024 * 1024,
 		LvsName:       lvsName,
 		ClearMethod:   cfgLvolClearMethod,
 		ThinProvision: cfgLvolThinProvision,
-	}
-
-	var lvolID string
-
-	err := client.call("bdev_lvol_create", &params, &lvolID)
-	if errorMatches(err, ErrJSONNoSpaceLeft) {
-		err = ErrJSONNoSpaceLeft // may happen in concurrency
-	}
+	})
+}
 
-	return lvolID, err
+func (client *rpcClient) deleteVolume(ctx context.Context, lvolID string) error {
+	// spdkrpc.ErrNoSuchDevice may happen in concurrency
+	return client.BdevLvolDelete(ctx, lvolID)
 }
 
-func (client *rpcClient) deleteVolume(lvolID string) error {
-	params := struct {
-		Name string `json:"name"`
-	}{
-		Name: lvolID,
-	}
+// snapshot of encrypted volume is marked in its lvol name, it survives driver
+// restart while snapshot keys kept by controller don't
+const encryptedSnapshotPrefix = "csi-enc-"
 
-	err := client.call("bdev_lvol_delete", &params, nil)
-	if errorMatches(err, ErrJSONNoSuchDevice) {
-		err = ErrJSONNoSuchDevice // may happen in concurrency
+func (client *rpcClient) snapshot(ctx context.Context, lvolName, snapshotName string, encrypted bool) (string, error) {
+	err := client.Capabilities().Require(FeatureSnapshot...)
+	if err != nil {
+		return "", err
 	}
 
-	return err
-}
-
-func (client *rpcClient) snapshot(lvolName, snapShotName string) (string, error) {
-	params := struct {
-		LvolName     string `json:"lvol_name"`
-		SnapShotName string `json:"snapshot_name"`
-	}{
-		LvolName:     lvolName,
-		SnapShotName: snapShotName,
+	if encrypted {
+		snapshotName = encryptedSnapshotPrefix + snapshotName
 	}
-
-	var snapshotID string
-	err := client.call("bdev_lvol_snapshot", &params, &snapshotID)
-
-	return snapshotID, err
+	return client.BdevLvolSnapshot(ctx, lvolName, snapshotName)
 }
 
-// low level rpc request/response handling
-func (client *rpcClient) call(method string, args, result interface{}) error {
-	type rpcRequest struct {
-		Ver    string `json:"jsonrpc"`
-		ID     int32  `json:"id"`
-		Method string `json:"method"`
-	}
-
-	id := atomic.AddInt32(&client.rpcID, 1)
-	request := rpcRequest{
-		Ver:    "2.0",
-		ID:     id,
-		Method: method,
+// check encryption mark of snapshot, lvol alias is "lvstore/lvol"
+func (client *rpcClient) snapshotEncrypted(ctx context.Context, snapshotID string) (bool, error) {
+	result, err := client.BdevGetBdevs(ctx, &spdkrpc.BdevGetBdevsParams{Name: snapshotID})
+	if err != nil {
+		return false, err
 	}
-
-	var data []byte
-	var err error
-
-	if args == nil {
-		data, err = json.Marshal(request)
-	} else {
-		requestWithParams := struct {
-			rpcRequest
-			Params interface{} `json:"params"`
-		}{
-			request,
-			args,
+	for i := range result {
+		for _, alias := range result[i].Aliases {
+			name := alias[strings.LastIndex(alias, "/")+1:]
+			if strings.HasPrefix(name, encryptedSnapshotPrefix) {
+				return true, nil
+			}
 		}
-		data, err = json.Marshal(requestWithParams)
-	}
-	if err != nil {
-		return fmt.Errorf("%s: %s", method, err)
 	}
+	return false, nil
+}
 
-	req, err := http.NewRequest("POST", client.rpcURL, bytes.NewReader(data))
+func (client *rpcClient) cloneVolume(ctx context.Context, snapshotID string) (string, error) {
+	err := client.Capabilities().Require(FeatureClone...)
 	if err != nil {
-		return fmt.Errorf("%s: %s", method, err)
+		return "", err
 	}
 
-	req.SetBasicAuth(client.rpcUser, client.rpcPass)
-	req.Header.Set("Content-Type", "application/json")
+	return client.BdevLvolClone(ctx, snapshotID, "csi-"+uuid.New().String())
+}
+
+func (client *rpcClient) resizeVolume(ctx context.Context, lvolID string, sizeMiB int64) error {
+	return client.BdevLvolResize(ctx, lvolID, sizeMiB*1024*1024)
+}
 
-	resp, err := client.httpClient.Do(req)
+// stack a crypto bdev on top of base bdev, returns crypto bdev name
+func (client *rpcClient) createCryptoBdev(ctx context.Context, baseBdev string, key *CryptoKey) (string, error) {
+	caps := client.Capabilities()
+	err := caps.Require(FeatureEncrypt...)
 	if err != nil {
-		return fmt.Errorf("%s: %s", method, err)
+		return "", err
 	}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("%s: HTTP error code: %d", method, resp.StatusCode)
+	name := "crypto-" + baseBdev
+	if caps.HasMethod("accel_crypto_key_create") {
+		return name, client.createCryptoBdevWithAccelKey(ctx, baseBdev, name, key)
 	}
 
-	response := struct {
-		ID    int32 `json:"id"`
-		Error struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		} `json:"error"`
-		Result interface{} `json:"result"`
-	}{
-		Result: result,
-	}
+	return client.BdevCryptoCreate(ctx, &spdkrpc.BdevCryptoCreateParams{
+		BaseBdevName: baseBdev,
+		Name:         name,
+		CryptoPmd:    cfgCryptoPMD,
+		Key:          key.Key,
+		Cipher:       key.Cipher,
+		Key2:         key.Key2,
+	})
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&response)
+// since SPDK v23.01, crypto key is registered to accel framework in hex and
+// referred by name, key is named after crypto bdev
+func (client *rpcClient) createCryptoBdevWithAccelKey(ctx context.Context, baseBdev, name string, key *CryptoKey) error {
+	err := client.AccelCryptoKeyCreate(ctx, &spdkrpc.AccelCryptoKeyCreateParams{
+		Name:   name,
+		Cipher: key.Cipher,
+		Key:    hex.EncodeToString([]byte(key.Key)),
+		Key2:   hex.EncodeToString([]byte(key.Key2)),
+	})
 	if err != nil {
-		return fmt.Errorf("%s: %s", method, err)
-	}
-	if response.ID != id {
-		return fmt.Errorf("%s: json response ID mismatch", method)
-	}
-	if response.Error.Code != 0 {
-		return fmt.Errorf("%s: json response error: %s", method, response.Error.Message)
+		return err
 	}
 
-	return nil
+	_, err = client.BdevCryptoCreate(ctx, &spdkrpc.BdevCryptoCreateParams{
+		BaseBdevName: baseBdev,
+		Name:         name,
+		KeyName:      name,
+	})
+	if err != nil {
+		client.AccelCryptoKeyDestroy(ctx, name) // nolint:errcheck // we can do little
+	}
+	return err
 }
 
-func errorMatches(errFull, errJSON error) bool {
-	if errFull == nil {
-		return false
+func (client *rpcClient) deleteCryptoBdev(ctx context.Context, cryptoBdev string) error {
+	err := client.BdevCryptoDelete(ctx, cryptoBdev)
+	if err != nil {
+		return err
 	}
-	strFull := strings.ToLower(errFull.Error())
-	strJSON := strings.ToLower(errJSON.Error())
-	strJSON = strings.TrimPrefix(strJSON, "json:")
-	strJSON = strings.TrimSpace(strJSON)
-	return strings.Contains(strFull, strJSON)
+	if client.Capabilities().HasMethod("accel_crypto_key_destroy") {
+		err = client.AccelCryptoKeyDestroy(ctx, cryptoBdev)
+		if errors.Is(err, spdkrpc.ErrNoSuchDevice) {
+			err = nil // key not created by older spdk
+		}
+	}
+	return err
 }
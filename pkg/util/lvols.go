@@ -0,0 +1,227 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// per lvol state of a target, e.g., exported nqn, embeds the bdev stack
+type lvolState interface {
+	stack() *bdevStack
+}
+
+func (stack *bdevStack) stack() *bdevStack {
+	return stack
+}
+
+// lvol bookkeeping shared by all target types, target embeds it and only
+// implements VolumeInfo, PublishVolume and UnpublishVolume
+type lvolNode struct {
+	client  *rpcClient
+	newLvol func() lvolState // initial state of created or cloned lvol
+	lvols   map[string]lvolState
+	mtx     sync.Mutex // for concurrent access to lvols map
+}
+
+func newLvolNode(client *rpcClient, newLvol func() lvolState) lvolNode {
+	return lvolNode{
+		client:  client,
+		newLvol: newLvol,
+		lvols:   make(map[string]lvolState),
+	}
+}
+
+// state of the lvol, nil if not exists
+func (node *lvolNode) lookup(lvolID string) lvolState {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	return node.lvols[lvolID]
+}
+
+func (node *lvolNode) add(lvolID string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	_, exists := node.lvols[lvolID]
+	if exists {
+		return fmt.Errorf("volume ID already exists: %s", lvolID)
+	}
+	node.lvols[lvolID] = node.newLvol()
+	return nil
+}
+
+func (node *lvolNode) Info() string {
+	return node.client.URL()
+}
+
+func (node *lvolNode) Capabilities(ctx context.Context) (*spdkrpc.Capabilities, error) {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.client.Capabilities(), nil
+}
+
+func (node *lvolNode) SetTLSConfig(config *spdkrpc.TLSConfig) error {
+	return node.client.SetTLSConfig(config)
+}
+
+func (node *lvolNode) LvStores(ctx context.Context) ([]LvStore, error) {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.client.lvStores(ctx)
+}
+
+// CreateVolume creates a logical volume and returns volume ID
+func (node *lvolNode) CreateVolume(ctx context.Context, lvsName string, sizeMiB int64) (string, error) {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return "", err
+	}
+	lvolID, err := node.client.createVolume(ctx, lvsName, sizeMiB)
+	if err != nil {
+		return "", err
+	}
+	err = node.add(lvolID)
+	if err != nil {
+		return "", err
+	}
+
+	klog.V(5).Infof("volume created: %s", lvolID)
+	return lvolID, nil
+}
+
+func (node *lvolNode) CreateSnapshot(ctx context.Context, lvolName, snapshotName string, encrypted bool) (string, error) {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return "", err
+	}
+	snapshotID, err := node.client.snapshot(ctx, lvolName, snapshotName, encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	klog.V(5).Infof("snapshot created: %s", snapshotID)
+	return snapshotID, nil
+}
+
+func (node *lvolNode) SnapshotEncrypted(ctx context.Context, snapshotID string) (bool, error) {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return false, err
+	}
+	return node.client.snapshotEncrypted(ctx, snapshotID)
+}
+
+// EncryptVolume stacks a crypto bdev on the volume
+func (node *lvolNode) EncryptVolume(ctx context.Context, lvolID string, key *CryptoKey) error {
+	lvol := node.lookup(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	return node.client.encryptStack(ctx, lvolID, lvol.stack(), key)
+}
+
+// ReplicateVolume builds raid1 over the lvol and remote replicas
+func (node *lvolNode) ReplicateVolume(ctx context.Context, lvolID string, replicas []map[string]string) error {
+	lvol := node.lookup(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	return node.client.replicateStack(ctx, lvolID, lvol.stack(), replicas)
+}
+
+// VolumeCondition checks exported bdev and replicas status
+func (node *lvolNode) VolumeCondition(ctx context.Context, lvolID string) (*VolumeCondition, error) {
+	lvol := node.lookup(lvolID)
+	if lvol == nil {
+		return nil, ErrVolumeDeleted
+	}
+	return node.client.stackCondition(ctx, lvolID, lvol.stack())
+}
+
+// RepairVolume reattaches lost replicas and starts rebuild
+func (node *lvolNode) RepairVolume(ctx context.Context, lvolID string) error {
+	lvol := node.lookup(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	return node.client.repairStack(ctx, lvolID, lvol.stack())
+}
+
+// CloneVolume creates a volume from snapshot and returns volume ID
+func (node *lvolNode) CloneVolume(ctx context.Context, snapshotID string, sizeMiB int64) (string, error) {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return "", err
+	}
+	lvolID, err := node.client.cloneVolume(ctx, snapshotID)
+	if err != nil {
+		return "", err
+	}
+	if sizeMiB > 0 {
+		err = node.client.resizeVolume(ctx, lvolID, sizeMiB)
+		if err != nil {
+			node.client.deleteVolume(ctx, lvolID) // nolint:errcheck // we can do few
+			return "", err
+		}
+	}
+	err = node.add(lvolID)
+	if err != nil {
+		return "", err
+	}
+
+	klog.V(5).Infof("volume cloned: %s, from %s", lvolID, snapshotID)
+	return lvolID, nil
+}
+
+// DeleteVolume deletes stacked bdevs (if any) and then the lvol
+func (node *lvolNode) DeleteVolume(ctx context.Context, lvolID string) error {
+	err := node.client.ready(ctx)
+	if err != nil {
+		return err
+	}
+	lvol := node.lookup(lvolID)
+	if lvol != nil {
+		err = node.client.deleteStack(ctx, lvol.stack())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = node.client.deleteVolume(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	delete(node.lvols, lvolID)
+
+	klog.V(5).Infof("volume deleted: %s", lvolID)
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// mkfs parameters in storage class, passed to node in volume context, and
+// applied only when an unformatted volume is formatted
+const (
+	mkfsBlockSizeParam  = "mkfsBlockSize"  // bytes
+	mkfsInodeRatioParam = "mkfsInodeRatio" // bytes per inode, ext only
+	mkfsReflinkParam    = "mkfsReflink"    // xfs only
+	mkfsLazyInitParam   = "mkfsLazyInit"   // lazy inode table and journal init, ext only
+	fsLabelParam        = "fsLabel"
+	fsUUIDParam         = "fsUuid"
+)
+
+var mkfsParams = []string{
+	mkfsBlockSizeParam, mkfsInodeRatioParam, mkfsReflinkParam, mkfsLazyInitParam, fsLabelParam, fsUUIDParam,
+}
+
+// per filesystem limits, see mkfs.ext4(8), mkfs.xfs(8), mkfs.btrfs(8)
+type mkfsLimits struct {
+	minBlockSize, maxBlockSize int
+	maxLabelLen                int
+	inodeRatio                 bool
+	reflink                    bool
+	lazyInit                   bool
+}
+
+var mkfsFilesystems = map[string]mkfsLimits{
+	"ext2":  {minBlockSize: 1024, maxBlockSize: 65536, maxLabelLen: 16, inodeRatio: true, lazyInit: true},
+	"ext3":  {minBlockSize: 1024, maxBlockSize: 65536, maxLabelLen: 16, inodeRatio: true, lazyInit: true},
+	"ext4":  {minBlockSize: 1024, maxBlockSize: 65536, maxLabelLen: 16, inodeRatio: true, lazyInit: true},
+	"xfs":   {minBlockSize: 512, maxBlockSize: 65536, maxLabelLen: 12, reflink: true},
+	"btrfs": {minBlockSize: 4096, maxBlockSize: 65536, maxLabelLen: 255}, // sector size
+}
+
+const (
+	minInodeRatio = 1024
+	maxInodeRatio = 64 * 1024 * 1024
+)
+
+// ValidateMkfsParams checks mkfs parameters in storage class against
+// filesystem type, empty fsType defaults to ext4. fsUuid is rejected, all
+// volumes of the class would share it, it's only set in volume attributes
+// of static or ephemeral volumes.
+func ValidateMkfsParams(fsType string, params map[string]string) error {
+	if _, exists := params[fsUUIDParam]; exists {
+		return fmt.Errorf("%s not supported in storage class, volumes would share the uuid", fsUUIDParam)
+	}
+	_, err := MkfsArgs(fsType, params)
+	return err
+}
+
+// MkfsArgs returns mkfs.<fsType> arguments, without the device, per mkfs
+// parameters in params, empty fsType defaults to ext4
+func MkfsArgs(fsType string, params map[string]string) ([]string, error) {
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	limits, supported := mkfsFilesystems[fsType]
+	if !supported {
+		for _, key := range mkfsParams {
+			if _, exists := params[key]; exists {
+				return nil, fmt.Errorf("%s not supported for fsType %s", key, fsType)
+			}
+		}
+		return nil, nil // mkfs defaults
+	}
+
+	var args []string
+	var xfsMeta []string // -m suboptions of mkfs.xfs
+	isExt := strings.HasPrefix(fsType, "ext")
+	if isExt {
+		args = append(args, "-F", "-m0") // zero blocks reserved for super-user
+	}
+
+	if value, exists := params[mkfsBlockSizeParam]; exists {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < limits.minBlockSize || n > limits.maxBlockSize || n&(n-1) != 0 {
+			return nil, fmt.Errorf("invalid %s: %s, must be power of 2 in [%d, %d] for %s",
+				mkfsBlockSizeParam, value, limits.minBlockSize, limits.maxBlockSize, fsType)
+		}
+		switch fsType {
+		case "xfs":
+			args = append(args, "-b", "size="+value)
+		case "btrfs":
+			args = append(args, "-s", value)
+		default:
+			args = append(args, "-b", value)
+		}
+	}
+
+	if value, exists := params[mkfsInodeRatioParam]; exists {
+		if !limits.inodeRatio {
+			return nil, fmt.Errorf("%s not supported for fsType %s", mkfsInodeRatioParam, fsType)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < minInodeRatio || n > maxInodeRatio {
+			return nil, fmt.Errorf("invalid %s: %s, must be in [%d, %d]", mkfsInodeRatioParam, value, minInodeRatio, maxInodeRatio)
+		}
+		args = append(args, "-i", value)
+	}
+
+	if value, exists := params[mkfsReflinkParam]; exists {
+		if !limits.reflink {
+			return nil, fmt.Errorf("%s not supported for fsType %s", mkfsReflinkParam, fsType)
+		}
+		reflink, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", mkfsReflinkParam, value)
+		}
+		xfsMeta = append(xfsMeta, "reflink="+boolFlag(reflink))
+	}
+
+	if value, exists := params[mkfsLazyInitParam]; exists {
+		if !limits.lazyInit {
+			return nil, fmt.Errorf("%s not supported for fsType %s", mkfsLazyInitParam, fsType)
+		}
+		lazyInit, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", mkfsLazyInitParam, value)
+		}
+		flag := boolFlag(lazyInit)
+		extended := "lazy_itable_init=" + flag
+		if fsType != "ext2" { // no journal
+			extended += ",lazy_journal_init=" + flag
+		}
+		args = append(args, "-E", extended)
+	}
+
+	if value, exists := params[fsLabelParam]; exists {
+		if value == "" || len(value) > limits.maxLabelLen || strings.ContainsAny(value, "\x00\n") {
+			return nil, fmt.Errorf("invalid %s: %q, at most %d bytes for %s", fsLabelParam, value, limits.maxLabelLen, fsType)
+		}
+		args = append(args, "-L", value)
+	}
+
+	if value, exists := params[fsUUIDParam]; exists {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", fsUUIDParam, value)
+		}
+		if fsType == "xfs" {
+			xfsMeta = append(xfsMeta, "uuid="+id.String())
+		} else {
+			args = append(args, "-U", id.String())
+		}
+	}
+
+	if len(xfsMeta) > 0 {
+		args = append(args, "-m", strings.Join(xfsMeta, ","))
+	}
+	return args, nil
+}
+
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
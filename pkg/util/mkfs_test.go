@@ -0,0 +1,78 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	const id = "c5e3a2b4-1f3d-4b0e-9a7c-2d8f6e1b0a93"
+	testCases := []struct {
+		fsType string
+		params map[string]string
+		args   string // "!" if invalid
+	}{
+		{"", map[string]string{"fsType": "ext4"}, "-F -m0"},
+		{"ext4", map[string]string{"mkfsBlockSize": "4096", "mkfsInodeRatio": "65536", "mkfsLazyInit": "false"},
+			"-F -m0 -b 4096 -i 65536 -E lazy_itable_init=0,lazy_journal_init=0"},
+		{"ext2", map[string]string{"mkfsLazyInit": "true", "fsLabel": "data", "fsUuid": id},
+			"-F -m0 -E lazy_itable_init=1 -L data -U " + id},
+		{"xfs", map[string]string{"mkfsBlockSize": "512", "mkfsReflink": "true", "fsUuid": id},
+			"-b size=512 -m reflink=1,uuid=" + id},
+		{"btrfs", map[string]string{"mkfsBlockSize": "4096", "fsLabel": strings.Repeat("x", 255)},
+			"-s 4096 -L " + strings.Repeat("x", 255)},
+		{"vfat", map[string]string{}, ""},
+		{"vfat", map[string]string{"fsLabel": "data"}, "!"},
+		{"ext4", map[string]string{"mkfsBlockSize": "3000"}, "!"},
+		{"ext4", map[string]string{"mkfsBlockSize": "512"}, "!"},
+		{"btrfs", map[string]string{"mkfsBlockSize": "2048"}, "!"},
+		{"ext4", map[string]string{"mkfsInodeRatio": "512"}, "!"},
+		{"xfs", map[string]string{"mkfsInodeRatio": "16384"}, "!"},
+		{"ext4", map[string]string{"mkfsReflink": "true"}, "!"},
+		{"xfs", map[string]string{"mkfsReflink": "yes"}, "!"},
+		{"btrfs", map[string]string{"mkfsLazyInit": "true"}, "!"},
+		{"xfs", map[string]string{"fsLabel": "longer-than-12"}, "!"},
+		{"ext4", map[string]string{"fsLabel": ""}, "!"},
+		{"ext4", map[string]string{"fsUuid": "not-uuid"}, "!"},
+	}
+	for _, tc := range testCases {
+		args, err := MkfsArgs(tc.fsType, tc.params)
+		if tc.args == "!" {
+			if err == nil {
+				t.Fatalf("%s %v: should be invalid, got %v", tc.fsType, tc.params, args)
+			}
+			continue
+		}
+		if err != nil || strings.Join(args, " ") != tc.args {
+			t.Fatalf("%s %v: expect %q, got %v, %v", tc.fsType, tc.params, tc.args, args, err)
+		}
+	}
+}
+
+// fsUuid is per volume, volume context only
+func TestValidateMkfsParams(t *testing.T) {
+	err := ValidateMkfsParams("ext4", map[string]string{"fsLabel": "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateMkfsParams("ext4", map[string]string{"fsUuid": "c5e3a2b4-1f3d-4b0e-9a7c-2d8f6e1b0a93"})
+	if err == nil {
+		t.Fatal("fsUuid should be rejected in storage class")
+	}
+}
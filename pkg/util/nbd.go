@@ -0,0 +1,172 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// node local spdk target whose lvols are exported to the same host through
+// nbd, no fabrics involved, node server starts and stops nbd disks through
+// its local rpc socket, see SetLocalRPC
+type nodeNBD struct {
+	lvolNode
+}
+
+type lvolNBD struct {
+	published bool
+	bdevStack
+}
+
+func newNBD(client *rpcClient) *nodeNBD {
+	return &nodeNBD{
+		lvolNode: newLvolNode(client, func() lvolState {
+			return &lvolNBD{}
+		}),
+	}
+}
+
+func (node *nodeNBD) lvol(lvolID string) *lvolNBD {
+	lvol, _ := node.lookup(lvolID).(*lvolNBD)
+	return lvol
+}
+
+// ReplicateVolume is not supported, nbd volume is local to its consumer and
+// raid1 over remote replicas defeats that
+func (node *nodeNBD) ReplicateVolume(ctx context.Context, lvolID string, replicas []map[string]string) error {
+	return errors.New("nbd volume cannot be replicated")
+}
+
+// VolumeInfo returns a string:string map containing the bdev for CSI node to
+// start nbd disk on its local spdk target.
+func (node *nodeNBD) VolumeInfo(lvolID string) (map[string]string, error) {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
+		return nil, fmt.Errorf("volume not exists: %s", lvolID)
+	}
+
+	return map[string]string{
+		"targetType": "nbd",
+		"bdev":       lvol.bdevName(lvolID),
+	}, nil
+}
+
+// PublishVolume exports nothing, nbd disk is started by node server
+func (node *nodeNBD) PublishVolume(ctx context.Context, lvolID string) error {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	if lvol.published {
+		return ErrVolumePublished
+	}
+
+	lvol.published = true
+	klog.V(5).Infof("volume published: %s", lvolID)
+	return nil
+}
+
+func (node *nodeNBD) UnpublishVolume(ctx context.Context, lvolID string) error {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	if !lvol.published {
+		return ErrVolumeUnpublished
+	}
+
+	lvol.published = false
+	klog.V(5).Infof("volume unpublished: %s", lvolID)
+	return nil
+}
+
+// node local spdk target serving nbd disks to node server
+var (
+	localClient *spdkrpc.Client
+	localMtx    sync.Mutex // protect probing localClient
+)
+
+// SetLocalRPC sets rpc url of node local spdk target, e.g.,
+// unix:///var/tmp/spdk.sock, to start and stop nbd disks of nbd volumes
+func SetLocalRPC(rpcURL string) error {
+	client, err := spdkrpc.NewClient(rpcURL, "", "")
+	if err != nil {
+		return err
+	}
+	client.Observer = rpcObserver{}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+	localClient = client
+	return nil
+}
+
+// LocalSpdkNode returns nbd spdk node of node local spdk target to provision
+// ephemeral volumes, it's probed on first use
+func LocalSpdkNode() (SpdkNode, error) {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if localClient == nil {
+		return nil, ErrEphemeralUnsupported
+	}
+	client := &rpcClient{Client: localClient}
+	client.required = append(append([]string{}, requiredNBDMethods...), requiredLvolMethods...)
+	return newNBD(client), nil
+}
+
+// local spdk target may start after node server, probe it on first use
+func localSpdk(ctx context.Context) (*spdkrpc.Client, error) {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if localClient == nil {
+		return nil, errors.New("node local spdk target not configured")
+	}
+	if localClient.Capabilities() == nil {
+		err := localClient.Probe(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := localClient.Capabilities().Require(requiredNBDMethods...)
+	if err != nil {
+		return nil, err
+	}
+	return localClient, nil
+}
+
+// nbd device exporting the bdev, empty if not found
+func findNbdDisk(ctx context.Context, client *spdkrpc.Client, bdevName string) (string, error) {
+	disks, err := client.NbdGetDisks(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	for i := range disks {
+		if disks[i].BdevName == bdevName {
+			return disks[i].NbdDevice, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
+)
+
+// nbd target runs against the fake, real spdk target would start nbd disks
+// on the test host
+func TestNBD(t *testing.T) {
+	fakeDeviceRoots(t)
+	server := spdkrpctest.NewServer(spdkrpctest.Options{})
+	defer server.Close()
+
+	err := SetLocalRPC(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { localClient = nil })
+
+	ctx := context.Background()
+	nodeIx, err := NewSpdkNode(server.URL, "", "", "nbd", "", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+	node := nodeIx.(*nodeNBD)
+	lvs, err := node.LvStores(ctx)
+	if err != nil || len(lvs) == 0 {
+		t.Fatalf("LvStores: %v, %v", lvs, err)
+	}
+	lvolID, err := node.CreateVolume(ctx, lvs[0].Name, 4)
+	if err != nil {
+		t.Fatalf("CreateVolume: %s", err)
+	}
+	err = node.PublishVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("PublishVolume: %s", err)
+	}
+	err = node.PublishVolume(ctx, lvolID)
+	if !errors.Is(err, ErrVolumePublished) {
+		t.Fatalf("expect ErrVolumePublished: %v", err)
+	}
+	volumeContext, err := node.VolumeInfo(lvolID)
+	if err != nil || volumeContext["bdev"] != lvolID {
+		t.Fatalf("VolumeInfo: %v, %v", volumeContext, err)
+	}
+	err = node.ReplicateVolume(ctx, lvolID, []map[string]string{{"targetType": "tcp"}})
+	if err == nil {
+		t.Fatal("nbd volume should not be replicated")
+	}
+
+	// fake spdk picks /dev/nbd0, kernel side is faked in sysfs
+	writeSysfs(t, "block/nbd0", map[string]string{"pid": "1234"})
+	devicePath := writeDevice(t, "nbd0")
+
+	initiator, err := NewSpdkCsiInitiator(volumeContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !initiator.Condition().Abnormal {
+		t.Fatal("should be abnormal before connected")
+	}
+	path, err := initiator.Connect(ctx)
+	if err != nil || path != devicePath {
+		t.Fatalf("Connect: %s, %v", path, err)
+	}
+	if condition := initiator.Condition(); condition.Abnormal {
+		t.Fatalf("should be normal: %s", condition.Message)
+	}
+
+	// nbd disk in use cannot be deleted
+	err = node.client.deleteVolume(ctx, lvolID)
+	if !errors.Is(err, spdkrpc.ErrBusy) {
+		t.Fatalf("expect busy: %v", err)
+	}
+
+	// node server restarted, nbd disk is found by bdev instead of started again
+	initiator, _ = NewSpdkCsiInitiator(volumeContext)
+	path, err = initiator.Connect(ctx)
+	if err != nil || path != devicePath {
+		t.Fatalf("Connect: %s, %v", path, err)
+	}
+	if calls := server.Calls("nbd_start_disk"); calls != 1 {
+		t.Fatalf("expect 1 nbd_start_disk, got %d", calls)
+	}
+
+	os.Remove(filepath.Join(sysfsRoot, "block/nbd0/pid"))
+	err = initiator.Disconnect(ctx)
+	if err != nil {
+		t.Fatalf("Disconnect: %s", err)
+	}
+	disks, err := localClient.NbdGetDisks(ctx, "")
+	if err != nil || len(disks) != 0 {
+		t.Fatalf("nbd disk not stopped: %v, %v", disks, err)
+	}
+	err = initiator.Disconnect(ctx)
+	if err != nil {
+		t.Fatalf("Disconnect not idempotent: %s", err)
+	}
+
+	err = node.UnpublishVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("UnpublishVolume: %s", err)
+	}
+	err = node.DeleteVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("DeleteVolume: %s", err)
+	}
+}
+
+func TestNBDLocalRPC(t *testing.T) {
+	localClient = nil
+	initiator, _ := NewSpdkCsiInitiator(map[string]string{"targetType": "nbd", "bdev": "lvol0"})
+	_, err := initiator.Connect(context.Background())
+	if err == nil {
+		t.Fatal("should fail without local spdk")
+	}
+	_, err = LocalSpdkNode()
+	if !errors.Is(err, ErrEphemeralUnsupported) {
+		t.Fatalf("expect ErrEphemeralUnsupported: %v", err)
+	}
+
+	server := spdkrpctest.NewServer(spdkrpctest.Options{
+		Methods: append([]string{"rpc_get_methods", "spdk_get_version"}, requiredLvolMethods...),
+	})
+	defer server.Close()
+	err = SetLocalRPC(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { localClient = nil })
+
+	_, err = initiator.Connect(context.Background())
+	if !errors.Is(err, spdkrpc.ErrMethodUnsupported) {
+		t.Fatalf("expect ErrMethodUnsupported: %v", err)
+	}
+
+	// ephemeral volumes are provisioned on the same local spdk
+	node, err := LocalSpdkNode()
+	if err != nil {
+		t.Fatalf("LocalSpdkNode: %s", err)
+	}
+	_, err = CreateEphemeralVolume(context.Background(), node, "csi-volume0", 4)
+	if !errors.Is(err, spdkrpc.ErrMethodUnsupported) {
+		t.Fatalf("expect ErrMethodUnsupported: %v", err)
+	}
+}
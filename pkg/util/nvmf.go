@@ -17,66 +17,75 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"strings"
-	"sync"
 	"sync/atomic"
 
+	"github.com/google/uuid"
 	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
 )
 
 const invalidNSID = 0
 
 type nodeNVMf struct {
-	client *rpcClient
+	lvolNode
 
 	targetType   string // RDMA, TCP
 	targetAddr   string
 	targetPort   string
 	transCreated int32
-
-	lvols map[string]*lvolNVMf
-	mtx   sync.Mutex // for concurrent access to lvols map
 }
 
 type lvolNVMf struct {
-	nsID  int
-	nqn   string
-	model string
+	nsID   int
+	nqn    string
+	model  string
+	nsUUID string // namespace uuid, identifies the disk on client node
+	bdevStack
 }
 
 func (lvol *lvolNVMf) reset() {
 	lvol.nsID = invalidNSID
 	lvol.nqn = ""
 	lvol.model = ""
+	lvol.nsUUID = ""
+}
+
+// namespace uuid is the lvol uuid, or derived from lvol id if it's not an
+// uuid, so the disk keeps the same identity across republish
+func namespaceUUID(lvolID string) uuid.UUID {
+	id, err := uuid.Parse(lvolID)
+	if err != nil {
+		id = uuid.NewSHA1(uuid.NameSpaceOID, []byte(lvolID))
+	}
+	return id
 }
 
 func newNVMf(client *rpcClient, targetType, targetAddr string) *nodeNVMf {
 	return &nodeNVMf{
-		client:     client,
+		lvolNode: newLvolNode(client, func() lvolState {
+			return &lvolNVMf{nsID: invalidNSID}
+		}),
 		targetType: targetType,
 		targetAddr: targetAddr,
 		targetPort: cfgNVMfSvcPort,
-		lvols:      make(map[string]*lvolNVMf),
 	}
 }
 
-func (node *nodeNVMf) Info() string {
-	return node.client.info()
-}
-
-func (node *nodeNVMf) LvStores() ([]LvStore, error) {
-	return node.client.lvStores()
+func (node *nodeNVMf) lvol(lvolID string) *lvolNVMf {
+	lvol, _ := node.lookup(lvolID).(*lvolNVMf)
+	return lvol
 }
 
 // VolumeInfo returns a string:string map containing information necessary
 // for CSI node(initiator) to connect to this target and identify the disk.
 func (node *nodeNVMf) VolumeInfo(lvolID string) (map[string]string, error) {
-	node.mtx.Lock()
-	lvol, exists := node.lvols[lvolID]
-	node.mtx.Unlock()
-
-	if !exists {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
 		return nil, fmt.Errorf("volume not exists: %s", lvolID)
 	}
 
@@ -86,68 +95,21 @@ func (node *nodeNVMf) VolumeInfo(lvolID string) (map[string]string, error) {
 		"targetPort": node.targetPort,
 		"nqn":        lvol.nqn,
 		"model":      lvol.model,
+		"uuid":       lvol.nsUUID,
 	}, nil
 }
 
-// CreateVolume creates a logical volume and returns volume ID
-func (node *nodeNVMf) CreateVolume(lvsName string, sizeMiB int64) (string, error) {
-	lvolID, err := node.client.createVolume(lvsName, sizeMiB)
-	if err != nil {
-		return "", err
-	}
-
-	node.mtx.Lock()
-	defer node.mtx.Unlock()
-
-	_, exists := node.lvols[lvolID]
-	if exists {
-		return "", fmt.Errorf("volume ID already exists: %s", lvolID)
-	}
-	node.lvols[lvolID] = &lvolNVMf{nsID: invalidNSID}
-
-	klog.V(5).Infof("volume created: %s", lvolID)
-	return lvolID, nil
-}
-
-func (node *nodeNVMf) CreateSnapshot(lvolName, snapshotName string) (string, error) {
-	snapshotID, err := node.client.snapshot(lvolName, snapshotName)
-	if err != nil {
-		return "", err
-	}
-
-	klog.V(5).Infof("snapshot created: %s", snapshotID)
-	return snapshotID, nil
-}
-
-func (node *nodeNVMf) DeleteVolume(lvolID string) error {
-	err := node.client.deleteVolume(lvolID)
-	if err != nil {
-		return err
-	}
-
-	node.mtx.Lock()
-	defer node.mtx.Unlock()
-
-	delete(node.lvols, lvolID)
-
-	klog.V(5).Infof("volume deleted: %s", lvolID)
-	return nil
-}
-
 // PublishVolume exports a volume through NVMf target
-func (node *nodeNVMf) PublishVolume(lvolID string) error {
+func (node *nodeNVMf) PublishVolume(ctx context.Context, lvolID string) error {
 	var err error
 
-	err = node.createTransport()
+	err = node.createTransport(ctx)
 	if err != nil {
 		return err
 	}
 
-	node.mtx.Lock()
-	lvol, exists := node.lvols[lvolID]
-	node.mtx.Unlock()
-
-	if !exists {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
 		return ErrVolumeDeleted
 	}
 	if lvol.nqn != "" {
@@ -161,44 +123,43 @@ func (node *nodeNVMf) PublishVolume(lvolID string) error {
 		}
 	}()
 
+	nsUUID := namespaceUUID(lvolID)
 	lvol.model = lvolID
-	lvol.nqn, err = node.createSubsystem(lvol.model)
+	lvol.nqn, err = node.createSubsystem(ctx, lvol.model, nsUUID)
 	if err != nil {
 		return err
 	}
 
-	lvol.nsID, err = node.subsystemAddNs(lvol.nqn, lvolID)
+	lvol.nsID, err = node.subsystemAddNs(ctx, lvol.nqn, lvol.bdevName(lvolID), nsUUID)
 	if err != nil {
-		node.deleteSubsystem(lvol.nqn) // nolint:errcheck // we can do few
+		node.client.NvmfDeleteSubsystem(ctx, lvol.nqn) // nolint:errcheck // we can do few
 		return err
 	}
 
-	err = node.subsystemAddListener(lvol.nqn)
+	err = node.subsystemAddListener(ctx, lvol.nqn)
 	if err != nil {
-		node.subsystemRemoveNs(lvol.nqn, lvol.nsID) // nolint:errcheck // ditto
-		node.deleteSubsystem(lvol.nqn)              // nolint:errcheck // ditto
+		node.client.NvmfSubsystemRemoveNs(ctx, lvol.nqn, lvol.nsID) // nolint:errcheck // ditto
+		node.client.NvmfDeleteSubsystem(ctx, lvol.nqn)              // nolint:errcheck // ditto
 		return err
 	}
 
+	lvol.nsUUID = nsUUID.String()
 	klog.V(5).Infof("volume published: %s", lvolID)
 	return nil
 }
 
-func (node *nodeNVMf) UnpublishVolume(lvolID string) error {
+func (node *nodeNVMf) UnpublishVolume(ctx context.Context, lvolID string) error {
 	var err error
 
-	node.mtx.Lock()
-	lvol, exists := node.lvols[lvolID]
-	node.mtx.Unlock()
-
-	if !exists {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
 		return ErrVolumeDeleted
 	}
 	if lvol.nqn == "" {
 		return ErrVolumeUnpublished
 	}
 
-	err = node.subsystemRemoveNs(lvol.nqn, lvol.nsID)
+	err = node.client.NvmfSubsystemRemoveNs(ctx, lvol.nqn, lvol.nsID)
 	if err != nil {
 		// we should try deleting subsystem even if we fail here
 		klog.Errorf("failed to remove namespace(nqn=%s, nsid=%d): %s", lvol.nqn, lvol.nsID, err)
@@ -206,7 +167,7 @@ func (node *nodeNVMf) UnpublishVolume(lvolID string) error {
 		lvol.nsID = invalidNSID
 	}
 
-	err = node.deleteSubsystem(lvol.nqn)
+	err = node.client.NvmfDeleteSubsystem(ctx, lvol.nqn)
 	if err != nil {
 		return err
 	}
@@ -216,22 +177,16 @@ func (node *nodeNVMf) UnpublishVolume(lvolID string) error {
 	return nil
 }
 
-func (node *nodeNVMf) createSubsystem(model string) (string, error) {
+func (node *nodeNVMf) createSubsystem(ctx context.Context, model string, nsUUID uuid.UUID) (string, error) {
 	nqn := "nqn.2020-04.io.spdk.csi:uuid:" + model
 
-	params := struct {
-		Nqn          string `json:"nqn"`
-		AllowAnyHost bool   `json:"allow_any_host"`
-		SerialNumber string `json:"serial_number"`
-		ModelNumber  string `json:"model_number"`
-	}{
+	// serial number is at most 20 characters, unique per subsystem
+	err := node.client.NvmfCreateSubsystem(ctx, &spdkrpc.NvmfCreateSubsystemParams{
 		Nqn:          nqn,
 		AllowAnyHost: cfgAllowAnyHost,
-		SerialNumber: "spdkcsi-sn",
-		ModelNumber:  model, // client matches imported disk with model string
-	}
-
-	err := node.client.call("nvmf_create_subsystem", &params, nil)
+		SerialNumber: "spdkcsi-" + hex.EncodeToString(nsUUID[:6]),
+		ModelNumber:  model,
+	})
 	if err != nil {
 		return "", err
 	}
@@ -239,95 +194,56 @@ func (node *nodeNVMf) createSubsystem(model string) (string, error) {
 	return nqn, nil
 }
 
-func (node *nodeNVMf) subsystemAddNs(nqn, lvolID string) (int, error) {
-	type namespace struct {
-		BdevName string `json:"bdev_name"`
-	}
-
-	params := struct {
-		Nqn       string    `json:"nqn"`
-		Namespace namespace `json:"namespace"`
-	}{
-		Nqn: nqn,
-		Namespace: namespace{
-			BdevName: lvolID,
-		},
-	}
-
-	var nsID int
-
-	err := node.client.call("nvmf_subsystem_add_ns", &params, &nsID)
-	return nsID, err
-}
-
-func (node *nodeNVMf) subsystemAddListener(nqn string) error {
-	type listenAddress struct {
-		TrType  string `json:"trtype"`
-		AdrFam  string `json:"adrfam"`
-		TrAddr  string `json:"traddr"`
-		TrSvcID string `json:"trsvcid"`
-	}
-
-	params := struct {
-		Nqn           string        `json:"nqn"`
-		ListenAddress listenAddress `json:"listen_address"`
-	}{
-		Nqn: nqn,
-		ListenAddress: listenAddress{
-			TrType:  node.targetType,
-			TrAddr:  node.targetAddr,
-			TrSvcID: node.targetPort,
-			AdrFam:  cfgAddrFamily,
-		},
-	}
-
-	return node.client.call("nvmf_subsystem_add_listener", &params, nil)
-}
-
-func (node *nodeNVMf) subsystemRemoveNs(nqn string, nsID int) error {
-	params := struct {
-		Nqn  string `json:"nqn"`
-		NsID int    `json:"nsid"`
-	}{
-		Nqn:  nqn,
-		NsID: nsID,
-	}
-
-	return node.client.call("nvmf_subsystem_remove_ns", &params, nil)
+// client matches imported disk with namespace uuid, nguid is the same 16 bytes
+func (node *nodeNVMf) subsystemAddNs(ctx context.Context, nqn, bdevName string, nsUUID uuid.UUID) (int, error) {
+	return node.client.NvmfSubsystemAddNs(ctx, nqn, &spdkrpc.NvmfNamespace{
+		BdevName: bdevName,
+		NGUID:    strings.ToUpper(hex.EncodeToString(nsUUID[:])),
+		UUID:     nsUUID.String(),
+	})
 }
 
-func (node *nodeNVMf) deleteSubsystem(nqn string) error {
-	params := struct {
-		Nqn string `json:"nqn"`
-	}{
-		Nqn: nqn,
-	}
-
-	return node.client.call("nvmf_delete_subsystem", &params, nil)
+func (node *nodeNVMf) subsystemAddListener(ctx context.Context, nqn string) error {
+	return node.client.NvmfSubsystemAddListener(ctx, nqn, &spdkrpc.NvmfListenAddress{
+		TrType:  node.targetType,
+		TrAddr:  node.targetAddr,
+		TrSvcID: node.targetPort,
+		AdrFam:  cfgAddrFamily,
+	})
 }
 
-func (node *nodeNVMf) createTransport() error {
+func (node *nodeNVMf) createTransport(ctx context.Context) error {
 	// concurrent requests can happen despite this fast path check
 	if atomic.LoadInt32(&node.transCreated) != 0 {
 		return nil
 	}
 
 	// TODO: support transport parameters
-	params := struct {
-		TrType string `json:"trtype"`
-	}{
-		TrType: node.targetType,
+	err := node.client.NvmfCreateTransport(ctx, &spdkrpc.NvmfCreateTransportParams{TrType: node.targetType})
+	if err != nil {
+		// we may fail as transport is created by concurrent calls or previous
+		// driver instance, check transport availability again
+		exists, errGet := node.transportExists(ctx)
+		if errGet != nil || !exists {
+			return err
+		}
+	} else {
+		klog.V(5).Infof("Transport created: %s,%s", node.targetAddr, node.targetType)
 	}
 
-	err := node.client.call("nvmf_create_transport", &params, nil)
+	atomic.StoreInt32(&node.transCreated, 1)
+	return nil
+}
 
-	if err == nil {
-		klog.V(5).Infof("Transport created: %s,%s", node.targetAddr, node.targetType)
-		atomic.StoreInt32(&node.transCreated, 1)
-	} else if strings.Contains(err.Error(), "already exists") {
-		err = nil // ignore transport already exists error
-		atomic.StoreInt32(&node.transCreated, 1)
+func (node *nodeNVMf) transportExists(ctx context.Context) (bool, error) {
+	results, err := node.client.NvmfGetTransports(ctx)
+	if err != nil {
+		return false, err
 	}
-
-	return err
+	for _, result := range results {
+		if strings.EqualFold(result.TrType, node.targetType) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -14,7 +14,8 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-// NOTE: This test requires spdk target and jsonrpc http proxy run on localhost
+// NOTE: This test runs against an in-memory fake spdk target by default. To
+// test with real spdk target and jsonrpc http proxy on localhost:
 // - start spdk target server
 //   $ spdk/app/spdk_tgt/spdk_tgt
 // - create test bdev and volume store
@@ -22,27 +23,44 @@ limitations under the License.
 //   $ spdk/scripts/rpc.py bdev_lvol_create_lvstore Malloc0 lvs0
 // - start jsonrpc http proxy
 //   $ spdk/scripts/rpc_http_proxy.py 127.0.0.1 9009 spdkcsiuser spdkcsipass
+// - run test
+//   $ SPDKCSI_TEST_RPC_URL=http://127.0.0.1:9009 go test
 
 package util
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
 )
 
 const (
-	rpcURL  = "http://127.0.0.1:9009"
 	rpcUser = "spdkcsiuser"
 	rpcPass = "spdkcsipass"
 	trAddr  = "127.0.0.1"
 )
 
+// fake spdk target unless spdkrpctest.EnvRPCURL is set
+func testRPCURL(t *testing.T) string {
+	if rpcURL := os.Getenv(spdkrpctest.EnvRPCURL); rpcURL != "" {
+		return rpcURL
+	}
+	server := spdkrpctest.NewServer(spdkrpctest.Options{User: rpcUser, Password: rpcPass})
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
 func TestNVMeTCP(t *testing.T) {
 	testNVMeoF("nvme-tcp", t)
 }
 
 func testNVMeoF(trType string, t *testing.T) {
-	nodeIx, err := NewSpdkNode(rpcURL, rpcUser, rpcPass, trType, trAddr)
+	nodeIx, err := NewSpdkNode(testRPCURL(t), rpcUser, rpcPass, trType, trAddr, nil)
 	if err != nil {
 		t.Fatalf("NewSpdkNode: %s", err)
 	}
@@ -52,7 +70,9 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatal("cannot cast to nodeNVMf")
 	}
 
-	lvs, err := node.LvStores()
+	ctx := context.Background()
+
+	lvs, err := node.LvStores(ctx)
 	if err != nil {
 		t.Fatalf("LvStores: %s", err)
 	}
@@ -63,7 +83,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("No free space: %s", lvs[0].Name)
 	}
 
-	lvolID, err := node.CreateVolume(lvs[0].Name, lvs[0].FreeSizeMiB)
+	lvolID, err := node.CreateVolume(ctx, lvs[0].Name, lvs[0].FreeSizeMiB)
 	if err != nil {
 		t.Fatalf("CreateVolume: %s", err)
 	}
@@ -72,22 +92,26 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateVolumeCreated: %s", err)
 	}
 
-	err = node.PublishVolume(lvolID)
+	err = node.PublishVolume(ctx, lvolID)
 	if err != nil {
 		t.Fatalf("PublishVolume: %s", err)
 	}
 
-	nqn := node.lvols[lvolID].nqn
-	nsID := node.lvols[lvolID].nsID
+	nqn := node.lvol(lvolID).nqn
+	nsID := node.lvol(lvolID).nsID
 
 	err = validateVolumePublished(node, nqn, nsID)
 	if err != nil {
 		t.Fatalf("validateVolumePublished: %s", err)
 	}
+	err = validateVolumeIdentity(node, lvolID)
+	if err != nil {
+		t.Fatalf("validateVolumeIdentity: %s", err)
+	}
 
 	snapshotName := "snapshot-pvc"
 	var snapshotID string
-	snapshotID, err = node.CreateSnapshot(lvolID, snapshotName)
+	snapshotID, err = node.CreateSnapshot(ctx, lvolID, snapshotName, false)
 	if err != nil {
 		t.Fatalf("CreateSnapshot: %s", err)
 	}
@@ -96,7 +120,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateCreateSnapshot: %s", err)
 	}
 
-	err = node.DeleteVolume(snapshotID)
+	err = node.DeleteVolume(ctx, snapshotID)
 	if err != nil {
 		t.Fatalf("DeleteSnapshot: %s", err)
 	}
@@ -105,7 +129,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateSnapshotDeleted: %s", err)
 	}
 
-	err = node.UnpublishVolume(lvolID)
+	err = node.UnpublishVolume(ctx, lvolID)
 	if err != nil {
 		t.Fatalf("UnpublishVolume: %s", err)
 	}
@@ -114,7 +138,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateVolumeUnpublished: %s", err)
 	}
 
-	err = node.DeleteVolume(lvolID)
+	err = node.DeleteVolume(ctx, lvolID)
 	if err != nil {
 		t.Fatalf("DeleteVolume: %s", err)
 	}
@@ -125,18 +149,7 @@ func testNVMeoF(trType string, t *testing.T) {
 }
 
 func validateVolumeCreated(node *nodeNVMf, lvolID string) error {
-	params := struct {
-		Name string `json:"name"`
-	}{
-		Name: lvolID,
-	}
-
-	var result []struct {
-		BlockSize int64 `json:"block_size"`
-		NumBlocks int64 `json:"num_blocks"`
-	}
-
-	err := node.client.call("bdev_get_bdevs", &params, &result)
+	result, err := node.client.BdevGetBdevs(context.Background(), &spdkrpc.BdevGetBdevsParams{Name: lvolID})
 	if err != nil {
 		return err
 	}
@@ -149,17 +162,7 @@ func validateVolumeCreated(node *nodeNVMf, lvolID string) error {
 }
 
 func validateVolumePublished(node *nodeNVMf, nqn string, nsID int) error {
-	type namespace struct {
-		NsID int `json:"nsid"`
-	}
-
-	var results []struct {
-		Nqn         string      `json:"nqn"`
-		ModelNumber string      `json:"model_number"`
-		Namespaces  []namespace `json:"namespaces"`
-	}
-
-	err := node.client.call("nvmf_get_subsystems", nil, &results)
+	results, err := node.client.NvmfGetSubsystems(context.Background())
 	if err != nil {
 		return err
 	}
@@ -180,6 +183,51 @@ func validateVolumePublished(node *nodeNVMf, nqn string, nsID int) error {
 	return fmt.Errorf("nqn not found: %s", nqn)
 }
 
+// namespace uuid and nguid come from lvol uuid, serial number is unique
+func validateVolumeIdentity(node *nodeNVMf, lvolID string) error {
+	info, err := node.VolumeInfo(lvolID)
+	if err != nil {
+		return err
+	}
+	if info["uuid"] != lvolID {
+		return fmt.Errorf("uuid mismatch: %s", info["uuid"])
+	}
+
+	results, err := node.client.NvmfGetSubsystems(context.Background())
+	if err != nil {
+		return err
+	}
+	for i := range results {
+		result := &results[i]
+		if result.Nqn != info["nqn"] {
+			continue
+		}
+		ns := &result.Namespaces[0]
+		if ns.UUID != lvolID || ns.NGUID != strings.ToUpper(strings.ReplaceAll(lvolID, "-", "")) {
+			return fmt.Errorf("namespace uuid %s, nguid %s", ns.UUID, ns.NGUID)
+		}
+		if result.SerialNumber != "spdkcsi-"+lvolID[:8]+lvolID[9:13] {
+			return fmt.Errorf("serial number %s", result.SerialNumber)
+		}
+		return nil
+	}
+	return fmt.Errorf("nqn not found: %s", info["nqn"])
+}
+
+func TestNamespaceUUID(t *testing.T) {
+	id := "c5e3a2b4-1f3d-4b0e-9a7c-2d8f6e1b0a93"
+	if namespaceUUID(id).String() != id {
+		t.Fatalf("namespace uuid of %s: %s", id, namespaceUUID(id))
+	}
+	// not an uuid, derived uuid must be stable
+	if namespaceUUID("lvs0/lvol0") != namespaceUUID("lvs0/lvol0") {
+		t.Fatal("namespace uuid not stable")
+	}
+	if namespaceUUID("lvs0/lvol0") == namespaceUUID("lvs0/lvol1") {
+		t.Fatal("namespace uuid not unique")
+	}
+}
+
 func validateVolumeDeleted(node *nodeNVMf, lvolID string) error {
 	if validateVolumeCreated(node, lvolID) == nil {
 		return fmt.Errorf("volume not deleted")
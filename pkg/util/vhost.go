@@ -0,0 +1,129 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+)
+
+// vhost controller name is also the socket name
+const vhostCtrlrPrefix = "spdkcsi-"
+
+// vhost-user-blk target, spdk runs on the same host as the vm runtime which
+// connects to the controller socket directly
+type nodeVhost struct {
+	lvolNode
+	socketDir string // socket directory on client node, as reported by spdk if empty
+}
+
+type lvolVhost struct {
+	socketPath string // empty if not published
+	bdevStack
+}
+
+func (lvol *lvolVhost) reset() {
+	lvol.socketPath = ""
+}
+
+func newVhost(client *rpcClient, socketDir string) *nodeVhost {
+	return &nodeVhost{
+		lvolNode: newLvolNode(client, func() lvolState {
+			return &lvolVhost{}
+		}),
+		socketDir: socketDir,
+	}
+}
+
+func (node *nodeVhost) lvol(lvolID string) *lvolVhost {
+	lvol, _ := node.lookup(lvolID).(*lvolVhost)
+	return lvol
+}
+
+// VolumeInfo returns a string:string map containing information necessary
+// for CSI node to pass the controller socket to vm runtime.
+func (node *nodeVhost) VolumeInfo(lvolID string) (map[string]string, error) {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
+		return nil, fmt.Errorf("volume not exists: %s", lvolID)
+	}
+
+	return map[string]string{
+		"targetType": "vhost",
+		"socketPath": lvol.socketPath,
+	}, nil
+}
+
+// PublishVolume creates a vhost-user-blk controller over the volume
+func (node *nodeVhost) PublishVolume(ctx context.Context, lvolID string) error {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	if lvol.socketPath != "" {
+		return ErrVolumePublished
+	}
+
+	ctrlr := vhostCtrlrPrefix + lvolID
+	err := node.client.VhostCreateBlkController(ctx, &spdkrpc.VhostCreateBlkControllerParams{
+		Ctrlr:   ctrlr,
+		DevName: lvol.bdevName(lvolID),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctrlrs, err := node.client.VhostGetControllers(ctx, ctrlr)
+	if err == nil && len(ctrlrs) != 1 {
+		err = fmt.Errorf("vhost controller not found: %s", ctrlr)
+	}
+	if err != nil {
+		node.client.VhostDeleteController(ctx, ctrlr) // nolint:errcheck // we can do few
+		return err
+	}
+
+	lvol.socketPath = ctrlrs[0].Socket
+	if node.socketDir != "" {
+		lvol.socketPath = filepath.Join(node.socketDir, filepath.Base(ctrlrs[0].Socket))
+	}
+	klog.V(5).Infof("volume published: %s, %s", lvolID, lvol.socketPath)
+	return nil
+}
+
+func (node *nodeVhost) UnpublishVolume(ctx context.Context, lvolID string) error {
+	lvol := node.lvol(lvolID)
+	if lvol == nil {
+		return ErrVolumeDeleted
+	}
+	if lvol.socketPath == "" {
+		return ErrVolumeUnpublished
+	}
+
+	err := node.client.VhostDeleteController(ctx, vhostCtrlrPrefix+lvolID)
+	if err != nil {
+		return err
+	}
+
+	lvol.reset()
+	klog.V(5).Infof("volume unpublished: %s", lvolID)
+	return nil
+}
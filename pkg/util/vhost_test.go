@@ -0,0 +1,168 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/spdkrpc"
+	"github.com/spdk/spdk-csi/pkg/spdkrpc/spdkrpctest"
+)
+
+// vhost target runs against the fake, real spdk target may not enable vhost
+func TestVhost(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{VhostSocketDir: "/var/tmp/vhost"})
+	defer server.Close()
+
+	ctx := context.Background()
+	nodeIx, err := NewSpdkNode(server.URL, "", "", "vhost", "", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+	node := nodeIx.(*nodeVhost)
+
+	lvs, err := node.LvStores(ctx)
+	if err != nil || len(lvs) == 0 {
+		t.Fatalf("LvStores: %v, %v", lvs, err)
+	}
+	lvolID, err := node.CreateVolume(ctx, lvs[0].Name, 4)
+	if err != nil {
+		t.Fatalf("CreateVolume: %s", err)
+	}
+
+	err = node.PublishVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("PublishVolume: %s", err)
+	}
+	err = node.PublishVolume(ctx, lvolID)
+	if !errors.Is(err, ErrVolumePublished) {
+		t.Fatalf("expect ErrVolumePublished: %v", err)
+	}
+	info, err := node.VolumeInfo(lvolID)
+	if err != nil {
+		t.Fatalf("VolumeInfo: %s", err)
+	}
+	if info["targetType"] != "vhost" || info["socketPath"] != "/var/tmp/vhost/spdkcsi-"+lvolID {
+		t.Fatalf("unexpected volume info: %v", info)
+	}
+	ctrlrs, err := node.client.VhostGetControllers(ctx, "spdkcsi-"+lvolID)
+	if err != nil || len(ctrlrs) != 1 || ctrlrs[0].BackendSpecific.Block.Bdev != lvolID {
+		t.Fatalf("VhostGetControllers: %v, %v", ctrlrs, err)
+	}
+
+	// published volume is claimed by vhost controller
+	err = node.client.deleteVolume(ctx, lvolID)
+	if !errors.Is(err, spdkrpc.ErrBusy) {
+		t.Fatalf("expect busy: %v", err)
+	}
+
+	err = node.UnpublishVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("UnpublishVolume: %s", err)
+	}
+	ctrlrs, err = node.client.VhostGetControllers(ctx, "")
+	if err != nil || len(ctrlrs) != 0 {
+		t.Fatalf("vhost controller not deleted: %v, %v", ctrlrs, err)
+	}
+	err = node.DeleteVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("DeleteVolume: %s", err)
+	}
+
+	// socket directory on client node differs from spdk target
+	nodeIx, err = NewSpdkNode(server.URL, "", "", "vhost", "/run/spdk", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+	node = nodeIx.(*nodeVhost)
+	lvolID, err = node.CreateVolume(ctx, lvs[0].Name, 4)
+	if err != nil {
+		t.Fatalf("CreateVolume: %s", err)
+	}
+	err = node.PublishVolume(ctx, lvolID)
+	if err != nil {
+		t.Fatalf("PublishVolume: %s", err)
+	}
+	info, _ = node.VolumeInfo(lvolID)
+	if info["socketPath"] != "/run/spdk/spdkcsi-"+lvolID {
+		t.Fatalf("unexpected volume info: %v", info)
+	}
+}
+
+func TestVhostUnsupported(t *testing.T) {
+	server := spdkrpctest.NewServer(spdkrpctest.Options{
+		Methods: append(append([]string{"rpc_get_methods", "spdk_get_version"}, requiredLvolMethods...), requiredNVMfMethods...),
+	})
+	defer server.Close()
+
+	node, err := NewSpdkNode(server.URL, "", "", "vhost", "", nil)
+	if err != nil {
+		t.Fatalf("NewSpdkNode: %s", err)
+	}
+	_, err = node.LvStores(context.Background())
+	if !errors.Is(err, spdkrpc.ErrMethodUnsupported) {
+		t.Fatalf("expect ErrMethodUnsupported: %v", err)
+	}
+}
+
+func TestInitiatorVhost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spdkcsi-vhost*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "spdkcsi-test")
+	initiator, err := NewSpdkCsiInitiator(map[string]string{"targetType": "vhost", "socketPath": socketPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !initiator.Condition().Abnormal {
+		t.Fatal("should be abnormal without socket")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	path, err := initiator.Connect(context.Background())
+	if err != nil || path != socketPath {
+		t.Fatalf("Connect: %s, %v", path, err)
+	}
+	if condition := initiator.Condition(); condition.Abnormal {
+		t.Fatalf("should be normal: %s", condition.Message)
+	}
+	err = initiator.Disconnect(context.Background())
+	if err != nil {
+		t.Fatalf("Disconnect: %s", err)
+	}
+
+	// not a socket
+	initiator, _ = NewSpdkCsiInitiator(map[string]string{"targetType": "vhost", "socketPath": dir})
+	_, err = initiator.Connect(context.Background())
+	if err == nil {
+		t.Fatal("should fail on non socket")
+	}
+}